@@ -1,14 +1,22 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+// thumbnailKeyPrefix is where thumbnails go when they're kept in storage
+// rather than the assets directory
+const thumbnailKeyPrefix = "thumbnails/"
+
 func (cfg apiConfig) ensureAssetsDir() error {
 	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
 		return os.Mkdir(cfg.assetsRoot, 0755)
@@ -16,25 +24,74 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	ext := mediaTypeToExt(mediaType)
-	key := make([]byte, 32)
-	_, err := rand.Read(key)
-	if err != nil {
-		panic("failed to generate random bytes")
+// immutableAssetCacheControl is sent with content addressed assets, which
+// never change at the same path
+const immutableAssetCacheControl = "public, max-age=31536000, immutable"
+
+// Content addressed asset names, as built by getAssetPath. Assets stored
+// before they were named this way have random names and aren't cached.
+var immutableAssetPattern = regexp.MustCompile(`^[0-9a-f-]{36}(-\d+)?\.[0-9a-f]{16}\.[a-z0-9+.-]+$`)
+
+// getAssetPath names an asset after what it belongs to and a hash of its
+// contents, e.g. "<videoID>-640.<hash>.jpeg". New contents get a new
+// name, so anything at a given path can be cached forever.
+func getAssetPath(name, contentHash, mediaType string) string {
+	return fmt.Sprintf("%s.%s%s", name, contentHash, mediaTypeToExt(mediaType))
+}
+
+// assetContentHash is the hash getAssetPath puts in an asset's name
+func assetContentHash(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
 	}
-	RawURLEncoding := base64.RawURLEncoding.EncodeToString(key)
-	return fmt.Sprintf("%s%s", RawURLEncoding, ext)
+	return hex.EncodeToString(hasher.Sum(nil)[:8]), nil
 }
 
 func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
 	return filepath.Join(cfg.assetsRoot, assetPath)
 }
 
+// getAssetURL is where clients fetch an asset from: the CDN in front of
+// the assets directory if ASSET_CDN_BASE_URL is set, the API otherwise
 func (cfg apiConfig) getAssetURL(assetPath string) string {
+	assetPath = strings.TrimLeft(assetPath, "/")
+	if cfg.assetCDNBaseURL != "" {
+		return strings.TrimRight(cfg.assetCDNBaseURL, "/") + "/assets/" + assetPath
+	}
+	return cfg.localAssetURL(assetPath)
+}
+
+// defaultThumbnailURL is where the image shown for videos without a
+// thumbnail is, empty if there's none
+func (cfg apiConfig) defaultThumbnailURL() string {
+	if cfg.defaultThumbnail == "" || isAbsoluteURL(cfg.defaultThumbnail) {
+		return cfg.defaultThumbnail
+	}
+	return cfg.getAssetURL(cfg.defaultThumbnail)
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (cfg apiConfig) localAssetURL(assetPath string) string {
+	return cfg.publicURL("/assets/" + assetPath)
+}
+
+// legacyLocalAssetURL is localAssetURL as recorded before PUBLIC_BASE_URL,
+// when every asset URL pointed at localhost
+func (cfg apiConfig) legacyLocalAssetURL(assetPath string) string {
 	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
 }
 
+// publicURL is where clients reach urlPath, e.g. "/share/abc", on this
+// server
+func (cfg apiConfig) publicURL(urlPath string) string {
+	return cfg.publicBaseURL + urlPath
+}
+
 func mediaTypeToExt(mediaType string) string {
 	parts := strings.Split(mediaType, "/")
 	if len(parts) != 2 {
@@ -42,3 +99,68 @@ func mediaTypeToExt(mediaType string) string {
 	}
 	return "." + parts[1]
 }
+
+// putAsset stores an asset and returns the URL to record for it: a
+// "bucket,key" value in the default region's storage if thumbnails are kept
+// there, otherwise a getAssetURL for a file in the assets directory
+func (cfg *apiConfig) putAsset(ctx context.Context, assetPath string, r io.Reader, mediaType string) (string, error) {
+	if cfg.thumbnailsInStorage {
+		storage, err := cfg.storageRegions.forRegion("")
+		if err != nil {
+			return "", err
+		}
+		key := tenantKey(requestTenant(ctx), thumbnailKeyPrefix+assetPath)
+		if err := storage.Put(ctx, key, r, PutOptions{ContentType: mediaType, CacheControl: immutableAssetCacheControl}); err != nil {
+			return "", err
+		}
+		return storedURL(storage, key), nil
+	}
+
+	f, err := os.Create(cfg.getAssetDiskPath(assetPath))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return cfg.getAssetURL(assetPath), nil
+}
+
+// isStoredAsset reports whether an asset URL is a "bucket,key" value, which
+// has to be signed before clients can use it, rather than a local asset URL
+func isStoredAsset(assetURL string) bool {
+	if strings.Contains(assetURL, "://") {
+		return false
+	}
+	_, _, err := splitStoredURL(assetURL)
+	return err == nil
+}
+
+// deleteAssetByURL removes the object behind a stored "bucket,key" value or
+// the file behind a URL built by getAssetURL. URLs that don't point at our
+// assets (or files already gone) are ignored.
+func (cfg apiConfig) deleteAssetByURL(ctx context.Context, assetURL string) error {
+	if isStoredAsset(assetURL) {
+		return cfg.deleteStoredObject(ctx, assetURL)
+	}
+	// Assets recorded before the CDN was set up, or while it was switched
+	// off, still point at the API
+	var assetPath string
+	for _, prefix := range []string{cfg.getAssetURL(""), cfg.localAssetURL(""), cfg.legacyLocalAssetURL("")} {
+		if strings.HasPrefix(assetURL, prefix) {
+			assetPath = filepath.Base(strings.TrimPrefix(assetURL, prefix))
+			break
+		}
+	}
+	if assetPath == "" {
+		return nil
+	}
+	err := os.Remove(cfg.getAssetDiskPath(assetPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
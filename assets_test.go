@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestGetAssetURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		cdnBaseURL string
+		assetPath  string
+		want       string
+	}{
+		{
+			name:      "no CDN",
+			assetPath: "thumb.abc123.jpeg",
+			want:      "http://localhost:8091/assets/thumb.abc123.jpeg",
+		},
+		{
+			name:      "no CDN, leading slash",
+			assetPath: "/thumb.abc123.jpeg",
+			want:      "http://localhost:8091/assets/thumb.abc123.jpeg",
+		},
+		{
+			name:       "CDN",
+			cdnBaseURL: "https://cdn.example.com",
+			assetPath:  "thumb.abc123.jpeg",
+			want:       "https://cdn.example.com/assets/thumb.abc123.jpeg",
+		},
+		{
+			name:       "CDN with a trailing slash",
+			cdnBaseURL: "https://cdn.example.com/",
+			assetPath:  "thumb.abc123.jpeg",
+			want:       "https://cdn.example.com/assets/thumb.abc123.jpeg",
+		},
+		{
+			name:       "CDN, leading slashes",
+			cdnBaseURL: "https://cdn.example.com",
+			assetPath:  "//thumb.abc123.jpeg",
+			want:       "https://cdn.example.com/assets/thumb.abc123.jpeg",
+		},
+		{
+			name:       "CDN under a path",
+			cdnBaseURL: "https://cdn.example.com/tubely/",
+			assetPath:  "/thumb.abc123.jpeg",
+			want:       "https://cdn.example.com/tubely/assets/thumb.abc123.jpeg",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.assetCDNBaseURL = tc.cdnBaseURL
+			if got := cfg.getAssetURL(tc.assetPath); got != tc.want {
+				t.Errorf("getAssetURL(%q) = %q, want %q", tc.assetPath, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDefaultThumbnailURL(t *testing.T) {
+	tests := []struct {
+		name             string
+		cdnBaseURL       string
+		defaultThumbnail string
+		want             string
+	}{
+		{name: "none", want: ""},
+		{name: "asset without a CDN", defaultThumbnail: "placeholder.png", want: "http://localhost:8091/assets/placeholder.png"},
+		{name: "asset on the CDN", cdnBaseURL: "https://cdn.example.com", defaultThumbnail: "placeholder.png", want: "https://cdn.example.com/assets/placeholder.png"},
+		{name: "URL elsewhere", cdnBaseURL: "https://cdn.example.com", defaultThumbnail: "https://images.example.com/placeholder.png", want: "https://images.example.com/placeholder.png"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.assetCDNBaseURL = tc.cdnBaseURL
+			cfg.defaultThumbnail = tc.defaultThumbnail
+			if got := cfg.defaultThumbnailURL(); got != tc.want {
+				t.Errorf("defaultThumbnailURL = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
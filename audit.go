@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	auditActionVideoUpload     = "video_upload"
+	auditActionThumbnailUpload = "thumbnail_upload"
+	auditActionCaptionUpload   = "caption_upload"
+	auditActionVideoReprocess  = "video_reprocess"
+	auditActionVideoRotate     = "video_rotate"
+)
+
+// recordAudit notes an upload in the audit log. It's best effort: a failed
+// write is logged, but doesn't fail the upload it describes.
+func (cfg *apiConfig) recordAudit(r *http.Request, action string, userID, videoID uuid.UUID, contentType string, size int64) {
+	err := cfg.db.CreateAuditEntry(database.CreateAuditEntryParams{
+		UserID:      userID,
+		VideoID:     videoID,
+		Action:      action,
+		ContentType: contentType,
+		Size:        size,
+		RemoteIP:    remoteIP(r),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't write audit log entry", "action", action, "video_id", videoID, "user_id", userID, "error", err)
+	}
+}
+
+// remoteIP is the address the request came from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handlerListAudit lists audit log entries, newest first, for admins only.
+// ?userID= narrows it to one user.
+func (cfg *apiConfig) handlerListAudit(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Entries []database.AuditEntry `json:"entries"`
+		Total   int                   `json:"total"`
+		Limit   int                   `json:"limit"`
+		Offset  int                   `json:"offset"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	_, role, err := auth.ValidateJWTWithRole(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if role != auth.RoleAdmin {
+		respondWithError(w, http.StatusForbidden, "Only admins can view the audit log", nil)
+		return
+	}
+
+	userID := uuid.Nil
+	if userIDString := r.URL.Query().Get("userID"); userIDString != "" {
+		userID, err = uuid.Parse(userIDString)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid userID", err)
+			return
+		}
+	}
+
+	limit := defaultVideoPageSize
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", err)
+			return
+		}
+		limit = min(limit, maxVideoPageSize)
+	}
+
+	offset := 0
+	if offsetString := r.URL.Query().Get("offset"); offsetString != "" {
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a non-negative integer", err)
+			return
+		}
+	}
+
+	entries, total, err := cfg.db.ListAuditEntries(userID, limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve audit log", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Entries: entries,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// Caption files are text, a feature length film is a few hundred KB
+	maxCaptionUploadBytes = 2 << 20 // 2 MB
+	// captionCuesChecked is how many cues are parsed to validate a file.
+	// Players skip cues they can't parse, so the rest aren't worth failing
+	// an upload over.
+	captionCuesChecked = 3
+	// Language tags longer than this aren't BCP 47
+	maxCaptionLanguageLength = 35
+)
+
+var (
+	// BCP 47 language tags, e.g. "en", "pt-BR" or "zh-Hant"
+	captionLanguagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	vttTimingPattern       = regexp.MustCompile(`^(\d{2,}:)?[0-5]\d:[0-5]\d\.\d{3}[ \t]+-->[ \t]+(\d{2,}:)?[0-5]\d:[0-5]\d\.\d{3}([ \t]|$)`)
+	srtTimingPattern       = regexp.MustCompile(`^\d{2,}:[0-5]\d:[0-5]\d,\d{3}[ \t]+-->[ \t]+\d{2,}:[0-5]\d:[0-5]\d,\d{3}`)
+	captionBlockSeparator  = regexp.MustCompile(`\n{2,}`)
+)
+
+var errInvalidCaptions = errors.New("invalid captions")
+
+// parseCaptions validates an uploaded caption file, WebVTT or SRT by its
+// extension, and returns it as WebVTT
+func parseCaptions(data []byte, ext string) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("%w: not UTF-8 text", errInvalidCaptions)
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	blocks := captionBlockSeparator.Split(strings.TrimSpace(text), -1)
+
+	switch strings.ToLower(ext) {
+	case ".vtt":
+		if err := checkVTTCues(blocks); err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	case ".srt":
+		return srtToVTT(blocks)
+	default:
+		return nil, fmt.Errorf("%w: must be a .vtt or .srt file", errInvalidCaptions)
+	}
+}
+
+// checkVTTCues checks the header and the first cues of a WebVTT file
+func checkVTTCues(blocks []string) error {
+	header := blocks[0]
+	if header != "WEBVTT" && !strings.HasPrefix(header, "WEBVTT ") && !strings.HasPrefix(header, "WEBVTT\t") && !strings.HasPrefix(header, "WEBVTT\n") {
+		return fmt.Errorf("%w: missing WEBVTT header", errInvalidCaptions)
+	}
+
+	cues := 0
+	for _, block := range blocks[1:] {
+		if cues == captionCuesChecked {
+			break
+		}
+		if strings.HasPrefix(block, "NOTE") || strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION") {
+			continue
+		}
+		// The timing line may follow an optional cue identifier
+		lines := strings.SplitN(block, "\n", 3)
+		if !vttTimingPattern.MatchString(lines[0]) && (len(lines) < 2 || !vttTimingPattern.MatchString(lines[1])) {
+			return fmt.Errorf("%w: cue %d has no valid timing line", errInvalidCaptions, cues+1)
+		}
+		cues++
+	}
+	if cues == 0 {
+		return fmt.Errorf("%w: no cues", errInvalidCaptions)
+	}
+	return nil
+}
+
+// srtToVTT converts SRT cues to WebVTT, which only differs in its header
+// and using a dot rather than a comma before the milliseconds. Cue numbers
+// are kept as cue identifiers.
+func srtToVTT(blocks []string) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n")
+	for i, block := range blocks {
+		lines := strings.Split(block, "\n")
+		timing := 0
+		if !srtTimingPattern.MatchString(lines[0]) {
+			timing = 1
+		}
+		if timing >= len(lines) || !srtTimingPattern.MatchString(lines[timing]) {
+			if i < captionCuesChecked {
+				return nil, fmt.Errorf("%w: cue %d has no valid timing line", errInvalidCaptions, i+1)
+			}
+			// Past the cues that were checked, a player would skip it too
+			continue
+		}
+		lines[timing] = strings.ReplaceAll(lines[timing], ",", ".")
+
+		out.WriteString("\n")
+		out.WriteString(strings.Join(lines, "\n"))
+		out.WriteString("\n")
+	}
+	return out.Bytes(), nil
+}
+
+// captionKey is where a video's track for a language is stored. Replacing
+// a track overwrites the same key.
+func captionKey(video database.Video, language string) string {
+	return fmt.Sprintf("users/%s/captions/%s/%s.vtt", video.UserID, video.ID, strings.ToLower(language))
+}
+
+// captionStorage keeps captions next to the video they're for, or in the
+// default region if no video has been uploaded yet
+func (cfg *apiConfig) captionStorage(video database.Video) (Storage, error) {
+	if video.VideoURL != nil && *video.VideoURL != "" {
+		storage, _, err := cfg.storageFor(*video.VideoURL)
+		return storage, err
+	}
+	return cfg.storageRegions.forRegion("")
+}
+
+// handlerUploadCaptions adds a WebVTT or SRT caption track to a video, or
+// replaces the video's track for that language. SRT is stored as WebVTT,
+// which is what browsers play.
+func (cfg *apiConfig) handlerUploadCaptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionUploadBytes)
+
+	video, userID, err := cfg.authorizeVideoAccess(r, videoRoleEditor)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxCaptionUploadBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Captions exceed the maximum upload size of %d bytes", maxBytesErr.Limit), err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+		return
+	}
+
+	language := r.FormValue("language")
+	if len(language) > maxCaptionLanguageLength || !captionLanguagePattern.MatchString(language) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidLanguage, "Invalid language: must be a language tag such as en or pt-BR", nil)
+		return
+	}
+
+	file, header, err := r.FormFile("captions")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Missing 'captions' file in form data", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't read captions", err)
+		return
+	}
+	vtt, err := parseCaptions(data, filepath.Ext(header.Filename))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidCaptions, err.Error(), err)
+		return
+	}
+
+	storage, err := cfg.captionStorage(video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't find storage for captions", err)
+		return
+	}
+	key := tenantKey(requestTenant(r.Context()), captionKey(video, language))
+	if err := storage.Put(r.Context(), key, bytes.NewReader(vtt), PutOptions{ContentType: "text/vtt"}); err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Failed to upload captions to storage", err)
+		return
+	}
+	stored := storedURL(storage, key)
+
+	// A track replaced from another bucket leaves its old object behind
+	// unless it's deleted once the new one is saved
+	previous := ""
+	replaced := false
+	for i, caption := range video.Captions {
+		if strings.EqualFold(caption.Language, language) {
+			previous = caption.URL
+			video.Captions[i] = database.VideoCaption{Language: language, URL: stored}
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		video.Captions = append(video.Captions, database.VideoCaption{Language: language, URL: stored})
+	}
+
+	// Only the captions are saved, so processing finishing meanwhile isn't
+	// undone
+	video, err = cfg.db.UpdateVideoCaptions(video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	if previous != "" && previous != stored {
+		if err := cfg.deleteStoredObject(r.Context(), previous); err != nil {
+			log.Printf("couldn't delete replaced captions %s: %v", previous, err)
+		}
+	}
+	cfg.recordAudit(r, auditActionCaptionUpload, userID, video.ID, "text/vtt", int64(len(vtt)))
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCloudFrontSigner is a signer for cdn.example.com with a fresh
+// key, returned too so signatures can be checked
+func newTestCloudFrontSigner(t *testing.T, policyType cloudFrontPolicyType) (*cloudFrontSigner, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "cloudfront.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, block, 0o600); err != nil {
+		t.Fatalf("couldn't write key: %v", err)
+	}
+	signer, err := newCloudFrontSigner("https://cdn.example.com/", "KTESTKEYPAIR", path, policyType)
+	if err != nil {
+		t.Fatalf("newCloudFrontSigner: %v", err)
+	}
+	return signer, key
+}
+
+// TestCloudFrontSignedURLOverrides checks the signature of a URL with
+// response overrides is over the policy CloudFront checks it against, with
+// the & between them as it is in the URL
+func TestCloudFrontSignedURLOverrides(t *testing.T) {
+	opts := SignOptions{
+		ContentDisposition: `attachment; filename="video.mp4"`,
+		ContentType:        "video/mp4",
+	}
+
+	tests := []struct {
+		name       string
+		policyType cloudFrontPolicyType
+	}{
+		{name: "canned policy", policyType: cloudFrontPolicyCanned},
+		{name: "custom policy", policyType: cloudFrontPolicyCustom},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, key := newTestCloudFrontSigner(t, tc.policyType)
+			signed, err := signer.SignedURL("users/u/videos/landscape/abc/video.mp4", time.Hour, opts)
+			if err != nil {
+				t.Fatalf("SignedURL: %v", err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatalf("couldn't parse %q: %v", signed, err)
+			}
+			query := u.Query()
+
+			// What CloudFront signs is the URL without its signing parameters
+			resource, _, _ := strings.Cut(signed, "&Expires=")
+			resource, _, _ = strings.Cut(resource, "&Key-Pair-Id=")
+			if !strings.Contains(resource, "&response-content-type=") {
+				t.Fatalf("resource %q doesn't carry both overrides", resource)
+			}
+
+			var policy string
+			if tc.policyType == cloudFrontPolicyCustom {
+				decoded, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Policy")))
+				if err != nil {
+					t.Fatalf("couldn't decode policy: %v", err)
+				}
+				policy = string(decoded)
+				if !strings.Contains(policy, `"Resource":"`+resource+`"`) {
+					t.Errorf("policy %s doesn't have the resource %q as is", policy, resource)
+				}
+			} else {
+				policy = fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`, resource, query.Get("Expires"))
+			}
+			if strings.Contains(policy, `\u0026`) {
+				t.Errorf("policy %s has & escaped", policy)
+			}
+
+			signature, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature")))
+			if err != nil {
+				t.Fatalf("couldn't decode signature: %v", err)
+			}
+			hash := sha1.Sum([]byte(policy))
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hash[:], signature); err != nil {
+				t.Errorf("signature doesn't match policy %s: %v", policy, err)
+			}
+		})
+	}
+}
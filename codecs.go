@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// What to do with an upload whose video codec browsers can't play
+const (
+	codecPolicyReject    = "reject"
+	codecPolicyTranscode = "transcode"
+)
+
+// browserVideoCodecs are the ffprobe codec names browsers play from an
+// MP4. Anything else, HEVC included, can't be stored as it is.
+var browserVideoCodecs = map[string]bool{
+	"h264": true,
+	"vp9":  true,
+	"av1":  true,
+}
+
+var errUnsupportedCodec = errors.New("unsupported video codec")
+
+// codecNeedsTranscode reports whether a video in codec has to be
+// transcoded to play in browsers. Under the reject policy it fails with
+// an error wrapping errUnsupportedCodec instead.
+func (cfg *apiConfig) codecNeedsTranscode(codec string) (bool, error) {
+	if browserVideoCodecs[codec] {
+		return false, nil
+	}
+	if cfg.unsupportedCodecPolicy == codecPolicyReject {
+		return false, fmt.Errorf("%w: %s", errUnsupportedCodec, codec)
+	}
+	return true, nil
+}
+
+// exceedsBitrateCeiling reports whether a video is over cfg.maxVideoBitrate,
+// and so is worth re-encoding even if it could be stored as it is. Videos
+// that don't report a bitrate are left alone.
+func (cfg *apiConfig) exceedsBitrateCeiling(meta VideoMeta) bool {
+	return cfg.maxVideoBitrate > 0 && meta.Bitrate > cfg.maxVideoBitrate
+}
+
+// videoEncodeArgs are the ffmpeg arguments videos are re-encoded to H.264
+// with. Under a bitrate ceiling the quality target gives way to it where
+// the two disagree.
+func (cfg *apiConfig) videoEncodeArgs() []string {
+	args := []string{"-c:v", "libx264", "-preset", "medium", "-crf", "23"}
+	if cfg.maxVideoBitrate > 0 {
+		maxRate := strconv.FormatInt(cfg.maxVideoBitrate, 10)
+		bufSize := strconv.FormatInt(2*cfg.maxVideoBitrate, 10)
+		args = append(args, "-maxrate", maxRate, "-bufsize", bufSize)
+	}
+	return args
+}
+
+// unsupportedCodecMessage is the message an upload rejected for its codec
+// gets, naming the codec ffprobe found
+func unsupportedCodecMessage(codec string) string {
+	return fmt.Sprintf("Video codec %q isn't supported, upload H.264, VP9 or AV1", codec)
+}
+
+// checkUploadCodec rejects an upload before it's staged if its codec isn't
+// one browsers play and the policy is to reject those. Failures are a
+// *videoUploadError.
+func (cfg *apiConfig) checkUploadCodec(meta VideoMeta) error {
+	if cfg.unsupportedCodecPolicy != codecPolicyReject {
+		return nil
+	}
+	if _, err := cfg.codecNeedsTranscode(meta.VideoCodec); err != nil {
+		return &videoUploadError{http.StatusUnprocessableEntity, errCodeUnsupportedCodec, unsupportedCodecMessage(meta.VideoCodec), err}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testCodecProbeOutput is testProbeOutput with the video in codec
+func testCodecProbeOutput(codec string) string {
+	return strings.Replace(testProbeOutput, `"codec_name":"h264"`, `"codec_name":"`+codec+`"`, 1)
+}
+
+func TestHandlerUploadVideoCodec(t *testing.T) {
+	tests := []struct {
+		name          string
+		codec         string
+		policy        string
+		wantStatus    int
+		wantCode      string
+		wantTranscode bool
+	}{
+		{
+			name:       "H.264 is stored as it is",
+			codec:      "h264",
+			policy:     codecPolicyReject,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "VP9 is stored as it is",
+			codec:      "vp9",
+			policy:     codecPolicyReject,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "AV1 is stored as it is",
+			codec:      "av1",
+			policy:     codecPolicyTranscode,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "HEVC is rejected under the reject policy",
+			codec:      "hevc",
+			policy:     codecPolicyReject,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeUnsupportedCodec,
+		},
+		{
+			name:          "HEVC is transcoded under the transcode policy",
+			codec:         "hevc",
+			policy:        codecPolicyTranscode,
+			wantStatus:    http.StatusAccepted,
+			wantTranscode: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.unsupportedCodecPolicy = tc.policy
+			setFakeProbe(t, cfg, testCodecProbeOutput(tc.codec))
+			ffmpegRuns := recordFFmpegRuns(t, cfg)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("a "+tc.codec+" upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if tc.wantCode != "" {
+				if !strings.Contains(body.Error, tc.codec) {
+					t.Errorf("error = %q, want it to name the codec %q", body.Error, tc.codec)
+				}
+				return
+			}
+
+			runQueuedVideoJobs(t, cfg)
+			transcoded := false
+			for _, run := range ffmpegRuns() {
+				if strings.Contains(run, "-progress pipe:1") && strings.Contains(run, "libx264") {
+					transcoded = true
+				}
+			}
+			if transcoded != tc.wantTranscode {
+				t.Errorf("transcoded = %v, want %v: %v", transcoded, tc.wantTranscode, ffmpegRuns())
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.VideoCodec != tc.codec {
+				t.Errorf("video_codec = %q, want %q", stored.VideoCodec, tc.codec)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoBitrateCeiling(t *testing.T) {
+	withBitrates := func(stream, format string) string {
+		output := strings.Replace(testProbeOutput, `"bit_rate":"1000000"`, `"bit_rate":"`+stream+`"`, 1)
+		return strings.Replace(output, `"bit_rate":"1100000"`, `"bit_rate":"`+format+`"`, 1)
+	}
+
+	tests := []struct {
+		name         string
+		ceiling      int64
+		probe        string
+		wantReencode bool
+	}{
+		{
+			name:         "high bitrate is re-encoded",
+			ceiling:      8_000_000,
+			probe:        withBitrates("12000000", "12100000"),
+			wantReencode: true,
+		},
+		{
+			name:         "low bitrate is stream copied",
+			ceiling:      8_000_000,
+			probe:        withBitrates("1000000", "1100000"),
+			wantReencode: false,
+		},
+		{
+			name:         "exactly at the ceiling is stream copied",
+			ceiling:      8_000_000,
+			probe:        withBitrates("8000000", "8100000"),
+			wantReencode: false,
+		},
+		{
+			name:         "container bitrate when the stream has none",
+			ceiling:      8_000_000,
+			probe:        withBitrates("", "12100000"),
+			wantReencode: true,
+		},
+		{
+			name:         "no bitrate reported",
+			ceiling:      8_000_000,
+			probe:        withBitrates("", ""),
+			wantReencode: false,
+		},
+		{
+			name:         "no ceiling configured",
+			probe:        withBitrates("12000000", "12100000"),
+			wantReencode: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.maxVideoBitrate = tc.ceiling
+			setFakeProbe(t, cfg, tc.probe)
+			ffmpegRuns := recordFFmpegRuns(t, cfg)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("a video"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			var faststart string
+			for _, run := range ffmpegRuns() {
+				if strings.Contains(run, "-progress pipe:1") {
+					faststart = run
+				}
+			}
+			if faststart == "" {
+				t.Fatalf("no faststart pass was run: %v", ffmpegRuns())
+			}
+			if reencoded := strings.Contains(faststart, "libx264"); reencoded != tc.wantReencode {
+				t.Errorf("re-encoded = %v, want %v: %s", reencoded, tc.wantReencode, faststart)
+			}
+			if tc.wantReencode && !strings.Contains(faststart, "-maxrate 8000000 -bufsize 16000000") {
+				t.Errorf("re-encode isn't capped at the ceiling: %s", faststart)
+			}
+			if !tc.wantReencode && !strings.Contains(faststart, "-c copy") {
+				t.Errorf("faststart pass isn't a stream copy: %s", faststart)
+			}
+		})
+	}
+}
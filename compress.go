@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response worth compressing, below it the
+// gzip header and CPU time outweigh the savings
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, which
+// a q=0 for it (or for *) rules out
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses JSON responses of at least gzipMinSize for
+// clients that accept gzip. Anything else, video and images included, is
+// passed through untouched, so streaming and proxied responses keep their
+// Content-Length and Range support.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter holds back the headers of a JSON response until it
+// knows whether the body reaches gzipMinSize
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	// passthrough is set once the response is known not to be compressed
+	passthrough bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status != 0 || g.passthrough {
+		return
+	}
+	g.status = status
+
+	mediaType, _, _ := mime.ParseMediaType(g.Header().Get("Content-Type"))
+	bodyless := status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified
+	if bodyless || mediaType != "application/json" || g.Header().Get("Content-Encoding") != "" {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 && !g.passthrough {
+		g.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case g.passthrough:
+		return g.ResponseWriter.Write(b)
+	case g.gz != nil:
+		return g.gz.Write(b)
+	}
+
+	g.buf = append(g.buf, b...)
+	if len(g.buf) < gzipMinSize {
+		return len(b), nil
+	}
+
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzipWriters.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+	if _, err := g.gz.Write(g.buf); err != nil {
+		return 0, err
+	}
+	g.buf = nil
+	return len(b), nil
+}
+
+// close sends whatever is still held back: a body too small to compress
+// as it is, or the end of the gzip stream
+func (g *gzipResponseWriter) close() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+		gzipWriters.Put(g.gz)
+	case !g.passthrough && g.status != 0:
+		g.ResponseWriter.WriteHeader(g.status)
+		g.ResponseWriter.Write(g.buf)
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
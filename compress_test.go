@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		videos         int
+		acceptEncoding string
+		rangeHeader    string
+		wantGzip       bool
+	}{
+		{
+			name:           "list with gzip requested",
+			videos:         20,
+			acceptEncoding: "gzip, deflate, br",
+			wantGzip:       true,
+		},
+		{
+			name:   "list without gzip requested",
+			videos: 20,
+		},
+		{
+			name:           "gzip refused with q=0",
+			videos:         20,
+			acceptEncoding: "gzip;q=0, identity",
+		},
+		{
+			name:           "list too small to be worth it",
+			videos:         1,
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "ranged request",
+			videos:         20,
+			acceptEncoding: "gzip",
+			rangeHeader:    "bytes=0-99",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			for range tc.videos {
+				createTestVideo(t, cfg, owner)
+			}
+			handler := cfg.tenantMiddleware(gzipMiddleware(http.HandlerFunc(cfg.handlerListVideos)))
+
+			list := func(acceptEncoding, rangeHeader string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+				authorizeTestRequest(t, r, owner)
+				if acceptEncoding != "" {
+					r.Header.Set("Accept-Encoding", acceptEncoding)
+				}
+				if rangeHeader != "" {
+					r.Header.Set("Range", rangeHeader)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+				return w
+			}
+			plain := list("", "")
+			w := list(tc.acceptEncoding, tc.rangeHeader)
+
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			body := w.Body.Bytes()
+			gzipped := w.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tc.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip: %v", w.Header().Get("Content-Encoding"), tc.wantGzip)
+			}
+			if gzipped {
+				if w.Body.Len() >= plain.Body.Len() {
+					t.Errorf("compressed body is %d bytes, the JSON %d", w.Body.Len(), plain.Body.Len())
+				}
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("couldn't decompress body: %v", err)
+				}
+			}
+			if !bytes.Equal(body, plain.Body.Bytes()) {
+				t.Errorf("body = %s, want %s", body, plain.Body)
+			}
+			if got, want := w.Header().Get("Content-Length"), fmt.Sprint(w.Body.Len()); got != "" && got != want {
+				t.Errorf("Content-Length = %s for a %s byte body", got, want)
+			}
+		})
+	}
+}
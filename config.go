@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// S3 refuses to presign URLs valid for longer than a week
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// envReader reads settings from the environment, collecting every missing
+// or invalid one instead of stopping at the first
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) fail(format string, args ...any) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+// err lists every problem found, nil if there were none
+func (e *envReader) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d missing or invalid settings: %s", len(e.problems), strings.Join(e.problems, "; "))
+}
+
+func (e *envReader) required(name string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		e.fail("%s must be set", name)
+	}
+	return v
+}
+
+func (e *envReader) optional(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (e *envReader) positiveInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		e.fail("%s must be a positive integer, got %q", name, v)
+		return fallback
+	}
+	return n
+}
+
+func (e *envReader) positiveInt64(name string, fallback int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		e.fail("%s must be a positive integer, got %q", name, v)
+		return fallback
+	}
+	return n
+}
+
+// nonNegativeInt64 is positiveInt64 for settings where 0 switches
+// something off
+func (e *envReader) nonNegativeInt64(name string, fallback int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		e.fail("%s must be a non-negative integer, got %q", name, v)
+		return fallback
+	}
+	return n
+}
+
+func (e *envReader) positiveDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		e.fail("%s must be a positive duration, got %q", name, v)
+		return fallback
+	}
+	return d
+}
+
+func (e *envReader) boolean(name string, fallback bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail("%s must be true or false, got %q", name, v)
+		return fallback
+	}
+	return b
+}
+
+// executable resolves a binary named by env var name, looked up on PATH
+// unless given as a path. Checked now rather than failing halfway through
+// the first upload.
+func (e *envReader) executable(name, fallback string) string {
+	path := e.optional(name, fallback)
+	if _, err := exec.LookPath(path); err != nil {
+		e.fail("%s not found or not executable, install it or set %s: %v", fallback, name, err)
+	}
+	return path
+}
+
+// loadConfig reads the server's settings from the environment and opens
+// the database and storage they point to. Every setting is checked before
+// anything is opened, and the error lists each one that's missing or
+// invalid.
+func loadConfig() (apiConfig, error) {
+	env := &envReader{}
+
+	pathToDB := env.required("DB_PATH")
+	jwtSecret := env.required("JWT_SECRET")
+	platform := env.required("PLATFORM")
+	filepathRoot := env.required("FILEPATH_ROOT")
+	assetsRoot := env.required("ASSETS_ROOT")
+	port := env.required("PORT")
+
+	// Optional, a CDN serving ASSETS_ROOT under /assets/, which asset URLs
+	// point at instead of the API
+	assetCDNBaseURL := strings.TrimRight(os.Getenv("ASSET_CDN_BASE_URL"), "/")
+	if assetCDNBaseURL != "" {
+		u, err := url.Parse(assetCDNBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			env.fail("ASSET_CDN_BASE_URL must be an http or https URL with no query, got %q", assetCDNBaseURL)
+		}
+	}
+
+	// Optional, where clients reach this server, for the URLs pointing back
+	// at it that it hands out, e.g. https://tubely.example.com
+	publicBaseURL := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if publicBaseURL == "" {
+		publicBaseURL = "http://localhost:" + port
+	} else if u, err := url.Parse(publicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		env.fail("PUBLIC_BASE_URL must be an http or https URL with no query, got %q", publicBaseURL)
+	}
+
+	// Optional, the image videos without a thumbnail are sent with: an
+	// http or https URL, or the name of a file in ASSETS_ROOT
+	defaultThumbnail := os.Getenv("DEFAULT_THUMBNAIL_URL")
+	if defaultThumbnail != "" && !isAbsoluteURL(defaultThumbnail) {
+		if defaultThumbnail != filepath.Base(defaultThumbnail) || defaultThumbnail == ".." {
+			env.fail("DEFAULT_THUMBNAIL_URL must be an http or https URL or the name of a file in ASSETS_ROOT, got %q", defaultThumbnail)
+		} else if info, err := os.Stat(filepath.Join(assetsRoot, defaultThumbnail)); err != nil || info.IsDir() {
+			env.fail("DEFAULT_THUMBNAIL_URL names %q, which isn't a file in ASSETS_ROOT", defaultThumbnail)
+		}
+	}
+
+	// "s3" (default) or "local", which keeps videos on disk and needs no AWS setup
+	storageBackend := env.optional("STORAGE_BACKEND", "s3")
+	if storageBackend != "s3" && storageBackend != "local" {
+		env.fail("STORAGE_BACKEND must be \"s3\" or \"local\", got %q", storageBackend)
+	}
+
+	var s3Bucket, s3Region, s3CfDistribution, s3KMSKeyID string
+	s3RegionBuckets := map[string]string{}
+	s3PutMaxAttempts := 3
+	if storageBackend == "s3" {
+		s3Bucket = env.required("S3_BUCKET")
+		s3Region = env.required("S3_REGION")
+		s3CfDistribution = env.required("S3_CF_DISTRO")
+
+		// Optional, more buckets in other regions, e.g.
+		// "eu-west-1=tubely-eu". S3_BUCKET stays the bucket for S3_REGION,
+		// which is where uploads go unless they ask for another region.
+		if v := os.Getenv("S3_BUCKETS"); v != "" {
+			buckets, err := parseRegionBuckets(v)
+			if err != nil {
+				env.fail("S3_BUCKETS must be comma separated region=bucket pairs: %v", err)
+			} else {
+				s3RegionBuckets = buckets
+			}
+		}
+		if bucket, ok := s3RegionBuckets[s3Region]; ok && bucket != s3Bucket {
+			env.fail("S3_BUCKETS lists %s for %s, which is S3_REGION with S3_BUCKET %s", bucket, s3Region, s3Bucket)
+		}
+		s3RegionBuckets[s3Region] = s3Bucket
+
+		// Optional, objects use the bucket's default encryption otherwise
+		s3KMSKeyID = os.Getenv("S3_KMS_KEY_ID")
+
+		s3PutMaxAttempts = env.positiveInt("S3_PUT_MAX_ATTEMPTS", s3PutMaxAttempts)
+	}
+
+	// Optional, tags for lifecycle rules or cost allocation on top of the
+	// ones every video object gets
+	var objectTags map[string]string
+	if v := os.Getenv("S3_OBJECT_TAGS"); v != "" {
+		tags, err := parseObjectTags(v)
+		if err != nil {
+			env.fail("S3_OBJECT_TAGS must be comma separated key=value pairs: %v", err)
+		}
+		objectTags = tags
+	}
+
+	maxVideoUploadBytes := env.positiveInt64("MAX_VIDEO_UPLOAD_BYTES", 1<<30) // 1GB
+	storageQuotaBytes := env.positiveInt64("STORAGE_QUOTA_BYTES", 10<<30)     // 10GB
+
+	// Video uploads each user may start per minute, in a single burst or
+	// spread out
+	uploadRateLimit := env.positiveInt("UPLOAD_RATE_LIMIT", 10)
+
+	presignExpiry := env.positiveDuration("PRESIGN_EXPIRY", time.Hour)
+	if presignExpiry > maxPresignExpiry {
+		env.fail("PRESIGN_EXPIRY must be at most %s, got %s", maxPresignExpiry, presignExpiry)
+	}
+	var missingObjects *missingObjectCache
+	if env.boolean("VERIFY_STORED_OBJECTS", false) {
+		missingObjects = newMissingObjectCache(missingObjectTTL)
+	}
+
+	videoWorkers := env.positiveInt("VIDEO_WORKERS", 2)
+	videoQueueSize := env.positiveInt("VIDEO_QUEUE_SIZE", 100)
+
+	ffmpegPath := env.executable("FFMPEG_PATH", "ffmpeg")
+	ffprobePath := env.executable("FFPROBE_PATH", "ffprobe")
+
+	// Applies to each ffprobe run, thumbnail and faststart pass that only
+	// copies streams
+	ffmpegTimeout := env.positiveDuration("FFMPEG_TIMEOUT", 2*time.Minute)
+	// Applies to runs decoding the whole video: transcodes, rotations,
+	// loudness normalization, bitrate caps, watermarks, renditions, HLS
+	// and sprite sheets
+	transcodeTimeout := env.positiveDuration("FFMPEG_TRANSCODE_TIMEOUT", time.Hour)
+
+	// ffmpeg and ffprobe processes allowed at once, across uploads and
+	// background workers, and how long a run waits for one to finish
+	maxFFmpegJobs := env.positiveInt("MAX_FFMPEG_JOBS", runtime.NumCPU())
+	ffmpegQueueTimeout := env.positiveDuration("FFMPEG_QUEUE_TIMEOUT", 30*time.Second)
+
+	// Videos over this many bits/s are re-encoded down to it. None are by
+	// default, or with 0
+	maxVideoBitrate := env.nonNegativeInt64("MAX_VIDEO_BITRATE_KBPS", 0) * 1000
+
+	// Only used by uploads that ask for normalize_audio
+	loudnessTarget := defaultLoudnessTarget
+	if v := os.Getenv("AUDIO_LOUDNESS_TARGET"); v != "" {
+		target, err := strconv.ParseFloat(v, 64)
+		if err != nil || target < minLoudnessTarget || target > maxLoudnessTarget {
+			env.fail("AUDIO_LOUDNESS_TARGET must be between %g and %g LUFS, got %q", minLoudnessTarget, maxLoudnessTarget, v)
+		} else {
+			loudnessTarget = target
+		}
+	}
+
+	// How long deleted videos can be restored before they're purged
+	videoRetention := env.positiveDuration("VIDEO_RETENTION", 30*24*time.Hour)
+
+	// Optional, POSTed to whenever a video finishes processing
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookURL != "" && webhookSecret == "" {
+		env.fail("WEBHOOK_SECRET must be set when WEBHOOK_URL is set")
+	}
+
+	// Browser origins other than our own that may call the API, e.g. a
+	// frontend on its own domain. CORS stays off unless origins are listed.
+	cors := corsConfig{
+		allowedOrigins: parseCORSList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		allowedMethods: defaultCORSMethods,
+		allowedHeaders: defaultCORSHeaders,
+	}
+	if v := os.Getenv("CORS_ALLOWED_METHODS"); v != "" {
+		cors.allowedMethods = parseCORSList(v)
+	}
+	if v := os.Getenv("CORS_ALLOWED_HEADERS"); v != "" {
+		cors.allowedHeaders = parseCORSList(v)
+		if !slices.ContainsFunc(cors.allowedHeaders, func(h string) bool { return strings.EqualFold(h, "Authorization") }) {
+			env.fail("CORS_ALLOWED_HEADERS must include Authorization")
+		}
+	}
+
+	// Thumbnails are served from the assets directory unless this is set
+	thumbnailsInStorage := env.boolean("THUMBNAILS_IN_S3", false)
+
+	thumbnailJPEGQuality := defaultThumbnailJPEGQuality
+	if v := os.Getenv("THUMBNAIL_JPEG_QUALITY"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || quality < 1 || quality > 100 {
+			env.fail("THUMBNAIL_JPEG_QUALITY must be between 1 and 100, got %q", v)
+		} else {
+			thumbnailJPEGQuality = quality
+		}
+	}
+
+	// No limit by default, thumbnails are already resized to thumbnailWidths
+	thumbnailMaxBytes := int64(0)
+	if v := os.Getenv("THUMBNAIL_MAX_BYTES"); v != "" {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBytes < minThumbnailMaxBytes {
+			env.fail("THUMBNAIL_MAX_BYTES must be an integer of at least %d, got %q", minThumbnailMaxBytes, v)
+		} else {
+			thumbnailMaxBytes = maxBytes
+		}
+	}
+
+	// Every type that can be decoded unless narrowed down
+	allowedThumbnailTypes := supportedThumbnailTypes
+	if v := os.Getenv("THUMBNAIL_TYPES"); v != "" {
+		allowedThumbnailTypes = parseCORSList(v)
+		for _, mediaType := range allowedThumbnailTypes {
+			if !slices.Contains(supportedThumbnailTypes, mediaType) {
+				env.fail("THUMBNAIL_TYPES must list some of %s, got %q", strings.Join(supportedThumbnailTypes, ", "), mediaType)
+			}
+		}
+		if len(allowedThumbnailTypes) == 0 {
+			env.fail("THUMBNAIL_TYPES must list at least one type")
+		}
+	}
+
+	// On by default, reprocessing needs the original
+	keepOriginals := env.boolean("KEEP_ORIGINALS", true)
+
+	// Uploads are staged here at full size, the system temp directory may
+	// be too small for them
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir != "" {
+		if err := checkTempDir(tempDir); err != nil {
+			env.fail("TEMP_DIR can't be used to stage uploads: %v", err)
+		}
+	}
+	// Anything of ours left there longer is from a crashed or killed process
+	tempFileMaxAge := env.positiveDuration("TEMP_FILE_MAX_AGE", 24*time.Hour)
+	if tempFileMaxAge < minTempFileMaxAge {
+		env.fail("TEMP_FILE_MAX_AGE must be at least %s, got %s", minTempFileMaxAge, tempFileMaxAge)
+	}
+
+	// Transcoding HEVC and the like is slow, but rejecting them means the
+	// uploader has to convert them
+	unsupportedCodecPolicy := env.optional("UNSUPPORTED_CODEC_POLICY", codecPolicyTranscode)
+	if unsupportedCodecPolicy != codecPolicyReject && unsupportedCodecPolicy != codecPolicyTranscode {
+		env.fail("UNSUPPORTED_CODEC_POLICY must be %q or %q, got %q", codecPolicyReject, codecPolicyTranscode, unsupportedCodecPolicy)
+	}
+
+	// Long enough to cover a client's retries, short enough that a key can
+	// be reused for a deliberate re-upload later
+	idempotencyKeyTTL := env.positiveDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+
+	// CloudFront signing is opt-in, S3 presigning is used otherwise. Half
+	// of it set is a mistake rather than opting out.
+	cfKeyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	cfPrivateKeyPath := os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+	if (cfKeyPairID == "") != (cfPrivateKeyPath == "") {
+		env.fail("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must both be set, or neither")
+	}
+	cfPolicy := cloudFrontPolicyType(env.optional("CLOUDFRONT_POLICY", string(cloudFrontPolicyCanned)))
+	if cfPolicy != cloudFrontPolicyCanned && cfPolicy != cloudFrontPolicyCustom {
+		env.fail("CLOUDFRONT_POLICY must be %q or %q, got %q", cloudFrontPolicyCanned, cloudFrontPolicyCustom, cfPolicy)
+	}
+
+	localRoot := env.optional("LOCAL_STORAGE_ROOT", "./storage")
+
+	if err := env.err(); err != nil {
+		return apiConfig{}, err
+	}
+
+	db, err := database.NewClient(pathToDB)
+	if err != nil {
+		return apiConfig{}, fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	regionStorage := map[string]Storage{}
+	defaultRegion := s3Region
+	var local *localStorage
+	switch storageBackend {
+	case "s3":
+		var cfSigner *cloudFrontSigner
+		if cfKeyPairID != "" && cfPrivateKeyPath != "" {
+			cfSigner, err = newCloudFrontSigner(s3CfDistribution, cfKeyPairID, cfPrivateKeyPath, cfPolicy)
+			if err != nil {
+				return apiConfig{}, fmt.Errorf("couldn't load CloudFront signer: %w", err)
+			}
+		}
+
+		// Load AWS configuration (automatically uses credentials from `aws configure`)
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			return apiConfig{}, fmt.Errorf("unable to load AWS SDK config: %w", err)
+		}
+
+		// Each bucket gets a client for its own region. The CloudFront
+		// distribution and KMS key belong to S3_BUCKET, buckets in other
+		// regions are presigned directly and use their default encryption.
+		for region, bucket := range s3RegionBuckets {
+			if region == s3Region {
+				client := s3.NewFromConfig(awsCfg)
+				regionStorage[region] = newS3Storage(client, s3.NewPresignClient(client), bucket, cfSigner, s3KMSKeyID, s3PutMaxAttempts)
+				continue
+			}
+			client := s3.NewFromConfig(awsCfg, func(o *s3.Options) { o.Region = region })
+			regionStorage[region] = newS3Storage(client, s3.NewPresignClient(client), bucket, nil, "", s3PutMaxAttempts)
+		}
+	case "local":
+		local, err = newLocalStorage(localRoot, publicBaseURL+"/storage", []byte(jwtSecret))
+		if err != nil {
+			return apiConfig{}, fmt.Errorf("couldn't create local storage directory: %w", err)
+		}
+		defaultRegion = "local"
+		regionStorage[defaultRegion] = local
+	}
+	storageRegions, err := newStorageRegions(defaultRegion, regionStorage)
+	if err != nil {
+		return apiConfig{}, fmt.Errorf("invalid storage configuration: %w", err)
+	}
+
+	return apiConfig{
+		db:               db,
+		jwtSecret:        jwtSecret,
+		platform:         platform,
+		filepathRoot:     filepathRoot,
+		assetsRoot:       assetsRoot,
+		assetCDNBaseURL:  assetCDNBaseURL,
+		publicBaseURL:    publicBaseURL,
+		defaultThumbnail: defaultThumbnail,
+		s3Region:         s3Region,
+		s3CfDistribution: s3CfDistribution,
+		port:             port,
+		ffmpegPath:       ffmpegPath,
+		ffprobePath:      ffprobePath,
+		ffmpegTimeout:    ffmpegTimeout,
+		transcodeTimeout: transcodeTimeout,
+		mediaLimiter:     newMediaLimiter(maxFFmpegJobs, ffmpegQueueTimeout),
+		loudnessTarget:   loudnessTarget,
+
+		maxVideoUploadBytes: maxVideoUploadBytes,
+		storageQuotaBytes:   storageQuotaBytes,
+		uploadLimiter:       newRateLimiter(uploadRateLimit, time.Minute),
+		presignExpiry:       presignExpiry,
+		presignCache:        newPresignCache(presignCacheSize),
+		storageRegions:      storageRegions,
+		localStorage:        local,
+		webhookURL:          webhookURL,
+		webhookSecret:       webhookSecret,
+		videoJobs:           make(chan videoJob, videoQueueSize),
+		videoWorkers:        videoWorkers,
+		videoProgress:       newVideoProgress(),
+		pendingVideoJobs:    &sync.WaitGroup{},
+		videoRetention:      videoRetention,
+		cors:                cors,
+		thumbnailsInStorage: thumbnailsInStorage,
+
+		thumbnailJPEGQuality: thumbnailJPEGQuality,
+		thumbnailMaxBytes:    thumbnailMaxBytes,
+		keepOriginals:        keepOriginals,
+		tempDir:              tempDir,
+		tempFileMaxAge:       tempFileMaxAge,
+
+		allowedThumbnailTypes:  allowedThumbnailTypes,
+		unsupportedCodecPolicy: unsupportedCodecPolicy,
+		maxVideoBitrate:        maxVideoBitrate,
+		idempotencyKeyTTL:      idempotencyKeyTTL,
+		idempotencyLocks:       newKeyedLocks(),
+		objectTags:             objectTags,
+		missingObjects:         missingObjects,
+		purgeLocks:             newKeyedLocks(),
+	}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestEnv sets the environment loadConfig needs for local storage, with
+// overrides on top. An override of "" unsets the variable.
+func setTestEnv(t *testing.T, overrides map[string]string) {
+	t.Helper()
+	env := map[string]string{
+		"DB_PATH":            filepath.Join(t.TempDir(), "tubely.db"),
+		"JWT_SECRET":         testJWTSecret,
+		"PLATFORM":           "dev",
+		"FILEPATH_ROOT":      "./app",
+		"ASSETS_ROOT":        t.TempDir(),
+		"PORT":               "8091",
+		"STORAGE_BACKEND":    "local",
+		"LOCAL_STORAGE_ROOT": t.TempDir(),
+		"FFMPEG_PATH":        writeFakeCommand(t, "ffmpeg", testFFmpegScript),
+		"FFPROBE_PATH":       writeFakeCommand(t, "ffprobe", "echo '"+testProbeOutput+"'"),
+	}
+	for name, value := range overrides {
+		env[name] = value
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantErrs []string // each listed in the error, which is nil if empty
+	}{
+		{
+			name: "everything set",
+		},
+		{
+			name:     "JWT secret missing",
+			env:      map[string]string{"JWT_SECRET": ""},
+			wantErrs: []string{"JWT_SECRET must be set"},
+		},
+		{
+			name:     "several settings missing",
+			env:      map[string]string{"DB_PATH": "", "PLATFORM": "", "PORT": ""},
+			wantErrs: []string{"3 missing or invalid settings", "DB_PATH must be set", "PLATFORM must be set", "PORT must be set"},
+		},
+		{
+			name:     "S3 settings missing",
+			env:      map[string]string{"STORAGE_BACKEND": "s3", "S3_BUCKET": "", "S3_REGION": "", "S3_CF_DISTRO": ""},
+			wantErrs: []string{"S3_BUCKET must be set", "S3_REGION must be set", "S3_CF_DISTRO must be set"},
+		},
+		{
+			name:     "ffmpeg not installed",
+			env:      map[string]string{"FFMPEG_PATH": filepath.Join(t.TempDir(), "no-ffmpeg")},
+			wantErrs: []string{"ffmpeg not found or not executable"},
+		},
+		{
+			name:     "upload limits that aren't positive",
+			env:      map[string]string{"MAX_VIDEO_UPLOAD_BYTES": "0", "UPLOAD_RATE_LIMIT": "lots"},
+			wantErrs: []string{`MAX_VIDEO_UPLOAD_BYTES must be a positive integer, got "0"`, `UPLOAD_RATE_LIMIT must be a positive integer, got "lots"`},
+		},
+		{
+			name:     "temp dir that doesn't exist",
+			env:      map[string]string{"TEMP_DIR": filepath.Join(t.TempDir(), "missing")},
+			wantErrs: []string{"TEMP_DIR can't be used to stage uploads"},
+		},
+		{
+			name:     "CDN base URL that isn't http",
+			env:      map[string]string{"ASSET_CDN_BASE_URL": "ftp://cdn.example.com"},
+			wantErrs: []string{`ASSET_CDN_BASE_URL must be an http or https URL with no query, got "ftp://cdn.example.com"`},
+		},
+		{
+			name:     "thumbnail type that can't be decoded",
+			env:      map[string]string{"THUMBNAIL_TYPES": "image/jpeg, image/bmp"},
+			wantErrs: []string{`THUMBNAIL_TYPES must list some of image/jpeg, image/png, image/gif, image/webp, got "image/bmp"`},
+		},
+		{
+			name:     "CloudFront key pair without its private key",
+			env:      map[string]string{"CLOUDFRONT_KEY_PAIR_ID": "KTESTKEYPAIR"},
+			wantErrs: []string{"CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must both be set, or neither"},
+		},
+		{
+			name:     "CloudFront private key without its key pair",
+			env:      map[string]string{"CLOUDFRONT_PRIVATE_KEY_PATH": "/etc/tubely/cloudfront.pem"},
+			wantErrs: []string{"CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must both be set, or neither"},
+		},
+		{
+			name:     "unknown CloudFront policy",
+			env:      map[string]string{"CLOUDFRONT_POLICY": "signed"},
+			wantErrs: []string{`CLOUDFRONT_POLICY must be "canned" or "custom", got "signed"`},
+		},
+		{
+			name:     "missing and invalid settings together",
+			env:      map[string]string{"JWT_SECRET": "", "PRESIGN_EXPIRY": "a week", "STORAGE_BACKEND": "floppy"},
+			wantErrs: []string{"3 missing or invalid settings", "JWT_SECRET must be set", `PRESIGN_EXPIRY must be a positive duration, got "a week"`, `STORAGE_BACKEND must be "s3" or "local", got "floppy"`},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestEnv(t, tc.env)
+
+			cfg, err := loadConfig()
+			if len(tc.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("loadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("loadConfig succeeded, want an error listing %q", tc.wantErrs)
+			}
+			for _, want := range tc.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+			if cfg.storageRegions != nil {
+				t.Error("loadConfig set up storage despite invalid settings")
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	setTestEnv(t, nil)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "max video upload", got: cfg.maxVideoUploadBytes, want: int64(1 << 30)},
+		{name: "storage quota", got: cfg.storageQuotaBytes, want: int64(10 << 30)},
+		{name: "presign expiry", got: cfg.presignExpiry, want: time.Hour},
+		{name: "video workers", got: cfg.videoWorkers, want: 2},
+		{name: "video queue size", got: cap(cfg.videoJobs), want: 100},
+		{name: "temp dir", got: cfg.tempDir, want: ""},
+		{name: "public base URL", got: cfg.publicBaseURL, want: "http://localhost:8091"},
+		{name: "unsupported codec policy", got: cfg.unsupportedCodecPolicy, want: codecPolicyTranscode},
+		{name: "thumbnail types", got: fmt.Sprint(cfg.allowedThumbnailTypes), want: fmt.Sprint(supportedThumbnailTypes)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+			}
+		})
+	}
+}
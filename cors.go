@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsConfig controls which other origins, such as a frontend served from
+// its own domain, may call the API from a browser
+type corsConfig struct {
+	// allowedOrigins are exact origins, e.g. "https://app.example.com", or
+	// "*" for any. Empty disables CORS.
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete}
+	// Authorization carries the JWT or API key, Content-Type is needed for
+	// JSON bodies, multipart/form-data is allowed by browsers regardless
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match", "Range", regionHeader, requestIDHeader}
+	// Response headers browsers hide from scripts unless they're listed
+	corsExposedHeaders = []string{"ETag", "Retry-After", "Content-Range", requestIDHeader}
+)
+
+// corsPreflightMaxAge lets browsers reuse a preflight for 10 minutes
+const corsPreflightMaxAge = "600"
+
+// parseCORSList splits a comma separated env var, dropping blanks
+func parseCORSList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (c corsConfig) originAllowed(origin string) bool {
+	return slices.Contains(c.allowedOrigins, "*") || slices.Contains(c.allowedOrigins, origin)
+}
+
+// corsMiddleware sets the Access-Control-Allow-* headers for allowed
+// origins and answers preflight requests itself, so handlers never see
+// them. Requests from other origins are passed on without the headers,
+// which makes the browser block the response.
+func (cfg *apiConfig) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.cors.allowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !cfg.cors.originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.cors.allowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.cors.allowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", corsPreflightMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
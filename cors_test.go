@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	const frontend = "https://app.example.com"
+
+	tests := []struct {
+		name           string
+		allowedOrigins []string
+		method         string
+		header         map[string]string
+		wantStatus     int
+		wantHeaders    map[string]string
+		wantHandler    bool
+	}{
+		{
+			name:           "preflight for the upload endpoint",
+			allowedOrigins: []string{frontend},
+			method:         http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         frontend,
+				"Access-Control-Request-Method":  http.MethodPost,
+				"Access-Control-Request-Headers": "authorization, content-type",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  frontend,
+				"Access-Control-Allow-Methods": strings.Join(defaultCORSMethods, ", "),
+				"Access-Control-Allow-Headers": strings.Join(defaultCORSHeaders, ", "),
+				"Access-Control-Max-Age":       corsPreflightMaxAge,
+			},
+		},
+		{
+			name:           "upload from an allowed origin",
+			allowedOrigins: []string{frontend},
+			method:         http.MethodPost,
+			header:         map[string]string{"Origin": frontend},
+			wantStatus:     http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":   frontend,
+				"Access-Control-Expose-Headers": strings.Join(corsExposedHeaders, ", "),
+			},
+			wantHandler: true,
+		},
+		{
+			name:           "wildcard allows any origin",
+			allowedOrigins: []string{"*"},
+			method:         http.MethodPost,
+			header:         map[string]string{"Origin": "https://other.example.com"},
+			wantStatus:     http.StatusOK,
+			wantHeaders:    map[string]string{"Access-Control-Allow-Origin": "https://other.example.com"},
+			wantHandler:    true,
+		},
+		{
+			name:           "preflight from another origin gets no CORS headers",
+			allowedOrigins: []string{frontend},
+			method:         http.MethodOptions,
+			header: map[string]string{
+				"Origin":                        "https://evil.example.com",
+				"Access-Control-Request-Method": http.MethodPost,
+			},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+			wantHandler: true,
+		},
+		{
+			name:        "CORS off without allowed origins",
+			method:      http.MethodPost,
+			header:      map[string]string{"Origin": frontend},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""},
+			wantHandler: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &apiConfig{cors: corsConfig{
+				allowedOrigins: tc.allowedOrigins,
+				allowedMethods: defaultCORSMethods,
+				allowedHeaders: defaultCORSHeaders,
+			}}
+			handlerCalled := false
+			handler := cfg.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerCalled = true
+			}))
+
+			r := httptest.NewRequest(tc.method, "/api/video_upload/0d2b1b0c-3c3e-4e63-9b0b-7d1b3e7a5a10", nil)
+			for name, value := range tc.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if handlerCalled != tc.wantHandler {
+				t.Errorf("handler called = %v, want %v", handlerCalled, tc.wantHandler)
+			}
+			for name, want := range tc.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
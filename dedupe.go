@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// reuseIdenticalVideo points video at the stored objects of an already
+// processed upload with the same content hash, skipping processing
+// entirely. The video keeps its own row, owner and thumbnail, and the
+// shared objects are only deleted along with the last video using them.
+// Only the owner's own files in the job's bucket, under their tenant's
+// prefix, are reused, so no one's video points at files outside their
+// prefix. It reports whether a match was found and saved.
+func (cfg *apiConfig) reuseIdenticalVideo(ctx context.Context, video *database.Video, job videoJob) (bool, error) {
+	storedPrefix := storedURL(job.storage, tenantKey(requestTenant(ctx), userKeyPrefix(video.UserID)))
+	match, err := cfg.db.GetReadyVideoByContentHash(job.contentHash, storedPrefix)
+	if err != nil {
+		return false, err
+	}
+	if match.VideoURL == nil {
+		return false, nil
+	}
+
+	video.VideoURL = match.VideoURL
+	video.Renditions = match.Renditions
+	video.HLSPlaylistURL = match.HLSPlaylistURL
+	video.SpriteSheetURL = match.SpriteSheetURL
+	video.SpriteVTTURL = match.SpriteVTTURL
+	video.Duration = match.Duration
+	video.StorageClass = match.StorageClass
+	video.FormatName = match.FormatName
+	video.VideoCodec = match.VideoCodec
+	video.Width = match.Width
+	video.Height = match.Height
+	video.OriginalURL = match.OriginalURL
+	video.OriginalMediaType = match.OriginalMediaType
+	video.NormalizeAudio = match.NormalizeAudio
+	video.Rotation = match.Rotation
+	video.DerivedBytes = match.DerivedBytes
+	video.ContentHash = job.contentHash
+	video.FileSize = job.size
+	video.Status = database.VideoStatusReady
+
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		return false, err
+	}
+	cfg.notifyVideoStatus(*video, database.VideoStatusReady)
+	return true, nil
+}
+
+// processedContentHash is the content hash of an upload processed with
+// options that change the stored result, so it's only reused for uploads
+// of the same file with the same options
+func processedContentHash(uploadHash string, options ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{uploadHash}, options...), ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// storedObjectsShared reports whether another video still references the
+// video's stored objects
+func (cfg *apiConfig) storedObjectsShared(video database.Video) (bool, error) {
+	if video.VideoURL == nil || *video.VideoURL == "" {
+		return false, nil
+	}
+	n, err := cfg.db.CountVideosByVideoURL(*video.VideoURL)
+	if err != nil {
+		return false, err
+	}
+	return n > 1, nil
+}
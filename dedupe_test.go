@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestReuseIdenticalVideo(t *testing.T) {
+	const contentHash = "0123456789abcdef"
+
+	tests := []struct {
+		name string
+		// matchKey is the key the identical, processed video is stored
+		// under, given the uploader and another user, in matchBucket, or
+		// the test bucket if empty
+		matchKey    func(owner, other uuid.UUID) string
+		matchBucket string
+		tenantID    string // of the uploader
+		wantReused  bool
+	}{
+		{
+			name:       "owner's own video",
+			matchKey:   func(owner, other uuid.UUID) string { return userKeyPrefix(owner) + "videos/landscape/abc/video.mp4" },
+			wantReused: true,
+		},
+		{
+			name: "owner's own video under their tenant",
+			matchKey: func(owner, other uuid.UUID) string {
+				return tenantKey("acme", userKeyPrefix(owner)+"videos/landscape/abc/video.mp4")
+			},
+			tenantID:   "acme",
+			wantReused: true,
+		},
+		{
+			name: "same user ID under another tenant",
+			matchKey: func(owner, other uuid.UUID) string {
+				return tenantKey("globex", userKeyPrefix(owner)+"videos/landscape/abc/video.mp4")
+			},
+			tenantID: "acme",
+		},
+		{
+			name: "tenant's video for an uploader with no tenant",
+			matchKey: func(owner, other uuid.UUID) string {
+				return tenantKey("acme", userKeyPrefix(owner)+"videos/landscape/abc/video.mp4")
+			},
+		},
+		{
+			name:     "another user's video",
+			matchKey: func(owner, other uuid.UUID) string { return userKeyPrefix(other) + "videos/landscape/abc/video.mp4" },
+		},
+		{
+			name:        "owner's video in another bucket",
+			matchKey:    func(owner, other uuid.UUID) string { return userKeyPrefix(owner) + "videos/landscape/abc/video.mp4" },
+			matchBucket: "tubely-other-region",
+		},
+		{
+			name:     "video stored before the per-user layout",
+			matchKey: func(owner, other uuid.UUID) string { return "landscape-abc.mp4" },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			other := createTestUser(t, cfg, "other@example.com")
+			storage, err := cfg.storageRegions.forRegion("")
+			if err != nil {
+				t.Fatalf("forRegion: %v", err)
+			}
+
+			bucket := tc.matchBucket
+			if bucket == "" {
+				bucket = testBucket
+			}
+			matchURL := bucket + "," + tc.matchKey(owner, other)
+			match := createTestVideo(t, cfg, owner)
+			match.VideoURL = &matchURL
+			match.ContentHash = contentHash
+			match.Status = database.VideoStatusReady
+			if err := cfg.db.UpdateVideo(match); err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			video := createTestVideo(t, cfg, owner)
+			ctx := withRequestTenant(context.Background(), tc.tenantID)
+			reused, err := cfg.reuseIdenticalVideo(ctx, &video, videoJob{storage: storage, contentHash: contentHash, size: 4096})
+			if err != nil {
+				t.Fatalf("reuseIdenticalVideo: %v", err)
+			}
+			if reused != tc.wantReused {
+				t.Fatalf("reused = %v, want %v", reused, tc.wantReused)
+			}
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if tc.wantReused {
+				if stored.VideoURL == nil || *stored.VideoURL != matchURL {
+					t.Errorf("video URL = %v, want %q", stored.VideoURL, matchURL)
+				}
+			} else if stored.VideoURL != nil {
+				t.Errorf("video URL = %q, want none", *stored.VideoURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// isFastStartMP4 walks the top-level MP4 boxes and reports whether the moov
+// (index) box comes before the mdat (media) box, which is what lets a
+// browser start playback before the whole file has downloaded.
+func isFastStartMP4(r io.ReaderAt, size int64) (bool, error) {
+	var offset int64
+	header := make([]byte, 16)
+
+	for offset+8 <= size {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return false, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+
+		switch boxSize {
+		case 0:
+			// Box extends to the end of the file
+			boxSize = size - offset
+		case 1:
+			// 64-bit size follows the type
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return false, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if boxSize < 8 {
+			return false, errors.New("invalid MP4 box size")
+		}
+
+		switch boxType {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+		offset += boxSize
+	}
+
+	return false, errors.New("no moov or mdat box found")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Box is a top-level MP4 box of boxType with payload zero bytes after
+// its 8 byte header
+func mp4Box(boxType string, payload int) []byte {
+	box := make([]byte, 8+payload)
+	binary.BigEndian.PutUint32(box[:4], uint32(8+payload))
+	copy(box[4:8], boxType)
+	return box
+}
+
+func TestIsFastStartMP4(t *testing.T) {
+	largeMdat := make([]byte, 16+32)
+	binary.BigEndian.PutUint32(largeMdat[:4], 1)
+	copy(largeMdat[4:8], "mdat")
+	binary.BigEndian.PutUint64(largeMdat[8:16], uint64(len(largeMdat)))
+
+	tests := []struct {
+		name    string
+		boxes   [][]byte
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:  "moov before mdat",
+			boxes: [][]byte{mp4Box("ftyp", 16), mp4Box("moov", 64), mp4Box("mdat", 256)},
+			want:  true,
+		},
+		{
+			name:  "mdat before moov",
+			boxes: [][]byte{mp4Box("ftyp", 16), mp4Box("mdat", 256), mp4Box("moov", 64)},
+			want:  false,
+		},
+		{
+			name:  "free box before moov",
+			boxes: [][]byte{mp4Box("ftyp", 16), mp4Box("free", 8), mp4Box("moov", 64), mp4Box("mdat", 256)},
+			want:  true,
+		},
+		{
+			name:  "64-bit mdat size before moov",
+			boxes: [][]byte{mp4Box("ftyp", 16), largeMdat, mp4Box("moov", 64)},
+			want:  false,
+		},
+		{
+			name:    "box smaller than its header",
+			boxes:   [][]byte{{0, 0, 0, 4, 'f', 't', 'y', 'p'}},
+			wantErr: true,
+		},
+		{
+			name:    "neither moov nor mdat",
+			boxes:   [][]byte{mp4Box("ftyp", 16), mp4Box("free", 8)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.Join(tc.boxes, nil)
+			got, err := isFastStartMP4(bytes.NewReader(data), int64(len(data)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("isFastStartMP4 error = %v, want error: %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("isFastStartMP4 = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestProcessVideoFastStart checks an MP4 already in faststart order is
+// stored as uploaded, without the ffmpeg faststart pass. The fake ffmpeg
+// only writes empty files, so a video it rewrote is stored empty.
+func TestProcessVideoFastStart(t *testing.T) {
+	upload := bytes.Join([][]byte{mp4Box("ftyp", 16), mp4Box("moov", 64), mp4Box("mdat", 256)}, nil)
+
+	tests := []struct {
+		name       string
+		fastStart  bool
+		wantStored []byte
+	}{
+		{
+			name:       "faststart MP4 skips ffmpeg",
+			fastStart:  true,
+			wantStored: upload,
+		},
+		{
+			name:       "other MP4 is rewritten by ffmpeg",
+			fastStart:  false,
+			wantStored: []byte{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			storage, err := cfg.storageRegions.forRegion("")
+			if err != nil {
+				t.Fatalf("forRegion: %v", err)
+			}
+
+			srcPath := filepath.Join(t.TempDir(), "upload.mp4")
+			if err := os.WriteFile(srcPath, upload, 0o600); err != nil {
+				t.Fatalf("couldn't write upload: %v", err)
+			}
+
+			processed, err := cfg.processVideo(context.Background(), video, videoSource{
+				path:      srcPath,
+				mediaType: "video/mp4",
+				fastStart: tc.fastStart,
+				storage:   storage,
+			})
+			if err != nil {
+				t.Fatalf("processVideo: %v", err)
+			}
+			if processed.VideoURL == nil {
+				t.Fatal("processed video has no VideoURL")
+			}
+			_, key, err := splitStoredURL(*processed.VideoURL)
+			if err != nil {
+				t.Fatalf("splitStoredURL(%q): %v", *processed.VideoURL, err)
+			}
+			stored, ok := bucket.object(key)
+			if !ok {
+				t.Fatalf("nothing stored under %q", key)
+			}
+			if !bytes.Equal(stored, tc.wantStored) {
+				t.Errorf("stored playback file is %d bytes, want %d", len(stored), len(tc.wantStored))
+			}
+		})
+	}
+}
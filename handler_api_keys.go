@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerAPIKeyCreate issues a key for server-to-server uploads. The key is
+// only ever shown in this response.
+func (cfg *apiConfig) handlerAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		ID  uuid.UUID `json:"id"`
+		Key string    `json:"key"`
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key", err)
+		return
+	}
+
+	apiKey, err := cfg.db.CreateAPIKey(userID, auth.HashAPIKey(key))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save API key", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		ID:  apiKey.ID,
+		Key: key,
+	})
+}
+
+func (cfg *apiConfig) handlerAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(r.PathValue("keyID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid API key ID", err)
+		return
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := cfg.db.RevokeAPIKey(keyID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API key", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "API key not found", errors.New("no active API key for user"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateUpload accepts either an "ApiKey" or a "Bearer" JWT
+// authorization header. On failure a 401 has already been written.
+func (cfg *apiConfig) authenticateUpload(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, err := cfg.authenticateUploadRequest(r)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// authenticateUploadRequest is authenticateUpload without the response,
+// failures are an *accessError
+func (cfg *apiConfig) authenticateUploadRequest(r *http.Request) (uuid.UUID, error) {
+	if key, err := auth.GetAPIKey(r.Header); err == nil {
+		apiKey, err := cfg.db.GetAPIKeyByHash(auth.HashAPIKey(key))
+		if err != nil {
+			return uuid.Nil, &accessError{http.StatusInternalServerError, errCodeInternal, "Couldn't look up API key", err}
+		}
+		if apiKey.ID == uuid.Nil || apiKey.RevokedAt != nil {
+			return uuid.Nil, &accessError{http.StatusUnauthorized, errCodeInvalidAPIKey, "Invalid or revoked API key", nil}
+		}
+		setRequestUser(r, apiKey.UserID)
+		return apiKey.UserID, nil
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil, &accessError{http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid authorization header", err}
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return uuid.Nil, &accessError{http.StatusUnauthorized, errCodeUnauthorized, "Couldn't validate JWT", err}
+	}
+	return userID, nil
+}
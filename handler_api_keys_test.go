@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// createTestAPIKey issues an API key for userID through the handler, and
+// returns its ID and the key
+func createTestAPIKey(t *testing.T, cfg *apiConfig, userID uuid.UUID) (uuid.UUID, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/api_keys", nil)
+	authorizeTestRequest(t, r, userID)
+	w := httptest.NewRecorder()
+	cfg.handlerAPIKeyCreate(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating API key: status = %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		ID  uuid.UUID `json:"id"`
+		Key string    `json:"key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("couldn't decode API key: %v", err)
+	}
+	// Only its hash is stored
+	if stored, err := cfg.db.GetAPIKeyByHash(created.Key); err != nil || stored.ID != uuid.Nil {
+		t.Fatalf("API key is stored as issued: %v, %v", stored.ID, err)
+	}
+	return created.ID, created.Key
+}
+
+func TestHandlerUploadVideoAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyOwner   string // "owner", "other", or "" for a key nobody was issued
+		revoke     bool
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "valid key uploads",
+			keyOwner:   "owner",
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "revoked key is refused",
+			keyOwner:   "owner",
+			revoke:     true,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeInvalidAPIKey,
+		},
+		{
+			name:       "unknown key is refused",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeInvalidAPIKey,
+		},
+		{
+			name:       "another user's key can't upload to the video",
+			keyOwner:   "other",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeNotOwner,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			other := createTestUser(t, cfg, "other@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			key := "not-an-issued-key"
+			if tc.keyOwner != "" {
+				keyUser := owner
+				if tc.keyOwner == "other" {
+					keyUser = other
+				}
+				var keyID uuid.UUID
+				keyID, key = createTestAPIKey(t, cfg, keyUser)
+				if tc.revoke {
+					r := httptest.NewRequest(http.MethodDelete, "/api/api_keys/"+keyID.String(), nil)
+					r.SetPathValue("keyID", keyID.String())
+					authorizeTestRequest(t, r, keyUser)
+					w := httptest.NewRecorder()
+					cfg.handlerAPIKeyRevoke(w, r)
+					if w.Code != http.StatusNoContent {
+						t.Fatalf("revoking API key: status = %d: %s", w.Code, w.Body)
+					}
+				}
+			}
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			r.Header.Set("Authorization", "ApiKey "+key)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if staged := bucket.keys("uploads/"); (len(staged) == 1) != (tc.wantStatus == http.StatusAccepted) {
+				t.Errorf("staged uploads = %v", staged)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// handlerAssetGet serves files from the assets directory through
+// http.ServeContent, so Range and If-Modified-Since requests get 206 and
+// 304 responses instead of the whole file.
+func (cfg *apiConfig) handlerAssetGet(w http.ResponseWriter, r *http.Request) {
+	// Asset names never contain directories, so anything else is refused
+	// rather than resolved against the assets root
+	assetPath := r.PathValue("assetPath")
+	if assetPath == "" || assetPath != filepath.Base(assetPath) || assetPath == ".." {
+		respondWithError(w, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+
+	f, err := os.Open(cfg.getAssetDiskPath(assetPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondWithError(w, http.StatusNotFound, "Asset not found", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open asset", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read asset", err)
+		return
+	}
+	if info.IsDir() {
+		respondWithError(w, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+
+	// Content addressed names never change contents, anything else may be
+	// replaced in place
+	if immutableAssetPattern.MatchString(assetPath) {
+		w.Header().Set("Cache-Control", immutableAssetCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
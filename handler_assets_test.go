@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandlerAssetGet(t *testing.T) {
+	asset := bytes.Repeat([]byte("0123456789"), 100)
+
+	tests := []struct {
+		name             string
+		assetPath        string
+		header           map[string]string
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{
+			name:       "whole asset",
+			assetPath:  "thumb.png",
+			wantStatus: http.StatusOK,
+			wantBody:   asset,
+		},
+		{
+			name:             "first 100 bytes",
+			assetPath:        "thumb.png",
+			header:           map[string]string{"Range": "bytes=0-99"},
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 0-99/1000",
+			wantBody:         asset[:100],
+		},
+		{
+			name:             "last 10 bytes",
+			assetPath:        "thumb.png",
+			header:           map[string]string{"Range": "bytes=-10"},
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 990-999/1000",
+			wantBody:         asset[990:],
+		},
+		{
+			name:             "range past the end",
+			assetPath:        "thumb.png",
+			header:           map[string]string{"Range": "bytes=1000-"},
+			wantStatus:       http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */1000",
+		},
+		{
+			name:       "unmodified since",
+			assetPath:  "thumb.png",
+			header:     map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "missing asset",
+			assetPath:  "missing.png",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "path outside the assets directory",
+			assetPath:  "../thumb.png",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			if err := os.WriteFile(filepath.Join(cfg.assetsRoot, "thumb.png"), asset, 0o644); err != nil {
+				t.Fatalf("couldn't write asset: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/assets/thumb.png", nil)
+			r.SetPathValue("assetPath", tc.assetPath)
+			for name, value := range tc.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerAssetGet(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Content-Range"); got != tc.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tc.wantContentRange)
+			}
+			if tc.wantBody != nil && !bytes.Equal(w.Body.Bytes(), tc.wantBody) {
+				t.Errorf("body is %d bytes, want %d", w.Body.Len(), len(tc.wantBody))
+			}
+		})
+	}
+}
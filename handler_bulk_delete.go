@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxBulkDeleteSize = 500
+	// bulkDeleteWorkers bounds how many videos are purged at once
+	bulkDeleteWorkers = 8
+)
+
+type bulkDeleteResult struct {
+	VideoID string `json:"video_id"`
+	Status  int    `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handlerBulkDeleteVideos permanently deletes many videos at once, files
+// and all, without the soft delete's grace period. Owners may delete
+// their own videos, admins anyone's. Every ID is handled on its own, so
+// the response is always 207 with a result per ID, in order.
+func (cfg *apiConfig) handlerBulkDeleteVideos(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoIDs []string `json:"video_ids"`
+	}
+
+	// Accepts an API key as well as a JWT, like every other change to videos
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	// An API key carries no role, so the caller's role is looked up either
+	// way, never trusted from the request
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "User no longer exists", nil)
+		return
+	}
+	role := user.Role
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	if len(params.VideoIDs) == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "video_ids must list at least one video", nil)
+		return
+	}
+	if len(params.VideoIDs) > maxBulkDeleteSize {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, fmt.Sprintf("At most %d videos per bulk delete", maxBulkDeleteSize), nil)
+		return
+	}
+
+	results := make([]bulkDeleteResult, len(params.VideoIDs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(bulkDeleteWorkers, len(params.VideoIDs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = cfg.bulkDeleteVideo(r, userID, role, params.VideoIDs[i])
+			}
+		}()
+	}
+	for i := range params.VideoIDs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	type response struct {
+		Results []bulkDeleteResult `json:"results"`
+	}
+	respondWithJSON(w, http.StatusMultiStatus, response{Results: results})
+}
+
+// bulkDeleteVideo is one ID of a bulk delete
+func (cfg *apiConfig) bulkDeleteVideo(r *http.Request, userID uuid.UUID, role, videoIDString string) bulkDeleteResult {
+	result := bulkDeleteResult{VideoID: videoIDString, Status: http.StatusNoContent}
+	if err := cfg.purgeVideoForUser(r, userID, role, videoIDString); err != nil {
+		var accessErr *accessError
+		if !errors.As(err, &accessErr) {
+			accessErr = &accessError{http.StatusInternalServerError, errCodeInternal, "Couldn't delete video", err}
+		}
+		slog.InfoContext(r.Context(), "bulk delete failed", "video_id", videoIDString, "error", accessErr)
+		result.Status = accessErr.status
+		result.Code = accessErr.code
+		result.Error = accessErr.message
+	}
+	return result
+}
+
+// purgeVideoForUser checks userID may delete the video and purges it,
+// failures are an *accessError
+func (cfg *apiConfig) purgeVideoForUser(r *http.Request, userID uuid.UUID, role, videoIDString string) error {
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		return &accessError{http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err}
+	}
+
+	// Videos already in the trash can be purged too
+	video, err := cfg.db.GetVideoIncludingDeleted(videoID)
+	if err != nil {
+		return &accessError{http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err}
+	}
+	if video.ID == uuid.Nil {
+		return &accessError{http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil}
+	}
+	if role != auth.RoleAdmin {
+		if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+			return err
+		}
+	}
+	// The worker would store files for a video that's no longer there
+	if video.Status == database.VideoStatusProcessing {
+		return &accessError{http.StatusConflict, errCodeAlreadyProcessing, "Video is being processed, delete it once it's done", nil}
+	}
+
+	if err := cfg.purgeVideo(r.Context(), video); err != nil {
+		return &accessError{http.StatusInternalServerError, errCodeStorageError, "Couldn't delete video files", err}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestHandlerBulkDeleteVideosAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		// auth is how the request authenticates: "jwt", "api key",
+		// "other's api key", "unknown api key" or "" for not at all
+		auth       string
+		wantStatus int
+		wantCode   string // of the response, or of the video's result
+		wantResult int    // status of the video's result
+	}{
+		{
+			name:       "owner's JWT",
+			auth:       "jwt",
+			wantStatus: http.StatusMultiStatus,
+			wantResult: http.StatusNoContent,
+		},
+		{
+			name:       "owner's API key",
+			auth:       "api key",
+			wantStatus: http.StatusMultiStatus,
+			wantResult: http.StatusNoContent,
+		},
+		{
+			name:       "another user's API key",
+			auth:       "other's api key",
+			wantStatus: http.StatusMultiStatus,
+			wantResult: http.StatusUnauthorized,
+			wantCode:   errCodeNotOwner,
+		},
+		{
+			name:       "unknown API key",
+			auth:       "unknown api key",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeInvalidAPIKey,
+		},
+		{
+			name:       "no credentials",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			other := createTestUser(t, cfg, "other@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/videos/bulk_delete", strings.NewReader(`{"video_ids":["`+video.ID.String()+`"]}`))
+			r.Header.Set("Content-Type", "application/json")
+			switch tc.auth {
+			case "jwt":
+				authorizeTestRequest(t, r, owner)
+			case "api key":
+				_, key := createTestAPIKey(t, cfg, owner)
+				r.Header.Set("Authorization", "ApiKey "+key)
+			case "other's api key":
+				_, key := createTestAPIKey(t, cfg, other)
+				r.Header.Set("Authorization", "ApiKey "+key)
+			case "unknown api key":
+				r.Header.Set("Authorization", "ApiKey not-an-issued-key")
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerBulkDeleteVideos(w, r)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+
+			var body struct {
+				Code    string             `json:"code"`
+				Results []bulkDeleteResult `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if tc.wantStatus != http.StatusMultiStatus {
+				if body.Code != tc.wantCode {
+					t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+				}
+				return
+			}
+			if len(body.Results) != 1 {
+				t.Fatalf("results = %v, want one", body.Results)
+			}
+			if got := body.Results[0]; got.Status != tc.wantResult || got.Code != tc.wantCode {
+				t.Errorf("result = %d %q, want %d %q", got.Status, got.Code, tc.wantResult, tc.wantCode)
+			}
+
+			stored, err := cfg.db.GetVideoIncludingDeleted(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideoIncludingDeleted: %v", err)
+			}
+			if deleted := stored.ID == uuid.Nil; deleted != (tc.wantResult == http.StatusNoContent) {
+				t.Errorf("video deleted = %v, want %v", deleted, tc.wantResult == http.StatusNoContent)
+			}
+		})
+	}
+}
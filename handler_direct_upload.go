@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerCreateUploadURL lets a client PUT a video straight to S3 rather
+// than through the API. It signs the PUT for the declared type and size,
+// which S3 then holds the client to. Direct uploads are recorded as
+// uploads without an S3 upload ID and, like resumable ones, need the S3
+// storage backend.
+func (cfg *apiConfig) handlerCreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		UploadID  string            `json:"upload_id"`
+		URL       string            `json:"url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	upload, ok := cfg.prepareDirectUpload(w, r)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(cfg.presignExpiry)
+	url, signedHeaders, err := upload.store.presignPut(r.Context(), upload.key, upload.contentType, upload.size, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't sign upload URL", err)
+		return
+	}
+	uploadID, ok := cfg.recordDirectUpload(w, upload)
+	if !ok {
+		return
+	}
+
+	headers := map[string]string{}
+	for name := range signedHeaders {
+		headers[name] = signedHeaders.Get(name)
+	}
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID:  uploadID,
+		URL:       url,
+		Method:    http.MethodPut,
+		Headers:   headers,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handlerCreatePostPolicy is handlerCreateUploadURL for browser upload
+// widgets that send files as a form POST. It takes the same body and
+// returns a signed S3 POST policy instead of a PUT URL:
+//
+//   - url is where the form is posted
+//   - fields are the form fields to send, as they are and before the
+//     file. They include the key, the Content-Type the file must be sent
+//     as, the base64 policy and its signature. Any other field is
+//     refused by S3.
+//   - file_field is the name of the field holding the file, which S3
+//     wants last
+//   - max_size is the most bytes the policy lets through, the declared
+//     size. Empty files are refused too.
+//
+// Once S3 has taken the form, the upload is finalized like a PUT one, at
+// the upload_url finalize endpoint.
+func (cfg *apiConfig) handlerCreatePostPolicy(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		UploadID  string            `json:"upload_id"`
+		URL       string            `json:"url"`
+		Method    string            `json:"method"`
+		Fields    map[string]string `json:"fields"`
+		FileField string            `json:"file_field"`
+		MaxSize   int64             `json:"max_size"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	upload, ok := cfg.prepareDirectUpload(w, r)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(cfg.presignExpiry)
+	url, fields, err := upload.store.presignPost(r.Context(), upload.key, upload.contentType, upload.size, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't sign upload policy", err)
+		return
+	}
+	uploadID, ok := cfg.recordDirectUpload(w, upload)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID:  uploadID,
+		URL:       url,
+		Method:    http.MethodPost,
+		Fields:    fields,
+		FileField: "file",
+		MaxSize:   upload.size,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// directUpload is a direct upload checked against the upload limits and
+// about to be signed
+type directUpload struct {
+	videoID     uuid.UUID
+	userID      uuid.UUID
+	store       *s3Storage
+	key         string
+	contentType string
+	size        int64
+}
+
+// prepareDirectUpload checks a request for a direct upload URL or policy:
+// the caller owns the video, and the declared type and size are ones the
+// upload limits and storage quota allow. It picks the key the raw upload
+// is staged under. Failures are answered, and ok is false.
+func (cfg *apiConfig) prepareDirectUpload(w http.ResponseWriter, r *http.Request) (directUpload, bool) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return directUpload{}, false
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return directUpload{}, false
+	}
+	if !cfg.allowUpload(w, userID) {
+		return directUpload{}, false
+	}
+
+	storage, ok := cfg.storageForRequest(w, r)
+	if !ok {
+		return directUpload{}, false
+	}
+	store, ok := storage.(*s3Storage)
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotImplemented, errCodeNotSupported, "Direct uploads require the S3 storage backend", nil)
+		return directUpload{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return directUpload{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return directUpload{}, false
+	}
+	if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
+		return directUpload{}, false
+	}
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return directUpload{}, false
+	}
+	if !allowedVideoTypes[params.ContentType] {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidMediaType, "Invalid file type: only video/mp4, video/quicktime and video/webm allowed", nil)
+		return directUpload{}, false
+	}
+	if params.Size <= 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "size must be a positive number of bytes", nil)
+		return directUpload{}, false
+	}
+	if params.Size > cfg.maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return directUpload{}, false
+	}
+	if !cfg.checkStorageQuota(w, video, params.Size) {
+		return directUpload{}, false
+	}
+
+	return directUpload{
+		videoID: videoID,
+		userID:  userID,
+		store:   store,
+		// The raw upload is staged under its own key and removed once processed
+		key:         tenantKey(requestTenant(r.Context()), fmt.Sprintf("uploads/%x", uuid.New())),
+		contentType: params.ContentType,
+		size:        params.Size,
+	}, true
+}
+
+// recordDirectUpload saves a signed direct upload for finalizing, as an
+// upload without an S3 upload ID
+func (cfg *apiConfig) recordDirectUpload(w http.ResponseWriter, upload directUpload) (string, bool) {
+	saved, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		ID:          uuid.New().String(),
+		VideoID:     upload.videoID,
+		UserID:      upload.userID,
+		Bucket:      upload.store.bucket,
+		Key:         upload.key,
+		ContentType: upload.contentType,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save upload", err)
+		return "", false
+	}
+	return saved.ID, true
+}
+
+// handlerFinalizeUpload queues a direct upload for processing once the
+// client's PUT, or form POST, has landed. The worker downloads it from S3
+// and runs it through the same pipeline as any other upload.
+func (cfg *apiConfig) handlerFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	upload, store, ok := cfg.getUploadForRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, upload.UserID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// ---- 1. Check the object made it to S3 ----
+	size, err := store.Head(r.Context(), upload.Key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadIncomplete, "Video hasn't been uploaded to the upload URL yet", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't check uploaded video", err)
+		return
+	}
+	// S3 holds the PUT to the signed size, but the quota may have been used
+	// up by other uploads since the URL was signed
+	if size > cfg.maxVideoUploadBytes {
+		cfg.discardDirectUpload(r, store, upload)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	if !cfg.checkStorageQuota(w, video, size) {
+		cfg.discardDirectUpload(r, store, upload)
+		return
+	}
+	if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+		log.Printf("couldn't delete upload %s: %v", upload.ID, err)
+	}
+
+	// ---- 2. Queue the object for processing ----
+	job := videoJob{videoID: video.ID, storage: store, rawKey: upload.Key, mediaType: upload.ContentType, size: size}
+	if err := cfg.queueVideoProcessing(r.Context(), &video, job); err != nil {
+		if errors.Is(err, errVideoQueueFull) {
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeQueueFull, "Video processing queue is full, try again later", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to queue video for processing", err)
+		return
+	}
+	cfg.recordAudit(r, auditActionVideoUpload, video.UserID, video.ID, upload.ContentType, size)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
+
+func (cfg *apiConfig) discardDirectUpload(r *http.Request, store *s3Storage, upload database.Upload) {
+	if err := store.Delete(r.Context(), upload.Key); err != nil {
+		log.Printf("couldn't delete direct upload %s: %v", upload.ID, err)
+	}
+	if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+		log.Printf("couldn't delete upload %s: %v", upload.ID, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long ffmpeg gets to read the stored video through its signed URL
+const thumbnailSourceURLExpiry = 15 * time.Minute
+
+// handlerGenerateThumbnail replaces a video's thumbnail with the frame at
+// ?at=<seconds> of its stored file (defaultThumbnailSeconds if omitted).
+//
+// The video isn't downloaded: ffmpeg is handed a signed URL and, since
+// stored videos are faststart MP4s, seeks to the frame with range requests,
+// reading only the index and the data around it.
+func (cfg *apiConfig) handlerGenerateThumbnail(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, userID, videoRoleEditor); err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+	if video.VideoURL == nil || *video.VideoURL == "" {
+		respondWithError(w, http.StatusConflict, "Video has no file to take a thumbnail from yet", nil)
+		return
+	}
+
+	at := defaultThumbnailSeconds
+	if v := r.URL.Query().Get("at"); v != "" {
+		at, err = strconv.ParseFloat(v, 64)
+		if err != nil || at < 0 {
+			respondWithError(w, http.StatusBadRequest, "at must be a non-negative number of seconds", err)
+			return
+		}
+	}
+	// Videos whose duration couldn't be probed are stored with 0
+	if video.Duration > 0 && at >= video.Duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("at must be less than the video's duration of %.3f seconds", video.Duration), nil)
+		return
+	}
+
+	sourceURL, err := cfg.signStoredURL(r.Context(), *video.VideoURL, thumbnailSourceURLExpiry, SignOptions{})
+	if errors.Is(err, errAssetUnavailable) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video file is no longer available", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+
+	frame, err := os.CreateTemp(cfg.tempDir, "tubely-thumbnail-*.jpg")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to create temporary file", err)
+		return
+	}
+	frame.Close()
+	defer os.Remove(frame.Name())
+
+	if err := cfg.extractFrame(sourceURL, at, frame.Name()); err != nil {
+		respondWithProcessingError(w, mediaProcessingError(videoID, "Couldn't extract frame", err))
+		return
+	}
+
+	thumbnails, err := cfg.saveThumbnailAsset(r.Context(), videoID, frame.Name())
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Error saving file", err)
+		return
+	}
+
+	thumbnailURL := thumbnails[len(thumbnails)-1].URL
+	previous := video
+	video.ThumbnailURL = &thumbnailURL
+	video.Thumbnails = thumbnails
+	video.ThumbnailBytes = thumbnailSizesBytes(thumbnails)
+	// Only the thumbnail is saved, so processing finishing meanwhile isn't
+	// undone
+	video, err = cfg.db.UpdateVideoThumbnail(video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	cfg.deleteReplacedThumbnails(r.Context(), previous, video)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Load balancers give up quickly, so a slow dependency is reported as down
+// rather than left hanging
+const healthCheckTimeout = 2 * time.Second
+
+// handlerHealthz reports 200 only when both the database and the storage
+// backend respond. It needs no authentication.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status   string            `json:"status"`
+		Database string            `json:"database"`
+		Storage  string            `json:"storage"`
+		Errors   map[string]string `json:"errors,omitempty"`
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	var dbErr, storageErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dbErr = cfg.db.Ping(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		storageErr = cfg.storageRegions.ping(ctx)
+	}()
+	wg.Wait()
+
+	resp := response{Status: "ok", Database: "ok", Storage: "ok"}
+	status := http.StatusOK
+	if dbErr != nil || storageErr != nil {
+		resp.Status = "unhealthy"
+		resp.Errors = map[string]string{}
+		status = http.StatusServiceUnavailable
+	}
+	if dbErr != nil {
+		log.Printf("health check: database: %v", dbErr)
+		resp.Database = "unhealthy"
+		resp.Errors["database"] = dbErr.Error()
+	}
+	if storageErr != nil {
+		log.Printf("health check: storage: %v", storageErr)
+		resp.Storage = "unhealthy"
+		resp.Errors["storage"] = storageErr.Error()
+	}
+
+	respondWithJSON(w, status, resp)
+}
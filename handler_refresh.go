@@ -1,15 +1,21 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+const refreshTokenExpiry = time.Hour * 24 * 60
+
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,14 +24,42 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	rt, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if rt.Token == "" || rt.RevokedAt != nil || time.Now().UTC().After(rt.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid, expired or revoked", errors.New("unusable refresh token"))
+		return
+	}
+
+	// Rotate on every use: the presented token is spent and a fresh one is
+	// handed back alongside the access token
+	err = cfg.db.RevokeRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke refresh token", err)
+		return
+	}
+
+	newRefreshToken, err := cfg.issueRefreshToken(rt.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+
+	// The role and tenant are looked up again, so changes apply from the
+	// next refresh
+	user, err := cfg.db.GetUser(rt.UserID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
+		rt.UserID,
+		user.Role,
+		user.TenantID,
 		cfg.jwtSecret,
 		time.Hour,
 	)
@@ -35,7 +69,8 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
 	})
 }
 
@@ -54,3 +89,21 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// issueRefreshToken creates and stores a new refresh token for the user
+func (cfg *apiConfig) issueRefreshToken(userID uuid.UUID) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+		UserID:    userID,
+		Token:     refreshToken,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenExpiry),
+	})
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
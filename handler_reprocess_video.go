@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerReprocessVideo reruns a video's kept original through the current
+// pipeline, replacing its processed files once the new ones are stored.
+// Owners and admins may trigger it. Asking again while it's processing is
+// refused rather than queueing a second job.
+func (cfg *apiConfig) handlerReprocessVideo(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, role, err := auth.ValidateJWTWithRole(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if role != auth.RoleAdmin {
+		if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+			respondWithAccessError(w, err)
+			return
+		}
+	}
+
+	if video.OriginalURL == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeNoOriginal, "Video has no kept original to reprocess", nil)
+		return
+	}
+	storage, rawKey, err := cfg.storageFor(*video.OriginalURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't find the video's original", err)
+		return
+	}
+	// Admins reprocess other tenants' videos too, the files go where the
+	// owner's do
+	ctx, err := cfg.withOwnerTenant(r.Context(), video.UserID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't find the video's owner", err)
+		return
+	}
+
+	started, err := cfg.db.StartVideoReprocessing(video.ID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	if !started {
+		respondWithErrorCode(w, http.StatusConflict, errCodeAlreadyProcessing, "Video is already being processed", nil)
+		return
+	}
+	previousStatus := video.Status
+	video.Status = database.VideoStatusProcessing
+
+	err = cfg.enqueueVideoJob(videoJob{
+		videoID:        video.ID,
+		storage:        storage,
+		rawKey:         rawKey,
+		tenantID:       requestTenant(ctx),
+		mediaType:      video.OriginalMediaType,
+		size:           video.FileSize,
+		storageClass:   video.StorageClass,
+		contentHash:    video.ContentHash,
+		normalizeAudio: video.NormalizeAudio,
+		rotate:         video.Rotation,
+		reprocess:      true,
+	})
+	if err != nil {
+		video.Status = previousStatus
+		if err := cfg.db.SetVideoStatus(video.ID, previousStatus); err != nil {
+			log.Printf("couldn't restore status of video %s: %v", video.ID, err)
+		}
+		if errors.Is(err, errVideoQueueFull) {
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeQueueFull, "Video processing queue is full, try again later", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to queue video for processing", err)
+		return
+	}
+	cfg.recordAudit(r, auditActionVideoReprocess, userID, video.ID, video.OriginalMediaType, video.FileSize)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(ctx, video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
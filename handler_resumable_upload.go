@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// S3 numbers multipart upload parts from 1 to 10000
+const maxUploadPartNumber = 10000
+
+// Resumable uploads are built on S3 multipart uploads, so they're only
+// available with the S3 storage backend
+func (cfg *apiConfig) handlerInitiateUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		UploadID string `json:"upload_id"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.allowUpload(w, userID) {
+		return
+	}
+
+	storage, ok := cfg.storageForRequest(w, r)
+	if !ok {
+		return
+	}
+	store, ok := storage.(*s3Storage)
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotImplemented, errCodeNotSupported, "Resumable uploads require the S3 storage backend", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	if !allowedVideoTypes[params.ContentType] {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidMediaType, "Invalid file type: only video/mp4, video/quicktime and video/webm allowed", nil)
+		return
+	}
+
+	// The raw upload is staged under its own key and removed once processed
+	key := tenantKey(requestTenant(r.Context()), fmt.Sprintf("uploads/%x", uuid.New()))
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(params.ContentType),
+	}
+	if store.kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(store.kmsKeyID)
+	}
+	created, err := store.client.CreateMultipartUpload(r.Context(), input)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't start multipart upload", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		ID:          uuid.New().String(),
+		S3UploadID:  aws.ToString(created.UploadId),
+		VideoID:     videoID,
+		UserID:      userID,
+		Bucket:      store.bucket,
+		Key:         key,
+		ContentType: params.ContentType,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID: upload.ID,
+	})
+}
+
+// handlerUploadPart stores one chunk of a resumable upload. S3 replaces a
+// part when the same number is uploaded again, so a failed part can simply
+// be re-PUT.
+func (cfg *apiConfig) handlerUploadPart(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		PartNumber int32  `json:"part_number"`
+		ETag       string `json:"etag"`
+	}
+
+	upload, store, ok := cfg.getUploadForRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.Atoi(r.PathValue("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxUploadPartNumber {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidPartNumber, fmt.Sprintf("Part number must be between 1 and %d", maxUploadPartNumber), err)
+		return
+	}
+
+	if r.ContentLength <= 0 {
+		respondWithErrorCode(w, http.StatusLengthRequired, errCodeLengthRequired, "Content-Length is required for upload parts", nil)
+		return
+	}
+	if r.ContentLength > cfg.maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, r.ContentLength)
+
+	part, err := store.client.UploadPart(r.Context(), &s3.UploadPartInput{
+		Bucket:        aws.String(upload.Bucket),
+		Key:           aws.String(upload.Key),
+		UploadId:      aws.String(upload.S3UploadID),
+		PartNumber:    aws.Int32(int32(partNumber)),
+		Body:          r.Body,
+		ContentLength: aws.Int64(r.ContentLength),
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't upload part", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		PartNumber: int32(partNumber),
+		ETag:       aws.ToString(part.ETag),
+	})
+}
+
+func (cfg *apiConfig) handlerCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, store, ok := cfg.getUploadForRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, upload.UserID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// ---- 1. Collect the parts S3 has received ----
+	var completedParts []types.CompletedPart
+	var totalSize int64
+	paginator := s3.NewListPartsPaginator(store.client, &s3.ListPartsInput{
+		Bucket:   aws.String(upload.Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.S3UploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(r.Context())
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't list uploaded parts", err)
+			return
+		}
+		for _, part := range page.Parts {
+			completedParts = append(completedParts, types.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: part.PartNumber,
+			})
+			totalSize += aws.ToInt64(part.Size)
+		}
+	}
+	if len(completedParts) == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeNoParts, "No parts have been uploaded", nil)
+		return
+	}
+	if totalSize > cfg.maxVideoUploadBytes {
+		cfg.abortUpload(r, store, upload)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	if !cfg.checkStorageQuota(w, video, totalSize) {
+		cfg.abortUpload(r, store, upload)
+		return
+	}
+	sort.Slice(completedParts, func(i, j int) bool {
+		return aws.ToInt32(completedParts[i].PartNumber) < aws.ToInt32(completedParts[j].PartNumber)
+	})
+
+	// ---- 2. Assemble the parts into the raw object ----
+	_, err = store.client.CompleteMultipartUpload(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(upload.Bucket),
+		Key:             aws.String(upload.Key),
+		UploadId:        aws.String(upload.S3UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't complete multipart upload", err)
+		return
+	}
+	if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+		log.Printf("couldn't delete upload %s: %v", upload.ID, err)
+	}
+
+	// ---- 3. Queue the assembled object for processing ----
+	job := videoJob{videoID: video.ID, storage: store, rawKey: upload.Key, mediaType: upload.ContentType, size: totalSize}
+	if err := cfg.queueVideoProcessing(r.Context(), &video, job); err != nil {
+		if errors.Is(err, errVideoQueueFull) {
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeQueueFull, "Video processing queue is full, try again later", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to queue video for processing", err)
+		return
+	}
+	cfg.recordAudit(r, auditActionVideoUpload, video.UserID, video.ID, upload.ContentType, totalSize)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
+
+// getUploadForRequest authenticates the request and loads the upload named
+// in the path along with the storage of the bucket it's going to, writing
+// an error response and returning false if any of that fails. direct picks
+// uploads PUT straight to S3 rather than multipart ones.
+func (cfg *apiConfig) getUploadForRequest(w http.ResponseWriter, r *http.Request, direct bool) (database.Upload, *s3Storage, bool) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return database.Upload{}, nil, false
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return database.Upload{}, nil, false
+	}
+
+	upload, err := cfg.db.GetUpload(r.PathValue("uploadID"), userID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get upload", err)
+		return database.Upload{}, nil, false
+	}
+	// Direct uploads are the ones without an S3 upload ID
+	if upload.ID == "" || upload.VideoID != videoID || (upload.S3UploadID == "") != direct {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeUploadNotFound, "Upload not found", errors.New("no matching upload for user"))
+		return database.Upload{}, nil, false
+	}
+
+	storage, err := cfg.storageRegions.forBucket(upload.Bucket)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Upload's bucket is no longer configured", err)
+		return database.Upload{}, nil, false
+	}
+	store, ok := storage.(*s3Storage)
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotImplemented, errCodeNotSupported, "Resumable uploads require the S3 storage backend", nil)
+		return database.Upload{}, nil, false
+	}
+
+	return upload, store, true
+}
+
+func (cfg *apiConfig) abortUpload(r *http.Request, store *s3Storage, upload database.Upload) {
+	_, err := store.client.AbortMultipartUpload(r.Context(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(upload.Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.S3UploadID),
+	})
+	if err != nil {
+		log.Printf("couldn't abort multipart upload %s: %v", upload.ID, err)
+	}
+	if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+		log.Printf("couldn't delete upload %s: %v", upload.ID, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// rotationFilters are the ffmpeg filters turning a video clockwise by each
+// rotation the API accepts
+var rotationFilters = map[int]string{
+	90:  "transpose=clock",
+	180: "hflip,vflip",
+	270: "transpose=cclock",
+}
+
+func rotationFilter(degrees int) string {
+	return rotationFilters[degrees]
+}
+
+// handlerRotateVideo turns a video clockwise by 90, 180 or 270 degrees, for
+// videos recorded sideways without rotation metadata players could go by.
+// Its playback file is re-encoded rotated and run through the rest of the
+// pipeline in the background, like a reprocess, so the stored resolution,
+// orientation and key prefix follow. The kept original stays as uploaded,
+// reprocessing it applies the video's rotation again. Only the owner may
+// rotate a video.
+func (cfg *apiConfig) handlerRotateVideo(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Degrees int `json:"degrees"`
+	}
+
+	video, userID, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	if _, ok := rotationFilters[params.Degrees]; !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRotation, "degrees must be 90, 180 or 270", nil)
+		return
+	}
+
+	if video.VideoURL == nil || *video.VideoURL == "" {
+		respondWithError(w, http.StatusConflict, "Video has no file to rotate yet", nil)
+		return
+	}
+	storage, playbackKey, err := cfg.storageFor(*video.VideoURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't find the video's file", err)
+		return
+	}
+
+	started, err := cfg.db.StartVideoRotation(video.ID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	if !started {
+		respondWithErrorCode(w, http.StatusConflict, errCodeAlreadyProcessing, "Video is already being processed", nil)
+		return
+	}
+	previousStatus := video.Status
+	video.Status = database.VideoStatusProcessing
+
+	err = cfg.enqueueVideoJob(videoJob{
+		videoID:      video.ID,
+		storage:      storage,
+		rawKey:       playbackKey,
+		tenantID:     requestTenant(r.Context()),
+		mediaType:    "video/mp4",
+		size:         video.FileSize,
+		storageClass: video.StorageClass,
+		reprocess:    true,
+		fromPlayback: true,
+		rotate:       params.Degrees,
+	})
+	if err != nil {
+		video.Status = previousStatus
+		if err := cfg.db.SetVideoStatus(video.ID, previousStatus); err != nil {
+			log.Printf("couldn't restore status of video %s: %v", video.ID, err)
+		}
+		if errors.Is(err, errVideoQueueFull) {
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeQueueFull, "Video processing queue is full, try again later", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to queue video for processing", err)
+		return
+	}
+	cfg.recordAudit(r, auditActionVideoRotate, userID, video.ID, "video/mp4", video.FileSize)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
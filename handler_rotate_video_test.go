@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// testTransposedProbeOutput is testProbeOutput turned a quarter
+var testTransposedProbeOutput = strings.Replace(testProbeOutput, `"width":1280,"height":720`, `"width":720,"height":1280`, 1)
+
+func TestHandlerRotateVideo(t *testing.T) {
+	tests := []struct {
+		name            string
+		degrees         int
+		wantStatus      int
+		wantCode        string
+		wantFilter      string
+		wantWidth       int
+		wantHeight      int
+		wantOrientation string
+	}{
+		{
+			name:            "90 degrees swaps width and height",
+			degrees:         90,
+			wantStatus:      http.StatusAccepted,
+			wantFilter:      "transpose=clock",
+			wantWidth:       720,
+			wantHeight:      1280,
+			wantOrientation: "vertical",
+		},
+		{
+			name:            "270 degrees swaps width and height",
+			degrees:         270,
+			wantStatus:      http.StatusAccepted,
+			wantFilter:      "transpose=cclock",
+			wantWidth:       720,
+			wantHeight:      1280,
+			wantOrientation: "vertical",
+		},
+		{
+			name:            "180 degrees keeps them",
+			degrees:         180,
+			wantStatus:      http.StatusAccepted,
+			wantFilter:      "hflip,vflip",
+			wantWidth:       1280,
+			wantHeight:      720,
+			wantOrientation: "landscape",
+		},
+		{
+			name:       "degrees that aren't a quarter turn",
+			degrees:    45,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidRotation,
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("a sideways video"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("upload status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			runQueuedVideoJobs(t, cfg)
+			uploaded, err := cfg.db.GetVideo(video.ID)
+			if err != nil || uploaded.VideoURL == nil {
+				t.Fatalf("uploaded video has no file: %v", err)
+			}
+			_, uploadedKey, err := splitStoredURL(*uploaded.VideoURL)
+			if err != nil {
+				t.Fatalf("splitStoredURL: %v", err)
+			}
+
+			// From here on ffmpeg marks what it transposed, and ffprobe
+			// reports those files turned
+			logPath := filepath.Join(t.TempDir(), "ffmpeg.log")
+			cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", `echo "$*" >> '`+logPath+"'\n"+testFFmpegScript+`
+case "$*" in *transpose=*) echo transposed > "$last";; esac`)
+			cfg.ffprobePath = writeFakeCommand(t, "ffprobe", `for a; do f=$a; done
+if grep -q transposed "$f"; then echo '`+testTransposedProbeOutput+`'; else echo '`+testProbeOutput+`'; fi`)
+
+			r = httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/rotate", strings.NewReader(`{"degrees":`+strconv.Itoa(tc.degrees)+`}`))
+			r.Header.Set("Content-Type", "application/json")
+			r.SetPathValue("videoID", video.ID.String())
+			authorizeTestRequest(t, r, owner)
+			w = httptest.NewRecorder()
+			cfg.handlerRotateVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code   string `json:"code"`
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if tc.wantCode == "" && body.Status != database.VideoStatusProcessing {
+				t.Errorf("status = %q while rotating, want %q", body.Status, database.VideoStatusProcessing)
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			rotated, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if rotated.Width != tc.wantWidth || rotated.Height != tc.wantHeight {
+				t.Errorf("resolution = %dx%d, want %dx%d", rotated.Width, rotated.Height, tc.wantWidth, tc.wantHeight)
+			}
+			if tc.wantCode != "" {
+				return
+			}
+			if rotated.Status != database.VideoStatusReady {
+				t.Errorf("status = %q after rotating, want %q", rotated.Status, database.VideoStatusReady)
+			}
+			if rotated.Rotation != tc.degrees {
+				t.Errorf("rotation = %d, want %d", rotated.Rotation, tc.degrees)
+			}
+			if rotated.VideoURL == nil || !strings.Contains(*rotated.VideoURL, "/videos/"+tc.wantOrientation+"/") {
+				t.Errorf("video_url = %v, want it under the %s prefix", rotated.VideoURL, tc.wantOrientation)
+			}
+			if _, ok := bucket.object(uploadedKey); ok {
+				t.Errorf("unrotated file %s is still stored", uploadedKey)
+			}
+			runs, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("couldn't read ffmpeg log: %v", err)
+			}
+			var filtered bool
+			for _, run := range strings.Split(string(runs), "\n") {
+				if strings.Contains(run, "-progress pipe:1") && strings.Contains(run, "-vf "+tc.wantFilter+" ") {
+					filtered = true
+				}
+			}
+			if !filtered {
+				t.Errorf("no faststart pass applied %s", tc.wantFilter)
+			}
+		})
+	}
+}
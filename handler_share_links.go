@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerCreateShareLink issues a link anyone can play the video with, no
+// account needed. The token is only ever shown in this response. Links
+// work until revoked, or for expires_in seconds if that's given.
+func (cfg *apiConfig) handlerCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresIn *int `json:"expires_in"`
+	}
+	type response struct {
+		ID        uuid.UUID  `json:"id"`
+		Token     string     `json:"token"`
+		URL       string     `json:"url"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	video, userID, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// The body is optional, an empty one makes a link that doesn't expire
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil && !errors.Is(err, io.EOF) {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	var expiresAt *time.Time
+	if params.ExpiresIn != nil {
+		if *params.ExpiresIn <= 0 {
+			respondWithError(w, http.StatusBadRequest, "expires_in must be a positive number of seconds", nil)
+			return
+		}
+		t := time.Now().UTC().Add(time.Duration(*params.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	token, err := auth.MakeShareToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:   video.ID,
+		UserID:    userID,
+		TokenHash: auth.HashAPIKey(token),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save share link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		ID:        link.ID,
+		Token:     token,
+		URL:       cfg.publicURL("/share/" + token),
+		ExpiresAt: link.ExpiresAt,
+	})
+}
+
+func (cfg *apiConfig) handlerRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	shareID, err := uuid.Parse(r.PathValue("shareID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share link ID", err)
+		return
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := cfg.db.RevokeShareLink(shareID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+	if !found {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeShareLinkNotFound, "Share link not found", errors.New("no active share link for user"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedVideo is all a share link reveals: enough to play the video, and
+// nothing about who owns it
+type sharedVideo struct {
+	Title        string                  `json:"title"`
+	VideoURL     string                  `json:"video_url"`
+	ThumbnailURL *string                 `json:"thumbnail_url"`
+	Captions     []database.VideoCaption `json:"captions"`
+	Duration     float64                 `json:"duration"`
+	Width        int                     `json:"width"`
+	Height       int                     `json:"height"`
+	// URLsExpireAt is when the presigned URLs stop working
+	URLsExpireAt time.Time `json:"urls_expire_at"`
+}
+
+// handlerGetSharedVideo is the public side of a share link. Unknown,
+// revoked and expired links all look the same.
+func (cfg *apiConfig) handlerGetSharedVideo(w http.ResponseWriter, r *http.Request) {
+	link, err := cfg.db.GetShareLinkByHash(auth.HashAPIKey(r.PathValue("token")))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up share link", err)
+		return
+	}
+	now := time.Now()
+	if link.ID == uuid.Nil || link.RevokedAt != nil || (link.ExpiresAt != nil && !now.Before(*link.ExpiresAt)) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeShareLinkNotFound, "Share link not found", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.Status != database.VideoStatusReady || video.VideoURL == nil || *video.VideoURL == "" {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video isn't available", nil)
+		return
+	}
+
+	// URLs handed out through a link don't outlive it. Whole minutes keep
+	// them cacheable across requests, until the last one.
+	expiry := cfg.presignExpiry
+	if link.ExpiresAt != nil {
+		if remaining := link.ExpiresAt.Sub(now); remaining < expiry {
+			expiry = remaining.Truncate(time.Minute)
+			if expiry == 0 {
+				expiry = max(remaining.Truncate(time.Second), time.Second)
+			}
+		}
+	}
+	// Whoever opens the link signs with the owner's tenant, not their own
+	ctx, err := cfg.withOwnerTenant(r.Context(), video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find the video's owner", err)
+		return
+	}
+	signedVideo, err := cfg.dbVideoToSignedVideo(ctx, video, expiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
+		return
+	}
+	// Gone from storage, found out while signing with VERIFY_STORED_OBJECTS
+	if signedVideo.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video file is no longer available", nil)
+		return
+	}
+
+	// The presigned URLs are for this response only
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, sharedVideo{
+		Title:        signedVideo.Title,
+		VideoURL:     *signedVideo.VideoURL,
+		ThumbnailURL: signedVideo.ThumbnailURL,
+		Captions:     signedVideo.Captions,
+		Duration:     signedVideo.Duration,
+		Width:        signedVideo.Width,
+		Height:       signedVideo.Height,
+		URLsExpireAt: now.Add(expiry).UTC(),
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// handlerStreamVideo proxies a video's stored file through this server for
+// clients that can't reach S3 directly. The Range header is passed on to
+// storage, and the body is copied through as it arrives rather than being
+// buffered. Like signed URLs, it's only served once the video is ready.
+func (cfg *apiConfig) handlerStreamVideo(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleViewer)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+	if !videoPlaybackReady(video) || video.VideoURL == nil || *video.VideoURL == "" {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video has no file yet", nil)
+		return
+	}
+
+	// Viewers the video was shared with read from its owner's storage
+	ctx, err := cfg.withOwnerTenant(r.Context(), video.UserID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't find the video's owner", err)
+		return
+	}
+
+	storage, key, err := cfg.storageFor(*video.VideoURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Invalid stored video URL", err)
+		return
+	}
+
+	obj, err := storage.GetRange(ctx, key, r.Header.Get("Range"))
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidRange):
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Invalid range", err)
+		case errors.Is(err, errObjectNotFound):
+			respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video file is no longer available", err)
+		default:
+			respondWithErrorCode(w, http.StatusBadGateway, errCodeStorageError, "Couldn't fetch video from storage", err)
+		}
+		return
+	}
+	defer obj.Body.Close()
+
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.ContentLength, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	status := http.StatusOK
+	if obj.ContentRange != "" {
+		w.Header().Set("Content-Range", obj.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	// Headers are gone by now, a failed copy can only be logged
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		slog.InfoContext(r.Context(), "streaming video interrupted", "video_id", video.ID, "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerStreamVideo(t *testing.T) {
+	stored := bytes.Repeat([]byte("0123456789"), 100)
+
+	tests := []struct {
+		name             string
+		rangeHeader      string
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{
+			name:       "whole video",
+			wantStatus: http.StatusOK,
+			wantBody:   stored,
+		},
+		{
+			name:             "first 100 bytes",
+			rangeHeader:      "bytes=0-99",
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 0-99/1000",
+			wantBody:         stored[:100],
+		},
+		{
+			name:             "open ended range",
+			rangeHeader:      "bytes=900-",
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 900-999/1000",
+			wantBody:         stored[900:],
+		},
+		{
+			name:        "range past the end",
+			rangeHeader: "bytes=2000-",
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			const key = "users/owner/videos/landscape/abc/playback.mp4"
+			bucket.objects[key] = fakeS3Object{body: stored, contentType: "video/mp4"}
+			videoURL := testBucket + "," + key
+			video.VideoURL = &videoURL
+			video.Status = database.VideoStatusReady
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/stream", nil)
+			r.SetPathValue("videoID", video.ID.String())
+			if tc.rangeHeader != "" {
+				r.Header.Set("Range", tc.rangeHeader)
+			}
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerStreamVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if len(bucket.gets) != 1 || aws.ToString(bucket.gets[0].Range) != tc.rangeHeader {
+				t.Fatalf("S3 GetObject calls = %d, want one with Range %q", len(bucket.gets), tc.rangeHeader)
+			}
+			if got := w.Header().Get("Content-Range"); got != tc.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tc.wantContentRange)
+			}
+			if tc.wantBody == nil {
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), tc.wantBody) {
+				t.Errorf("body is %d bytes, want %d", w.Body.Len(), len(tc.wantBody))
+			}
+			for header, want := range map[string]string{
+				"Content-Type":   "video/mp4",
+				"Accept-Ranges":  "bytes",
+				"Content-Length": strconv.Itoa(len(tc.wantBody)),
+			} {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
@@ -1,104 +1,215 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"net/http"
-	"os"
+	"slices"
+	"strings"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// maxThumbnailUploadBytes caps a multipart thumbnail upload, form and all
+const maxThumbnailUploadBytes = 10 << 20 // 10 MB
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+	// Ownership is checked before anything is stored
+	video, userID, err := cfg.authorizeVideoAccess(r, videoRoleEditor)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithAccessError(w, err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+	slog.InfoContext(r.Context(), "uploading thumbnail", "video_id", video.ID, "user_id", userID)
+
+	var (
+		file      io.ReadSeeker
+		mediaType string
+		size      int64
+	)
+	if requestMediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); requestMediaType == "application/json" {
+		// Canvas editors export a data URL rather than a file
+		data, dataType, err := readThumbnailDataURL(w, r)
+		if err != nil {
+			respondWithThumbnailError(w, err)
+			return
+		}
+		file, mediaType, size = bytes.NewReader(data), dataType, int64(len(data))
+	} else {
+		// Parse the form data, all of which fits in memory
+		r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailUploadBytes)
+		err = r.ParseMultipartForm(maxThumbnailUploadBytes)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail upload is larger than %d MB", maxThumbnailUploadBytes>>20), err)
+				return
+			}
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+			return
+		}
+
+		// Get the image data from the form
+		multipartFile, multipartFileHeader, err := r.FormFile("thumbnail")
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Couldn't parse thumbnail", err)
+			return
+		}
+		defer multipartFile.Close()
+		file, mediaType, size = multipartFile, multipartFileHeader.Header.Get("Content-Type"), multipartFileHeader.Size
+	}
+
+	if !cfg.checkThumbnailQuota(w, video, size) {
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	thumbnails, thumbnailURL, storedBytes, err := cfg.storeThumbnail(r.Context(), video.ID, file, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithThumbnailError(w, err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	previous := video
+	video.ThumbnailURL = &thumbnailURL
+	video.Thumbnails = thumbnails
+	video.ThumbnailBytes = storedBytes
 
-	// Parse the form data
-	const maxMemory = 10 * (1 << 20) // 1 << 20 is 1024 * 1024 (1 MB)
-	err = r.ParseMultipartForm(maxMemory)
+	// Only the thumbnail is saved, so processing finishing meanwhile isn't
+	// undone
+	video, err = cfg.db.UpdateVideoThumbnail(video)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
 		return
 	}
+	cfg.deleteReplacedThumbnails(r.Context(), previous, video)
+	cfg.recordAudit(r, auditActionThumbnailUpload, userID, video.ID, mediaType, size)
 
-	// Get the image data from the form
-	multipartFile, multipartFileHeader, err := r.FormFile("thumbnail")
+	// Both the thumbnail and the video are signed separately, each under
+	// its own field
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse thumbnail", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URLs", err)
+		return
 	}
-	defer multipartFile.Close()
 
-	mediaType := multipartFileHeader.Header.Get("Content-Type")
-	if mediaType == "" {
-		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for thumbnail", nil)
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// thumbnailUploadError carries the status and message a handler should
+// respond with when storeThumbnail fails
+type thumbnailUploadError struct {
+	status  int
+	code    string
+	message string
+	err     error
+}
+
+func (e *thumbnailUploadError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *thumbnailUploadError) Unwrap() error {
+	return e.err
+}
+
+func respondWithThumbnailError(w http.ResponseWriter, err error) {
+	var thumbErr *thumbnailUploadError
+	if errors.As(err, &thumbErr) {
+		respondWithErrorCode(w, thumbErr.status, thumbErr.code, thumbErr.message, thumbErr.err)
 		return
 	}
+	respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Error saving file", err)
+}
+
+// storeThumbnail validates an uploaded image of the declared media type
+// and writes its sizes to the assets directory as videoID's thumbnail. It
+// returns the sizes, the URL to use as the video's ThumbnailURL and the
+// bytes stored, failures are a *thumbnailUploadError.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, videoID uuid.UUID, file io.ReadSeeker, mediaType string) ([]database.VideoThumbnail, string, int64, error) {
+	if mediaType == "" {
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeMissingContentType, "Missing Content-Type for thumbnail", nil}
+	}
 
 	mediaTypeCheck, _, err := mime.ParseMediaType(mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to read mime in Content-Type", nil)
-		return
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidMediaType, "Unable to read mime in Content-Type", nil}
 	}
-	if mediaTypeCheck != "image/jpeg" && mediaTypeCheck != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
-		return
+	if !slices.Contains(cfg.allowedThumbnailTypes, mediaTypeCheck) {
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidMediaType, fmt.Sprintf("Invalid file type: only %s allowed", strings.Join(cfg.allowedThumbnailTypes, ", ")), nil}
 	}
 
-	assetPath := getAssetPath(mediaType)
-	thumbnailDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	thumbnailFile, err := os.Create(thumbnailDiskPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
-		return
+	// Don't trust the declared type, sniff the actual bytes
+	sniffBuf := make([]byte, 512)
+	n, err := io.ReadFull(file, sniffBuf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't read thumbnail", err}
 	}
-	defer thumbnailFile.Close()
-	if _, err = io.Copy(thumbnailFile, multipartFile); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
-		return
+	if http.DetectContentType(sniffBuf[:n]) != mediaTypeCheck {
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeContentMismatch, "file contents do not match declared type", nil}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", 0, &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't reset file pointer", err}
 	}
 
-	// Get the video's metadata from the SQLite database. The apiConfig's db has a GetVideo method you can use
-	video, err := cfg.db.GetVideo(videoID)
+	// Store resized copies rather than the full resolution original
+	img, err := decodeThumbnail(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
-		return
+		if errors.Is(err, errThumbnailTooLarge) {
+			return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeImageTooLarge, "Thumbnail is too large", err}
+		}
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't decode thumbnail", err}
 	}
-	// If the authenticated user is not the video owner, return a http.StatusUnauthorized response
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
-		return
+
+	sizesType := mediaTypeCheck
+	if animatedThumbnailTypes[mediaTypeCheck] {
+		sizesType = "image/jpeg"
 	}
+	thumbnails, err := cfg.saveThumbnailSizes(ctx, videoID, img, sizesType)
+	if err != nil {
+		return nil, "", 0, &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Error saving file", err}
+	}
+	thumbnailURL := thumbnails[len(thumbnails)-1].URL
+	storedBytes := thumbnailSizesBytes(thumbnails)
 
-	dataURL := cfg.getAssetURL(assetPath)
-	video.ThumbnailURL = &dataURL
+	if !animatedThumbnailTypes[mediaTypeCheck] {
+		return thumbnails, thumbnailURL, storedBytes, nil
+	}
 
-	err = cfg.db.UpdateVideo(video)
+	// Keep GIFs and WebPs as uploaded so they stay animated, the JPEG sizes
+	// are the static fallback, but without the metadata they came with.
+	// Originals too big to store can't be re-encoded without losing the
+	// animation, so only the static sizes are kept.
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", 0, &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't reset file pointer", err}
+	}
+	original, err := io.ReadAll(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		return nil, "", 0, &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't read thumbnail", err}
+	}
+	original, err = stripAnimatedMetadata(original, mediaTypeCheck)
+	if err != nil {
+		return nil, "", 0, &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't decode thumbnail", err}
+	}
+	tooBig := cfg.thumbnailMaxBytes > 0 && int64(len(original)) > cfg.thumbnailMaxBytes
+	if tooBig {
+		slog.InfoContext(ctx, "animated thumbnail is over the size limit, keeping static sizes only", "size", len(original), "limit", cfg.thumbnailMaxBytes)
+	} else {
+		thumbnailURL, err = cfg.saveOriginalAsset(ctx, videoID, bytes.NewReader(original), mediaTypeCheck)
+		if err != nil {
+			return nil, "", 0, &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Error saving file", err}
+		}
+		storedBytes += int64(len(original))
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
-
+	return thumbnails, thumbnailURL, storedBytes, nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxThumbnailBatchSize  = 50
+	maxThumbnailBatchBytes = 200 << 20 // 200 MB
+)
+
+type thumbnailBatchResult struct {
+	VideoID      string `json:"video_id"`
+	Status       int    `json:"status"`
+	Code         string `json:"code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// handlerBatchUploadThumbnails sets the thumbnails of many videos at once.
+// The form pairs the n-th "videoID" field with the n-th "thumbnail" file.
+// Every pair is handled on its own, so the response is always 207 with a
+// result per pair, in order.
+func (cfg *apiConfig) handlerBatchUploadThumbnails(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailBatchBytes)
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	const maxMemory = 10 << 20 // the rest spills to temporary files
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Batch is larger than %d MB", maxThumbnailBatchBytes>>20), err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+		return
+	}
+
+	videoIDs := r.MultipartForm.Value["videoID"]
+	files := r.MultipartForm.File["thumbnail"]
+	if len(files) == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "No thumbnails in form", nil)
+		return
+	}
+	if len(videoIDs) != len(files) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Each thumbnail needs exactly one videoID", nil)
+		return
+	}
+	if len(files) > maxThumbnailBatchSize {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, fmt.Sprintf("At most %d thumbnails per batch", maxThumbnailBatchSize), nil)
+		return
+	}
+
+	results := make([]thumbnailBatchResult, 0, len(files))
+	for i, header := range files {
+		result := thumbnailBatchResult{VideoID: videoIDs[i], Status: http.StatusOK}
+		thumbnailURL, err := cfg.setBatchThumbnail(r, userID, videoIDs[i], header)
+		if err != nil {
+			var thumbErr *thumbnailUploadError
+			if !errors.As(err, &thumbErr) {
+				thumbErr = &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Error saving file", err}
+			}
+			slog.InfoContext(r.Context(), "batch thumbnail failed", "video_id", videoIDs[i], "error", thumbErr)
+			result.Status = thumbErr.status
+			result.Code = thumbErr.code
+			result.Error = thumbErr.message
+		}
+		result.ThumbnailURL = thumbnailURL
+		results = append(results, result)
+	}
+
+	type response struct {
+		Results []thumbnailBatchResult `json:"results"`
+	}
+	respondWithJSON(w, http.StatusMultiStatus, response{Results: results})
+}
+
+// setBatchThumbnail is one pair of a batch: the same checks and storage as
+// handlerUploadThumbnail, with ownership checked before anything is stored
+func (cfg *apiConfig) setBatchThumbnail(r *http.Request, userID uuid.UUID, videoIDString string, header *multipart.FileHeader) (string, error) {
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		return "", &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err}
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return "", &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't find video", err}
+	}
+	if video.ID == uuid.Nil {
+		return "", &thumbnailUploadError{http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil}
+	}
+	var accessErr *accessError
+	if err := cfg.checkVideoAccess(video, userID, videoRoleEditor); errors.As(err, &accessErr) {
+		return "", &thumbnailUploadError{accessErr.status, accessErr.code, accessErr.message, accessErr.err}
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return "", &thumbnailUploadError{http.StatusBadRequest, errCodeMissingFile, "Couldn't read thumbnail", err}
+	}
+	defer file.Close()
+
+	if err := cfg.checkQuota(video.UserID, video.ThumbnailBytes, header.Size); err != nil {
+		var quotaErr *quotaExceededError
+		if errors.As(err, &quotaErr) {
+			return "", &thumbnailUploadError{http.StatusForbidden, errCodeQuotaExceeded, quotaExceededMessage, err}
+		}
+		return "", &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't check storage usage", err}
+	}
+
+	thumbnails, thumbnailURL, storedBytes, err := cfg.storeThumbnail(r.Context(), video.ID, file, header.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+
+	previous := video
+	video.ThumbnailURL = &thumbnailURL
+	video.Thumbnails = thumbnails
+	video.ThumbnailBytes = storedBytes
+	// Only the thumbnail is saved, so processing finishing meanwhile isn't
+	// undone
+	video, err = cfg.db.UpdateVideoThumbnail(video)
+	if err != nil {
+		return "", &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err}
+	}
+	cfg.deleteReplacedThumbnails(r.Context(), previous, video)
+	cfg.recordAudit(r, auditActionThumbnailUpload, userID, video.ID, header.Header.Get("Content-Type"), header.Size)
+
+	signedURL, err := cfg.signAssetURL(r.Context(), thumbnailURL, cfg.presignExpiry)
+	if err != nil {
+		return "", &thumbnailUploadError{http.StatusInternalServerError, errCodeInternal, "Failed to sign thumbnail URL", err}
+	}
+	return signedURL, nil
+}
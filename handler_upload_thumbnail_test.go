@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testPNG is a small solid PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 36))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 36; y++ {
+			img.Set(x, y, color.RGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("couldn't encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// newThumbnailUploadRequest is a multipart upload of body as the
+// "thumbnail" part, declared as contentType
+func newThumbnailUploadRequest(t *testing.T, videoID uuid.UUID, contentType string, body []byte) *http.Request {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="thumbnail"; filename="thumbnail"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("couldn't create form part: %v", err)
+	}
+	part.Write(body)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID.String(), &form)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestHandlerUploadThumbnailForm(t *testing.T) {
+	tests := []struct {
+		name       string
+		part       string // form field the file is sent as, none if empty
+		text       bool   // also send a plain text field
+		rawBody    string // sent as is instead of a multipart form
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "thumbnail is stored",
+			part:       "thumbnail",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "form without a thumbnail part",
+			text:       true,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeMissingFile,
+		},
+		{
+			name:       "file under another field name",
+			part:       "image",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeMissingFile,
+		},
+		{
+			name:       "body that isn't a multipart form",
+			rawBody:    "not a form",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidForm,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			var body bytes.Buffer
+			contentType := "multipart/form-data; boundary=missing"
+			if tc.rawBody != "" {
+				body.WriteString(tc.rawBody)
+			} else {
+				writer := multipart.NewWriter(&body)
+				if tc.text {
+					writer.WriteField("title", "no file here")
+				}
+				if tc.part != "" {
+					header := textproto.MIMEHeader{}
+					header.Set("Content-Disposition", `form-data; name="`+tc.part+`"; filename="thumb.png"`)
+					header.Set("Content-Type", "image/png")
+					part, err := writer.CreatePart(header)
+					if err != nil {
+						t.Fatalf("couldn't create form part: %v", err)
+					}
+					part.Write(testPNG(t))
+				}
+				writer.Close()
+				contentType = writer.FormDataContentType()
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), &body)
+			r.Header.Set("Content-Type", contentType)
+			r.SetPathValue("videoID", video.ID.String())
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var resp struct {
+				Code         string  `json:"code"`
+				ThumbnailURL *string `json:"thumbnail_url"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if resp.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tc.wantCode)
+			}
+			if tc.wantStatus == http.StatusOK && (resp.ThumbnailURL == nil || !strings.Contains(*resp.ThumbnailURL, video.ID.String())) {
+				t.Errorf("thumbnail_url = %v, want a URL for the video's thumbnail", resp.ThumbnailURL)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailContentMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		mediaType  string
+		encode     func(io.Writer, image.Image) error
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "PNG declared as PNG",
+			mediaType:  "image/png",
+			encode:     png.Encode,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "JPEG declared as PNG",
+			mediaType: "image/png",
+			encode: func(w io.Writer, img image.Image) error {
+				return jpeg.Encode(w, img, nil)
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeContentMismatch,
+		},
+		{
+			name:       "PNG declared as JPEG",
+			mediaType:  "image/jpeg",
+			encode:     png.Encode,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeContentMismatch,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			var img bytes.Buffer
+			if err := tc.encode(&img, image.NewRGBA(image.Rect(0, 0, 64, 36))); err != nil {
+				t.Fatalf("couldn't encode image: %v", err)
+			}
+			r := newThumbnailUploadRequest(t, video.ID, tc.mediaType, img.Bytes())
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+// testWebP is a 1x1 lossless WebP
+const testWebP = "RIFF\x1a\x00\x00\x00WEBPVP8L\r\x00\x00\x00/\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00"
+
+// testAnimatedGIF is a two frame GIF
+func testAnimatedGIF(t *testing.T) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := range 2 {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 36), palette)
+		for x := 0; x < 64; x++ {
+			frame.SetColorIndex(x, i, 1)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("couldn't encode GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandlerUploadThumbnailAnimated(t *testing.T) {
+	tests := []struct {
+		name       string
+		mediaType  string
+		body       func(t *testing.T) []byte
+		wantStatus int
+		wantCode   string
+		wantExt    string // of the thumbnail_url, the static sizes are JPEGs
+	}{
+		{
+			name:       "animated GIF is kept with JPEG sizes",
+			mediaType:  "image/gif",
+			body:       testAnimatedGIF,
+			wantStatus: http.StatusOK,
+			wantExt:    ".gif",
+		},
+		{
+			name:       "WebP is kept with JPEG sizes",
+			mediaType:  "image/webp",
+			body:       func(*testing.T) []byte { return []byte(testWebP) },
+			wantStatus: http.StatusOK,
+			wantExt:    ".webp",
+		},
+		{
+			name:       "GIF that doesn't decode",
+			mediaType:  "image/gif",
+			body:       func(*testing.T) []byte { return []byte("GIF89a\x40\x00\x24\x00\x00\x00\x00 and no frames") },
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidImage,
+		},
+		{
+			name:       "WebP that doesn't decode",
+			mediaType:  "image/webp",
+			body:       func(*testing.T) []byte { return []byte("RIFF\x1a\x00\x00\x00WEBPVP8 not really a WebP") },
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidImage,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newThumbnailUploadRequest(t, video.ID, tc.mediaType, tc.body(t))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var resp struct {
+				Code         string  `json:"code"`
+				ThumbnailURL *string `json:"thumbnail_url"`
+				Thumbnails   []struct {
+					URL string `json:"url"`
+				} `json:"thumbnails"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if resp.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tc.wantCode)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			if resp.ThumbnailURL == nil || path.Ext(*resp.ThumbnailURL) != tc.wantExt {
+				t.Errorf("thumbnail_url = %v, want a %s", resp.ThumbnailURL, tc.wantExt)
+			}
+			if len(resp.Thumbnails) == 0 {
+				t.Fatal("no static thumbnail sizes were stored")
+			}
+			for _, thumb := range resp.Thumbnails {
+				if path.Ext(thumb.URL) != ".jpeg" {
+					t.Errorf("static size %q isn't a JPEG", thumb.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailAllowedTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string // the default set if nil
+		mediaType   string
+		body        func(t *testing.T) []byte
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:       "PNG allowed by default",
+			mediaType:  "image/png",
+			body:       testPNG,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "PNG when only JPEG is allowed",
+			allowed:     []string{"image/jpeg"},
+			mediaType:   "image/png",
+			body:        testPNG,
+			wantStatus:  http.StatusBadRequest,
+			wantMessage: "Invalid file type: only image/jpeg allowed",
+		},
+		{
+			name:        "WebP when JPEG and PNG are allowed",
+			allowed:     []string{"image/jpeg", "image/png"},
+			mediaType:   "image/webp",
+			body:        func(*testing.T) []byte { return []byte(testWebP) },
+			wantStatus:  http.StatusBadRequest,
+			wantMessage: "Invalid file type: only image/jpeg, image/png allowed",
+		},
+		{
+			name:       "WebP when it's added",
+			allowed:    []string{"image/jpeg", "image/png", "image/webp"},
+			mediaType:  "image/webp",
+			body:       func(*testing.T) []byte { return []byte(testWebP) },
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			if tc.allowed != nil {
+				cfg.allowedThumbnailTypes = tc.allowed
+			}
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newThumbnailUploadRequest(t, video.ID, tc.mediaType, tc.body(t))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantMessage == "" {
+				return
+			}
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != errCodeInvalidMediaType {
+				t.Errorf("code = %q, want %q", body.Code, errCodeInvalidMediaType)
+			}
+			if body.Error != tc.wantMessage {
+				t.Errorf("error = %q, want %q", body.Error, tc.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// newVideoUploadRequest is a multipart upload of body as the "video" part,
+// declared as contentType
+func newVideoUploadRequest(t *testing.T, videoID uuid.UUID, contentType string, body []byte) *http.Request {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("couldn't create form part: %v", err)
+	}
+	part.Write(body)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &form)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestHandlerUploadVideo(t *testing.T) {
+	tests := []struct {
+		name       string
+		byOwner    bool
+		wantStatus int
+		wantCode   string
+		wantStaged bool
+	}{
+		{
+			name:       "owner's upload is staged and queued",
+			byOwner:    true,
+			wantStatus: http.StatusAccepted,
+			wantStaged: true,
+		},
+		{
+			name:       "someone else's video is refused",
+			byOwner:    false,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeNotOwner,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			uploader := owner
+			if !tc.byOwner {
+				uploader = createTestUser(t, cfg, "other@example.com")
+			}
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("not really an mp4, the fake ffprobe doesn't mind"))
+			authorizeTestRequest(t, r, uploader)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantCode != "" {
+				var body struct {
+					Code string `json:"code"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("couldn't decode error response: %v", err)
+				}
+				if body.Code != tc.wantCode {
+					t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+				}
+			}
+
+			staged := bucket.keys("uploads/")
+			if tc.wantStaged != (len(staged) == 1) {
+				t.Errorf("staged uploads = %v, want staged: %v", staged, tc.wantStaged)
+			}
+			if tc.wantStaged != (len(cfg.videoJobs) == 1) {
+				t.Errorf("queued jobs = %d, want queued: %v", len(cfg.videoJobs), tc.wantStaged)
+			}
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			wantVideoStatus := ""
+			if tc.wantStaged {
+				wantVideoStatus = database.VideoStatusProcessing
+			}
+			if stored.Status != wantVideoStatus {
+				t.Errorf("video status = %q, want %q", stored.Status, wantVideoStatus)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoSizeLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		overLimit  int64 // how far the request body is over the limit
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "body just under the limit is accepted",
+			overLimit:  -1,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "body exactly at the limit is accepted",
+			overLimit:  0,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "body just over the limit is too large",
+			overLimit:  1,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   errCodeFileTooLarge,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", bytes.Repeat([]byte{0}, 64<<10))
+			cfg.maxVideoUploadBytes = r.ContentLength - tc.overLimit
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantCode != "" {
+				var body struct {
+					Code string `json:"code"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("couldn't decode error response: %v", err)
+				}
+				if body.Code != tc.wantCode {
+					t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoContainers(t *testing.T) {
+	tests := []struct {
+		name          string
+		mediaType     string
+		probe         string
+		wantTranscode bool
+	}{
+		{
+			name:      "MP4 is copied",
+			mediaType: "video/mp4",
+			probe:     testProbeOutput,
+		},
+		{
+			name:          "MOV is transcoded to MP4",
+			mediaType:     "video/quicktime",
+			probe:         testProbeOutput,
+			wantTranscode: true,
+		},
+		{
+			name:          "WebM is transcoded to MP4",
+			mediaType:     "video/webm",
+			probe:         `{"streams":[{"codec_type":"video","codec_name":"vp9","width":1280,"height":720},{"codec_type":"audio","codec_name":"opus"}],"format":{"format_name":"matroska,webm","duration":"3.000000","size":"4096","bit_rate":"1100000"}}`,
+			wantTranscode: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			setFakeProbe(t, cfg, tc.probe)
+			ffmpegRuns := recordFFmpegRuns(t, cfg)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, tc.mediaType, []byte("a "+tc.mediaType+" upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Status != database.VideoStatusReady || stored.VideoURL == nil {
+				t.Fatalf("video status = %q with URL %v, want it ready", stored.Status, stored.VideoURL)
+			}
+			_, key, err := splitStoredURL(*stored.VideoURL)
+			if err != nil {
+				t.Fatalf("splitStoredURL: %v", err)
+			}
+			if !strings.HasSuffix(key, ".mp4") || !strings.Contains(key, "/landscape/") {
+				t.Errorf("playback key = %q, want a landscape .mp4", key)
+			}
+
+			var faststartRun string
+			for _, run := range ffmpegRuns() {
+				if strings.Contains(run, "-movflags faststart") && strings.Contains(run, "-progress pipe:1") {
+					faststartRun = run
+				}
+			}
+			if faststartRun == "" {
+				t.Fatal("ffmpeg faststart pass didn't run")
+			}
+			if got := strings.Contains(faststartRun, "libx264"); got != tc.wantTranscode {
+				t.Errorf("faststart pass %q, want transcoded: %v", faststartRun, tc.wantTranscode)
+			}
+		})
+	}
+}
+
+// testJPEGProbeOutput is what ffprobe reports for a JPEG image
+const testJPEGProbeOutput = `{"streams":[{"codec_type":"video","codec_name":"mjpeg","width":64,"height":36}],"format":{"format_name":"jpeg_pipe","duration":"0.040000","size":"2048"}}`
+
+func TestHandlerUploadVideoContentMismatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		mediaType    string
+		probe        string
+		validateOnly bool
+		wantStatus   int
+		wantCode     string
+	}{
+		{
+			name:       "MP4 contents declared as MP4",
+			mediaType:  "video/mp4",
+			probe:      testProbeOutput,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "JPEG declared as MP4",
+			mediaType:  "video/mp4",
+			probe:      testJPEGProbeOutput,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeContentMismatch,
+		},
+		{
+			name:         "JPEG declared as MP4, validate only",
+			mediaType:    "video/mp4",
+			probe:        testJPEGProbeOutput,
+			validateOnly: true,
+			wantStatus:   http.StatusBadRequest,
+			wantCode:     errCodeContentMismatch,
+		},
+		{
+			name:       "MP4 declared as WebM",
+			mediaType:  "video/webm",
+			probe:      testProbeOutput,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeContentMismatch,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			setFakeProbe(t, cfg, tc.probe)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, tc.mediaType, []byte("\xff\xd8\xff\xe0 not much of an image"))
+			if tc.validateOnly {
+				r.URL.RawQuery = "validateOnly=true"
+			}
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if tc.wantCode != "" {
+				if staged := bucket.keys("uploads/"); len(staged) != 0 {
+					t.Errorf("rejected upload was staged as %v", staged)
+				}
+			}
+		})
+	}
+}
+
+// TestHandlerUploadVideoValidateOnlyRateLimit checks validating a file
+// doesn't use up the uploads the rate limit allows
+func TestHandlerUploadVideoValidateOnlyRateLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		validateOnly []bool // one request each, against a limit of one upload
+		wantStatuses []int
+	}{
+		{
+			name:         "validations then an upload",
+			validateOnly: []bool{true, true, false},
+			wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusAccepted},
+		},
+		{
+			name:         "validation once the limit is used up",
+			validateOnly: []bool{false, true},
+			wantStatuses: []int{http.StatusAccepted, http.StatusOK},
+		},
+		{
+			name:         "upload once the limit is used up",
+			validateOnly: []bool{false, false},
+			wantStatuses: []int{http.StatusAccepted, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.uploadLimiter = newRateLimiter(1, time.Hour)
+			owner := createTestUser(t, cfg, "owner@example.com")
+
+			for i, validateOnly := range tc.validateOnly {
+				// A video each, so none is already processing
+				video := createTestVideo(t, cfg, owner)
+				r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+				if validateOnly {
+					r.URL.RawQuery = "validateOnly=true"
+				}
+				authorizeTestRequest(t, r, owner)
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, r)
+				if w.Code != tc.wantStatuses[i] {
+					t.Errorf("request %d status = %d, want %d: %s", i, w.Code, tc.wantStatuses[i], w.Body)
+				}
+			}
+		})
+	}
+}
+
+// TestHandlerUploadVideoCleanup checks an upload rejected once it has been
+// saved locally leaves nothing in the temp directory
+func TestHandlerUploadVideoCleanup(t *testing.T) {
+	tests := []struct {
+		name       string
+		probe      string
+		wantStatus int
+	}{
+		{
+			name:       "ffprobe can't read the upload",
+			probe:      "exit 1",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "upload has no duration",
+			probe:      `echo '{"streams":[{"codec_type":"video","codec_name":"h264","width":1280,"height":720}],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2"}}'`,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.ffprobePath = writeFakeCommand(t, "ffprobe", tc.probe)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+
+			left, err := os.ReadDir(cfg.tempDir)
+			if err != nil {
+				t.Fatalf("couldn't read temp dir: %v", err)
+			}
+			for _, entry := range left {
+				t.Errorf("%s was left in the temp dir", entry.Name())
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoCorrupt(t *testing.T) {
+	// An ftyp box claiming more bytes than there are, and nothing after it
+	truncated := []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00iso")
+
+	tests := []struct {
+		name       string
+		probe      string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "ffprobe can't find the moov box",
+			probe:      "echo 'moov atom not found' >&2\nexit 1",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeInvalidVideo,
+		},
+		{
+			name:       "no streams",
+			probe:      `echo '{"streams":[],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"0.000000"}}'`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeNoVideoStream,
+		},
+		{
+			name:       "zero duration",
+			probe:      `echo '{"streams":[{"codec_type":"video","codec_name":"h264","width":1280,"height":720}],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"0.000000"}}'`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeInvalidVideo,
+		},
+		{
+			name:       "video stream without a resolution",
+			probe:      `echo '{"streams":[{"codec_type":"video","codec_name":"h264"}],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"3.000000"}}'`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeInvalidVideo,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			cfg.ffprobePath = writeFakeCommand(t, "ffprobe", tc.probe)
+			ffmpegRuns := recordFFmpegRuns(t, cfg)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", truncated)
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if staged := bucket.keys(""); len(staged) != 0 {
+				t.Errorf("corrupt upload was stored as %v", staged)
+			}
+			if runs := ffmpegRuns(); len(runs) != 0 {
+				t.Errorf("ffmpeg ran on a corrupt upload: %v", runs)
+			}
+		})
+	}
+}
+
+// TestProbeVideoRotation probes a 4:3 phone video, which once rotated is
+// portrait rather than vertical
+func TestProbeVideoRotation(t *testing.T) {
+	tests := []struct {
+		name            string
+		rotation        string // JSON fields of the video stream carrying its rotation
+		wantWidth       int
+		wantHeight      int
+		wantOrientation string
+	}{
+		{
+			name:            "no rotation",
+			wantWidth:       1440,
+			wantHeight:      1080,
+			wantOrientation: "landscape",
+		},
+		{
+			name:            "rotate tag of 90",
+			rotation:        `,"tags":{"rotate":"90"}`,
+			wantWidth:       1080,
+			wantHeight:      1440,
+			wantOrientation: "portrait",
+		},
+		{
+			name:            "display matrix rotation of -90",
+			rotation:        `,"side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]`,
+			wantWidth:       1080,
+			wantHeight:      1440,
+			wantOrientation: "portrait",
+		},
+		{
+			name:            "rotate tag of 270",
+			rotation:        `,"tags":{"rotate":"270"}`,
+			wantWidth:       1080,
+			wantHeight:      1440,
+			wantOrientation: "portrait",
+		},
+		{
+			name:            "upside down stays landscape",
+			rotation:        `,"side_data_list":[{"side_data_type":"Display Matrix","rotation":180}]`,
+			wantWidth:       1440,
+			wantHeight:      1080,
+			wantOrientation: "landscape",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			setFakeProbe(t, cfg, `{"streams":[{"codec_type":"video","codec_name":"h264","width":1440,"height":1080`+tc.rotation+`}],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"3.000000"}}`)
+
+			meta, err := cfg.probeVideo(filepath.Join(t.TempDir(), "phone.mp4"))
+			if err != nil {
+				t.Fatalf("probeVideo: %v", err)
+			}
+			if meta.Width != tc.wantWidth || meta.Height != tc.wantHeight {
+				t.Errorf("probeVideo = %dx%d, want %dx%d", meta.Width, meta.Height, tc.wantWidth, tc.wantHeight)
+			}
+			if got := classifyOrientation(meta.Width, meta.Height); got != tc.wantOrientation {
+				t.Errorf("orientation = %q, want %q", got, tc.wantOrientation)
+			}
+		})
+	}
+}
+
+func TestClassifyOrientation(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{name: "1:1", width: 1080, height: 1080, want: "square"},
+		{name: "a pixel off 1:1", width: 1080, height: 1079, want: "square"},
+		{name: "at the square tolerance", width: 1000, height: 1020, want: "square"},
+		{name: "past the square tolerance", width: 1000, height: 1030, want: "portrait"},
+		{name: "16:9", width: 1920, height: 1080, want: "landscape"},
+		{name: "just under 2:1", width: 1999, height: 1000, want: "landscape"},
+		{name: "2:1", width: 2000, height: 1000, want: "ultrawide"},
+		{name: "21:9", width: 2560, height: 1080, want: "ultrawide"},
+		{name: "3:4", width: 1080, height: 1440, want: "portrait"},
+		{name: "just wider than 9:16", width: 1081, height: 1920, want: "portrait"},
+		{name: "9:16", width: 1080, height: 1920, want: "vertical"},
+		{name: "narrower than 9:16", width: 720, height: 1920, want: "vertical"},
+		{name: "no dimensions", width: 0, height: 0, want: "other"},
+		{name: "no height", width: 1920, height: 0, want: "other"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyOrientation(tc.width, tc.height); got != tc.want {
+				t.Errorf("classifyOrientation(%d, %d) = %q, want %q", tc.width, tc.height, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDBVideoToSignedVideoStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		wantURL   bool
+		wantSigns int
+	}{
+		{name: "processing", status: database.VideoStatusProcessing, wantURL: false, wantSigns: 0},
+		{name: "failed", status: database.VideoStatusFailed, wantURL: false, wantSigns: 0},
+		{name: "ready", status: database.VideoStatusReady, wantURL: true, wantSigns: 1},
+		{name: "from before statuses", status: "", wantURL: true, wantSigns: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			presigner := &countingPresigner{}
+			storage := newS3Storage(bucket, presigner, testBucket, nil, "", 1)
+			regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+			if err != nil {
+				t.Fatalf("newStorageRegions: %v", err)
+			}
+			cfg.storageRegions = regions
+			cfg.presignCache = nil
+
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			videoURL := testBucket + ",users/owner/videos/landscape/abc/playback.mp4"
+			playlistURL := testBucket + ",users/owner/videos/landscape/abc/hls/master.m3u8"
+			video.VideoURL = &videoURL
+			video.HLSPlaylistURL = &playlistURL
+			video.Status = tc.status
+
+			signed, err := cfg.dbVideoToSignedVideo(withRequestTenant(context.Background(), ""), video, time.Hour)
+			if err != nil {
+				t.Fatalf("dbVideoToSignedVideo: %v", err)
+			}
+			if signed.Status != tc.status {
+				t.Errorf("status = %q, want %q", signed.Status, tc.status)
+			}
+			if gotURL := signed.VideoURL != nil; gotURL != tc.wantURL {
+				t.Errorf("video_url = %v, want one: %v", signed.VideoURL, tc.wantURL)
+			}
+			if gotURL := signed.HLSPlaylistURL != nil; gotURL != tc.wantURL {
+				t.Errorf("hls_playlist_url = %v, want one: %v", signed.HLSPlaylistURL, tc.wantURL)
+			}
+			if tc.wantURL && !strings.HasPrefix(*signed.VideoURL, "https://"+testBucket+".s3.test/") {
+				t.Errorf("video_url = %q, want a presigned URL", *signed.VideoURL)
+			}
+			if presigner.gets != tc.wantSigns {
+				t.Errorf("%d URLs presigned, want %d", presigner.gets, tc.wantSigns)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoStreams(t *testing.T) {
+	const (
+		audio = `{"codec_type":"audio","codec_name":"aac"}`
+		video = `{"codec_type":"video","codec_name":"h264","width":1280,"height":720}`
+		data  = `{"codec_type":"data","codec_name":"bin_data"}`
+	)
+	probeOutput := func(streams ...string) string {
+		return `{"streams":[` + strings.Join(streams, ",") + `],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"3.000000","size":"4096"}}`
+	}
+
+	tests := []struct {
+		name       string
+		probe      string
+		wantStatus int
+		wantCode   string
+		wantWidth  int
+		wantHeight int
+	}{
+		{
+			name:       "audio-only MP4",
+			probe:      probeOutput(audio),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeNoVideoStream,
+		},
+		{
+			name:       "audio and data streams only",
+			probe:      probeOutput(audio, data),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeNoVideoStream,
+		},
+		{
+			name:       "audio first, video later",
+			probe:      probeOutput(audio, video),
+			wantStatus: http.StatusAccepted,
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+		{
+			name:       "video after audio and data",
+			probe:      probeOutput(data, audio, video),
+			wantStatus: http.StatusAccepted,
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			setFakeProbe(t, cfg, tc.probe)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+			if tc.wantCode != "" {
+				if body.Error != noVideoStreamMessage {
+					t.Errorf("error = %q, want %q", body.Error, noVideoStreamMessage)
+				}
+				return
+			}
+
+			runQueuedVideoJobs(t, cfg)
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Width != tc.wantWidth || stored.Height != tc.wantHeight {
+				t.Errorf("resolution = %dx%d, want %dx%d", stored.Width, stored.Height, tc.wantWidth, tc.wantHeight)
+			}
+			if stored.VideoCodec != "h264" {
+				t.Errorf("video_codec = %q, want the video stream's %q", stored.VideoCodec, "h264")
+			}
+		})
+	}
+}
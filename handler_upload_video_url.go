@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// handlerUploadVideoFromURL ingests a video that's already hosted somewhere
+// else. The file is downloaded, within the same size limit as a multipart
+// upload, and then goes through the same pipeline and response.
+func (cfg *apiConfig) handlerUploadVideoFromURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoID      string `json:"videoID"`
+		SourceURL    string `json:"sourceURL"`
+		StorageClass string `json:"storage_class"`
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.allowUpload(w, userID) {
+		return
+	}
+	storage, ok := cfg.storageForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+
+	videoID, err := uuid.Parse(params.VideoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	sourceURL, err := url.Parse(params.SourceURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidSourceURL, "Invalid sourceURL", err)
+		return
+	}
+	if err := validateRemoteURL(sourceURL); err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidSourceURL, fmt.Sprintf("Invalid sourceURL: %v", err), err)
+		return
+	}
+
+	storageClass := params.StorageClass
+	if storageClass == "" {
+		storageClass = defaultStorageClass
+	}
+	if !allowedStorageClasses[storageClass] {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidStorageClass, "Invalid storage_class: must be one of STANDARD, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING or GLACIER_IR", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// ---- Fetch the source ----
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, sourceURL.String(), nil)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidSourceURL, "Invalid sourceURL", err)
+		return
+	}
+	resp, err := remoteVideoClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errDisallowedRemoteAddress) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidSourceURL, "Invalid sourceURL: it must be publicly reachable", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeSourceUnavailable, "Couldn't download sourceURL", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeSourceUnavailable, fmt.Sprintf("Downloading sourceURL returned %s", resp.Status), nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !allowedVideoTypes[mediaType] {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidMediaType, "Invalid file type: sourceURL must serve video/mp4, video/quicktime or video/webm", err)
+		return
+	}
+	if resp.ContentLength > cfg.maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+
+	videoUploadsStarted.WithLabelValues(mediaType).Inc()
+	succeeded := false
+	defer func() {
+		if succeeded {
+			videoUploadsSucceeded.WithLabelValues(mediaType).Inc()
+		} else {
+			videoUploadsFailed.WithLabelValues(mediaType).Inc()
+		}
+	}()
+
+	// ---- Save a local copy, hashing it on the way ----
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-*.mp4")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to create temporary file", err)
+		return
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	// Content-Length can be missing or wrong, so the limit is enforced on
+	// the bytes actually read
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), io.LimitReader(resp.Body, cfg.maxVideoUploadBytes+1))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeSourceUnavailable, "Couldn't download sourceURL", err)
+		return
+	}
+	if size > cfg.maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %d bytes", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	rawSum := hasher.Sum(nil)
+	contentHash := hex.EncodeToString(rawSum)
+
+	if !cfg.checkStorageQuota(w, video, size) {
+		return
+	}
+
+	// ---- Stage the download and queue it for processing ----
+	reused, err := cfg.stageVideoUpload(r.Context(), &video, tempFile, videoJob{
+		storage:      storage,
+		mediaType:    mediaType,
+		size:         size,
+		storageClass: storageClass,
+		contentHash:  contentHash,
+		rawChecksum:  base64.StdEncoding.EncodeToString(rawSum),
+	})
+	if err != nil {
+		respondWithVideoUploadError(w, err)
+		return
+	}
+	cfg.recordAudit(r, auditActionVideoUpload, userID, video.ID, mediaType, size)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return
+	}
+
+	succeeded = true
+	status := http.StatusAccepted
+	if reused {
+		status = http.StatusOK
+	}
+	respondWithJSON(w, status, signedVideo)
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -14,22 +19,14 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
 		return
 	}
 	params.UserID = userID
@@ -43,37 +40,105 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
-func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+const maxVideoTitleLength = 200
+
+// handlerUpdateVideoMetadata changes a video's title and/or description.
+// Fields left out of the body are kept as they are. If-Match must carry
+// an ETag of the video as it is now, stale ones get 412.
+func (cfg *apiConfig) handlerUpdateVideoMetadata(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	// The row from the DB still holds VideoURL as "bucket,key", so saving it
+	// back leaves the stored object reference untouched
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleEditor)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// Without it, of two clients editing at once the last write would
+	// silently win
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		respondWithErrorCode(w, http.StatusPreconditionRequired, errCodeMissingIfMatch, "If-Match must be set to the video's ETag", nil)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	if params.Title != nil {
+		title := strings.TrimSpace(*params.Title)
+		if title == "" {
+			respondWithError(w, http.StatusBadRequest, "Title can't be empty", nil)
+			return
+		}
+		if utf8.RuneCountInString(title) > maxVideoTitleLength {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Title can't be longer than %d characters", maxVideoTitleLength), nil)
+			return
+		}
+		params.Title = &title
+	}
+
+	if !ifMatchesVersion(ifMatch, video.Version) {
+		respondWithErrorCode(w, http.StatusPreconditionFailed, errCodeVersionMismatch, "Video has changed since it was read, fetch it again", nil)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+
+	// The video may have changed since the If-Match check
+	updated, err := cfg.db.UpdateVideoIfVersion(video)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if !updated {
+		respondWithErrorCode(w, http.StatusPreconditionFailed, errCodeVersionMismatch, "Video has changed since it was read, fetch it again", nil)
+		return
+	}
+	video, err = cfg.db.GetVideo(video.ID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	// The same ETag a plain GET of the video now returns
+	etag, err := videoETag(video, videoGetVariant(cfg.presignExpiry, "", ""))
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't compute ETag", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	w.Header().Set("ETag", etag)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+func (cfg *apiConfig) handlerDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
 	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	// Files stay until the reaper purges the video, so it can be restored
+	if err := cfg.db.SoftDeleteVideo(video.ID); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
@@ -81,49 +146,252 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+// handlerRestoreVideo undoes a delete, as long as the reaper hasn't purged
+// the video yet
+func (cfg *apiConfig) handlerRestoreVideo(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// authorizeVideoAccess doesn't find deleted videos
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideoIncludingDeleted(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", nil)
+		return
+	}
+	if err := cfg.checkVideoAccess(video, userID, videoRoleOwner); err != nil {
+		respondWithAccessError(w, err)
 		return
 	}
 
-	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if video.DeletedAt != nil {
+		if err := cfg.db.RestoreVideo(videoID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+			return
+		}
+		video.DeletedAt = nil
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
 		return
 	}
-
 	respondWithJSON(w, http.StatusOK, signedVideo)
 }
 
-func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+// requestPresignExpiry is how long URLs signed for r stay valid, its
+// ?expires in seconds if set, the configured default otherwise
+func (cfg *apiConfig) requestPresignExpiry(r *http.Request) (time.Duration, error) {
+	expiresString := r.URL.Query().Get("expires")
+	if expiresString == "" {
+		return cfg.presignExpiry, nil
+	}
+	expiresSeconds, err := strconv.Atoi(expiresString)
+	if err != nil || expiresSeconds <= 0 {
+		return 0, errors.New("expires must be a positive number of seconds")
+	}
+	expiry := time.Duration(expiresSeconds) * time.Second
+	if expiry > maxPresignExpiry {
+		return 0, fmt.Errorf("expires can't exceed %d seconds", int(maxPresignExpiry.Seconds()))
+	}
+	return expiry, nil
+}
+
+// handlerVideoGet returns one of the caller's videos with freshly signed
+// URLs, so a stale URL can be refreshed without re-uploading. Videos owned
+// by someone else get the same 404 as unknown IDs, which doesn't reveal
+// that they exist. Responses carry an ETag for cheap polling with
+// If-None-Match.
+func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleViewer)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	expiry, err := cfg.requestPresignExpiry(r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+
+	// ?version=original hands out the upload as it was received instead
+	// of the playback file
+	version := r.URL.Query().Get("version")
+	if version != "" && version != "playback" && version != "original" {
+		respondWithError(w, http.StatusBadRequest, "version must be playback or original", nil)
+		return
+	}
+	if version == "original" && video.OriginalURL == nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNoOriginal, "Video has no kept original", nil)
+		return
+	}
+
+	etag, err := videoETag(video, videoGetVariant(expiry, r.URL.Query().Get("download"), version))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't compute ETag", err)
+		return
+	}
+	if writeNotModifiedIfMatch(w, r, etag) {
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, expiry)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	// ?download=true hands out a URL that saves the file under the video's
+	// title instead of playing it in the browser
+	stored, contentType := video.VideoURL, "video/mp4"
+	if version == "original" {
+		stored, contentType = video.OriginalURL, video.OriginalMediaType
+	} else if !videoPlaybackReady(video) {
+		// The original is what was received, it doesn't wait on processing
+		stored = nil
+	}
+	if r.URL.Query().Get("download") == "true" && stored != nil && *stored != "" {
+		disposition := fmt.Sprintf(`attachment; filename="%s"`, downloadFilename(video.Title))
+		downloadURL, err := cfg.signStoredURL(r.Context(), *stored, expiry, SignOptions{ContentDisposition: disposition, ContentType: contentType})
+		if errors.Is(err, errAssetUnavailable) {
+			respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video file is no longer available", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
+			return
+		}
+		signedVideo.VideoURL = &downloadURL
+	} else if version == "original" {
+		originalURL, err := cfg.signStoredURL(r.Context(), *stored, expiry, SignOptions{ContentType: contentType})
+		if errors.Is(err, errAssetUnavailable) {
+			respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Original upload is no longer available", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
+			return
+		}
+		signedVideo.VideoURL = &originalURL
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// handlerVideoHead answers HEAD with the stored video file's size, type
+// and modification time, without presigning anything. It only sets
+// headers, errors included: HEAD responses have no body. Videos with no
+// file uploaded yet are 404, like unknown ones.
+func (cfg *apiConfig) handlerVideoHead(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleViewer)
+	var accessErr *accessError
+	if errors.As(err, &accessErr) {
+		if accessErr.err != nil && accessErr.status > 499 {
+			slog.ErrorContext(r.Context(), "couldn't authorize video access", "video_id", r.PathValue("videoID"), "error", accessErr.err)
+		}
+		w.WriteHeader(accessErr.status)
+		return
+	}
+	if video.VideoURL == nil || *video.VideoURL == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Processed videos are always stored as MP4
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.FormatInt(video.FileSize, 10))
+	w.Header().Set("Last-Modified", video.UpdatedAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+const maxDownloadFilenameLength = 100
+
+// downloadFilename turns a title into a safe quoted-string filename. Only
+// ASCII letters, digits, spaces, dots, dashes and underscores survive, so
+// quotes, backslashes and control characters can't break the header.
+func downloadFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == ' ', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, title)
+	name = strings.Trim(name, " .")
+	if len(name) > maxDownloadFilenameLength {
+		name = name[:maxDownloadFilenameLength]
+	}
+	if name == "" {
+		name = "video"
+	}
+	return name + ".mp4"
+}
+
+const (
+	defaultVideoPageSize = 20
+	maxVideoPageSize     = 100
+)
+
+func (cfg *apiConfig) handlerListVideos(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos []database.Video `json:"videos"`
+		Total  int              `json:"total"`
+		Limit  int              `json:"limit"`
+		Offset int              `json:"offset"`
+	}
+
+	userID, ok := cfg.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultVideoPageSize
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", err)
+			return
+		}
+		limit = min(limit, maxVideoPageSize)
+	}
+
+	offset := 0
+	if offsetString := r.URL.Query().Get("offset"); offsetString != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a non-negative integer", err)
+			return
+		}
+	}
+
+	// Lets owners find deleted videos to restore
+	includeDeleted := r.URL.Query().Get("includeDeleted") == "true"
+
+	videos, total, err := cfg.db.ListVideosByUser(userID, limit, offset, includeDeleted)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
 	for i := range videos {
-		signedVideo, err := cfg.dbVideoToSignedVideo(videos[i])
+		signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), videos[i], cfg.presignExpiry)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to sign video URL", err)
 			return
@@ -131,5 +399,10 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		videos[i] = signedVideo
 	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	respondWithJSON(w, http.StatusOK, response{
+		Videos: videos,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	})
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// getTestVideoETag fetches videoID as userID and returns its ETag
+func getTestVideoETag(t *testing.T, cfg *apiConfig, videoID, userID uuid.UUID) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID.String(), nil)
+	r.SetPathValue("videoID", videoID.String())
+	authorizeTestRequest(t, r, userID)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoGet(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET response has no ETag")
+	}
+	return etag
+}
+
+// updateTestVideo PUTs a new title for videoID as userID, with ifMatch as
+// If-Match unless it's empty
+func updateTestVideo(t *testing.T, cfg *apiConfig, videoID, userID uuid.UUID, ifMatch, title string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPut, "/api/videos/"+videoID.String(), strings.NewReader(`{"title":"`+title+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	r.SetPathValue("videoID", videoID.String())
+	authorizeTestRequest(t, r, userID)
+	w := httptest.NewRecorder()
+	cfg.handlerUpdateVideoMetadata(w, r)
+	return w
+}
+
+func TestHandlerUpdateVideoMetadataIfMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    func(current, stale string) string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "current ETag",
+			ifMatch:    func(current, _ string) string { return current },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "stale ETag from before another client's update",
+			ifMatch:    func(_, stale string) string { return stale },
+			wantStatus: http.StatusPreconditionFailed,
+			wantCode:   errCodeVersionMismatch,
+		},
+		{
+			name:       "stale ETag listed with the current one",
+			ifMatch:    func(current, stale string) string { return stale + ", " + current },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "weak current ETag",
+			ifMatch:    func(current, _ string) string { return "W/" + current },
+			wantStatus: http.StatusPreconditionFailed,
+			wantCode:   errCodeVersionMismatch,
+		},
+		{
+			name:       "any version",
+			ifMatch:    func(string, string) string { return "*" },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no If-Match",
+			ifMatch:    func(string, string) string { return "" },
+			wantStatus: http.StatusPreconditionRequired,
+			wantCode:   errCodeMissingIfMatch,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			// Another client updates the video after stale was read
+			stale := getTestVideoETag(t, cfg, video.ID, owner)
+			if w := updateTestVideo(t, cfg, video.ID, owner, stale, "First edit"); w.Code != http.StatusOK {
+				t.Fatalf("first update status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			current := getTestVideoETag(t, cfg, video.ID, owner)
+
+			w := updateTestVideo(t, cfg, video.ID, owner, tc.ifMatch(current, stale), "Second edit")
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+
+			wantTitle := "First edit"
+			if tc.wantStatus == http.StatusOK {
+				wantTitle = "Second edit"
+				if etag := w.Header().Get("ETag"); etag != getTestVideoETag(t, cfg, video.ID, owner) {
+					t.Errorf("update ETag = %q, want the one a GET now returns", etag)
+				}
+			}
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Title != wantTitle {
+				t.Errorf("title = %q, want %q", stored.Title, wantTitle)
+			}
+		})
+	}
+}
+
+func TestHandlerUpdateVideoMetadataBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "valid body", body: `{"title":"New title"}`, wantStatus: http.StatusOK},
+		{name: "malformed JSON", body: `{"title":`, wantStatus: http.StatusBadRequest, wantCode: errCodeInvalidJSON},
+		{name: "unknown field", body: `{"title":"New title","user_id":"someone"}`, wantStatus: http.StatusBadRequest, wantCode: errCodeUnknownField},
+		{name: "oversized body", body: `{"description":"` + strings.Repeat("a", maxJSONBodyBytes) + `"}`, wantStatus: http.StatusBadRequest, wantCode: errCodeBodyTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := httptest.NewRequest(http.MethodPut, "/api/videos/"+video.ID.String(), strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("If-Match", "*")
+			r.SetPathValue("videoID", video.ID.String())
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUpdateVideoMetadata(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandlerVideoGetDefaultThumbnail(t *testing.T) {
+	const ownThumbnail = "http://localhost:8091/assets/own.abc123.jpeg"
+
+	tests := []struct {
+		name             string
+		thumbnailURL     string // the video's own, none if empty
+		defaultThumbnail string
+		wantURL          string // no thumbnail_url if empty
+		wantDefault      bool
+	}{
+		{
+			name:             "no thumbnail, default asset",
+			defaultThumbnail: "placeholder.png",
+			wantURL:          "http://localhost:8091/assets/placeholder.png",
+			wantDefault:      true,
+		},
+		{
+			name:             "no thumbnail, default URL",
+			defaultThumbnail: "https://images.example.com/placeholder.png",
+			wantURL:          "https://images.example.com/placeholder.png",
+			wantDefault:      true,
+		},
+		{
+			name: "no thumbnail, no default",
+		},
+		{
+			name:             "own thumbnail",
+			thumbnailURL:     ownThumbnail,
+			defaultThumbnail: "placeholder.png",
+			wantURL:          ownThumbnail,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.defaultThumbnail = tc.defaultThumbnail
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			if tc.thumbnailURL != "" {
+				video.ThumbnailURL = &tc.thumbnailURL
+				if err := cfg.db.UpdateVideo(video); err != nil {
+					t.Fatalf("UpdateVideo: %v", err)
+				}
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+			r.SetPathValue("videoID", video.ID.String())
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerVideoGet(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var body struct {
+				ThumbnailURL       *string `json:"thumbnail_url"`
+				IsDefaultThumbnail bool    `json:"is_default_thumbnail"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			var gotURL string
+			if body.ThumbnailURL != nil {
+				gotURL = *body.ThumbnailURL
+			}
+			if gotURL != tc.wantURL {
+				t.Errorf("thumbnail_url = %q, want %q", gotURL, tc.wantURL)
+			}
+			if body.IsDefaultThumbnail != tc.wantDefault {
+				t.Errorf("is_default_thumbnail = %v, want %v", body.IsDefaultThumbnail, tc.wantDefault)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerListVideoPermissions shows the owner who else has access to a
+// video
+func (cfg *apiConfig) handlerListVideoPermissions(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	permissions, err := cfg.db.GetVideoPermissions(video.ID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video permissions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, permissions)
+}
+
+// handlerGrantVideoPermission gives another user a role on one of the
+// caller's videos, viewer or editor, replacing any role they had
+func (cfg *apiConfig) handlerGrantVideoPermission(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	video, ownerID, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid user ID", err)
+		return
+	}
+
+	params := parameters{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		respondWithJSONBodyError(w, err)
+		return
+	}
+	if params.Role != database.VideoRoleViewer && params.Role != database.VideoRoleEditor {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRole, "role must be viewer or editor", nil)
+		return
+	}
+	if userID == ownerID {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "The owner already has full access", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	// Users of other tenants couldn't be handed the video's URLs anyway,
+	// and aren't let on to exist
+	if user == nil || user.TenantID != requestTenant(r.Context()) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find user", nil)
+		return
+	}
+
+	if err := cfg.db.GrantAccess(video.ID, userID, params.Role); err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't grant access", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerRevokeVideoPermission(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleOwner)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid user ID", err)
+		return
+	}
+
+	found, err := cfg.db.RevokeAccess(video.ID, userID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't revoke access", err)
+		return
+	}
+	if !found {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeGrantNotFound, "User has no access to revoke", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
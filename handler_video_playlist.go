@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// handlerVideoPlaylist serves a video's HLS playlist with every segment URI
+// rewritten to a signed URL. The playlist stored in S3 only holds
+// relative segment names, which a player can't fetch from private storage,
+// so the rewrite has to happen on each request while the signatures are fresh.
+// Like the video itself, it's only served to those who may view the video,
+// once it's ready.
+func (cfg *apiConfig) handlerVideoPlaylist(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleViewer)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+	// Segments are signed for as long as ?expires asks, like the video's
+	// own URLs
+	expiry, err := cfg.requestPresignExpiry(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if !videoPlaybackReady(video) || video.HLSPlaylistURL == nil || *video.HLSPlaylistURL == "" {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video has no HLS playlist", nil)
+		return
+	}
+
+	// Viewers the video was shared with get segments signed for its owner
+	ctx, err := cfg.withOwnerTenant(r.Context(), video.UserID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't find the video's owner", err)
+		return
+	}
+
+	storage, playlistKey, err := cfg.storageFor(*video.HLSPlaylistURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Invalid stored playlist URL format", err)
+		return
+	}
+
+	playlistBody, err := storage.Get(ctx, playlistKey)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeAssetUnavailable, "Video's HLS playlist is no longer available", err)
+		return
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't fetch playlist", err)
+		return
+	}
+	defer playlistBody.Close()
+
+	var playlist strings.Builder
+	scanner := bufio.NewScanner(playlistBody)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segmentKey := path.Join(path.Dir(playlistKey), line)
+			line, err = cfg.signObjectURL(ctx, storage, segmentKey, expiry, SignOptions{})
+			if err != nil {
+				respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't sign playlist segment", err)
+				return
+			}
+		}
+		playlist.WriteString(line)
+		playlist.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't read playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(playlist.String()))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerVideoPlaylist(t *testing.T) {
+	const (
+		hlsPrefix   = "users/owner/videos/landscape/abc/hls/"
+		playlistKey = hlsPrefix + hlsPlaylistName
+		playlist    = "#EXTM3U\n#EXT-X-TARGETDURATION:3\n#EXTINF:3.0,\nsegment_00000.ts\n#EXTINF:1.5,\nsegment_00001.ts\n#EXT-X-ENDLIST\n"
+	)
+
+	tests := []struct {
+		name        string
+		stored      bool // whether the playlist is in storage
+		query       string
+		wantStatus  int
+		wantCode    string
+		wantExpires string // X-Amz-Expires of every segment URL
+	}{
+		{
+			name:        "segments are signed",
+			stored:      true,
+			wantStatus:  http.StatusOK,
+			wantExpires: "3600",
+		},
+		{
+			name:        "segments are signed for ?expires",
+			stored:      true,
+			query:       "?expires=120",
+			wantStatus:  http.StatusOK,
+			wantExpires: "120",
+		},
+		{
+			name:       "invalid ?expires",
+			stored:     true,
+			query:      "?expires=soon",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing playlist",
+			wantStatus: http.StatusNotFound,
+			wantCode:   errCodeAssetUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			// The SDK's presigner, so the URLs say how long they're valid
+			storage := newS3Storage(bucket, testS3Presigner(), testBucket, nil, "", 1)
+			regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+			if err != nil {
+				t.Fatalf("newStorageRegions: %v", err)
+			}
+			cfg.storageRegions = regions
+
+			if tc.stored {
+				bucket.objects[playlistKey] = fakeS3Object{body: []byte(playlist), contentType: "application/vnd.apple.mpegurl"}
+			}
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			playlistURL := testBucket + "," + playlistKey
+			videoURL := testBucket + ",users/owner/videos/landscape/abc/playback.mp4"
+			video.HLSPlaylistURL = &playlistURL
+			video.VideoURL = &videoURL
+			video.Status = database.VideoStatusReady
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/playlist.m3u8"+tc.query, nil)
+			r.SetPathValue("videoID", video.ID.String())
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerVideoPlaylist(w, r)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantCode != "" {
+				var body struct {
+					Code string `json:"code"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("couldn't decode error: %v", err)
+				}
+				if body.Code != tc.wantCode {
+					t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+				}
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+			want := strings.Split(strings.TrimSuffix(playlist, "\n"), "\n")
+			if len(lines) != len(want) {
+				t.Fatalf("playlist has %d lines, want %d:\n%s", len(lines), len(want), w.Body)
+			}
+			for i, line := range lines {
+				if strings.HasPrefix(want[i], "#") {
+					if line != want[i] {
+						t.Errorf("line %d = %q, want it kept as %q", i, line, want[i])
+					}
+					continue
+				}
+				u, err := url.Parse(line)
+				if err != nil {
+					t.Fatalf("couldn't parse segment URL %q: %v", line, err)
+				}
+				if !strings.HasSuffix(u.Path, "/"+hlsPrefix+want[i]) {
+					t.Errorf("segment URL %q isn't for %s", line, hlsPrefix+want[i])
+				}
+				if got := u.Query().Get("X-Amz-Expires"); got != tc.wantExpires {
+					t.Errorf("segment URL %q expires after %q seconds, want %q", line, got, tc.wantExpires)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	hlsPlaylistName   = "index.m3u8"
+	hlsSegmentSeconds = 6
+)
+
+// processVideoForHLS splits a video into an HLS VOD playlist and MPEG-TS
+// segments, written to a fresh temp directory. The caller is responsible
+// for removing filepath.Dir(playlistPath) once the files are uploaded.
+func (cfg *apiConfig) processVideoForHLS(filePath string) (playlistPath string, segmentPaths []string, err error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	outDir, err := os.MkdirTemp(cfg.tempDir, "tubely-hls-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(outDir)
+		}
+	}()
+
+	playlistPath = filepath.Join(outDir, hlsPlaylistName)
+
+	cmd := cfg.transcodeCommand(
+		cfg.ffmpegPath,
+		"-i", absPath,
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-hls_time", fmt.Sprintf("%d", hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "segment_%05d.ts"),
+		"-f", "hls",
+		playlistPath,
+	)
+	start := time.Now()
+	err = cmd.Run()
+	ffmpegDuration.WithLabelValues("hls", metricResult(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to execute ffmpeg for HLS: %w", err)
+	}
+
+	segmentPaths, err = filepath.Glob(filepath.Join(outDir, "*.ts"))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(segmentPaths) == 0 {
+		return "", nil, fmt.Errorf("ffmpeg produced no HLS segments")
+	}
+	sort.Strings(segmentPaths)
+
+	return playlistPath, segmentPaths, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Set on responses replayed from an earlier request with the same key
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotencyLockName is what requests sharing an Idempotency-Key lock on,
+// so only the first does the work and the others replay its result
+func idempotencyLockName(userID uuid.UUID, key string) string {
+	return userID.String() + ":" + key
+}
+
+// replayIdempotentUpload answers a retried upload with the status of the
+// first request to use key, and the video as it is now. It reports
+// whether it responded, which it does for a key that was used on another
+// video too.
+func (cfg *apiConfig) replayIdempotentUpload(w http.ResponseWriter, r *http.Request, userID, videoID uuid.UUID, key string) bool {
+	entry, err := cfg.db.GetIdempotencyKey(userID, key, time.Now().Add(-cfg.idempotencyKeyTTL))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check Idempotency-Key", err)
+		return true
+	}
+	if entry.Key == "" {
+		return false
+	}
+	if entry.VideoID != videoID {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeIdempotencyKeyUsed, "Idempotency-Key was already used for another video", nil)
+		return true
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return true
+	}
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video, cfg.presignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Failed to sign video URL", err)
+		return true
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	respondWithJSON(w, entry.Status, signedVideo)
+	return true
+}
+
+// saveIdempotentUpload remembers how an upload sent with key was answered.
+// It's best effort: if it fails, a retry is simply processed again.
+func (cfg *apiConfig) saveIdempotentUpload(r *http.Request, userID, videoID uuid.UUID, key string, status int) {
+	err := cfg.db.SaveIdempotencyKey(database.IdempotencyKey{
+		Key:     key,
+		UserID:  userID,
+		VideoID: videoID,
+		Status:  status,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't save idempotency key", "video_id", videoID, "user_id", userID, "error", err)
+	}
+}
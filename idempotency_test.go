@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHandlerUploadVideoIdempotencyKey(t *testing.T) {
+	type upload struct {
+		video int    // index into owner, owner, other's videos
+		key   string // Idempotency-Key, none if empty
+	}
+	tests := []struct {
+		name         string
+		ttl          time.Duration
+		uploads      []upload
+		wantStatuses []int
+		wantReplayed []bool
+		wantJobs     int
+	}{
+		{
+			name:         "duplicated request replays the first",
+			uploads:      []upload{{video: 0, key: "retry-1"}, {video: 0, key: "retry-1"}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusAccepted},
+			wantReplayed: []bool{false, true},
+			wantJobs:     1,
+		},
+		{
+			name:         "different keys are both processed",
+			uploads:      []upload{{video: 0, key: "retry-1"}, {video: 0, key: "retry-2"}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusAccepted},
+			wantReplayed: []bool{false, false},
+			wantJobs:     2,
+		},
+		{
+			name:         "no key is processed every time",
+			uploads:      []upload{{video: 0}, {video: 0}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusAccepted},
+			wantReplayed: []bool{false, false},
+			wantJobs:     2,
+		},
+		{
+			name:         "key reused for another video",
+			uploads:      []upload{{video: 0, key: "retry-1"}, {video: 1, key: "retry-1"}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusUnprocessableEntity},
+			wantReplayed: []bool{false, false},
+			wantJobs:     1,
+		},
+		{
+			name:         "same key from another user",
+			uploads:      []upload{{video: 0, key: "retry-1"}, {video: 2, key: "retry-1"}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusAccepted},
+			wantReplayed: []bool{false, false},
+			wantJobs:     2,
+		},
+		{
+			name:         "expired key is processed again",
+			ttl:          -time.Hour,
+			uploads:      []upload{{video: 0, key: "retry-1"}, {video: 0, key: "retry-1"}},
+			wantStatuses: []int{http.StatusAccepted, http.StatusAccepted},
+			wantReplayed: []bool{false, false},
+			wantJobs:     2,
+		},
+		{
+			name:         "key that's too long",
+			uploads:      []upload{{video: 0, key: strings.Repeat("k", maxIdempotencyKeyLength+1)}},
+			wantStatuses: []int{http.StatusBadRequest},
+			wantReplayed: []bool{false},
+			wantJobs:     0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			if tc.ttl != 0 {
+				cfg.idempotencyKeyTTL = tc.ttl
+			}
+			owner := createTestUser(t, cfg, "owner@example.com")
+			other := createTestUser(t, cfg, "other@example.com")
+			owners := []uuid.UUID{owner, owner, other}
+			var videoIDs []uuid.UUID
+			for _, userID := range owners {
+				videoIDs = append(videoIDs, createTestVideo(t, cfg, userID).ID)
+			}
+
+			for i, u := range tc.uploads {
+				r := newVideoUploadRequest(t, videoIDs[u.video], "video/mp4", []byte("the same upload"))
+				if u.key != "" {
+					r.Header.Set(idempotencyKeyHeader, u.key)
+				}
+				authorizeTestRequest(t, r, owners[u.video])
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, r)
+
+				if w.Code != tc.wantStatuses[i] {
+					t.Fatalf("upload %d: status = %d, want %d: %s", i, w.Code, tc.wantStatuses[i], w.Body)
+				}
+				if replayed := w.Header().Get(idempotentReplayedHeader) == "true"; replayed != tc.wantReplayed[i] {
+					t.Errorf("upload %d: replayed = %v, want %v", i, replayed, tc.wantReplayed[i])
+				}
+			}
+			if len(cfg.videoJobs) != tc.wantJobs {
+				t.Errorf("%d video jobs queued, want %d", len(cfg.videoJobs), tc.wantJobs)
+			}
+		})
+	}
+}
+
+// TestHandlerUploadVideoIdempotencyKeyConcurrent checks requests sharing a
+// key wait for each other, so only one of them does the work
+func TestHandlerUploadVideoIdempotencyKeyConcurrent(t *testing.T) {
+	const requests = 4
+	cfg, _ := newTestConfig(t)
+	owner := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := range requests {
+		r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("the same upload"))
+		r.Header.Set(idempotencyKeyHeader, "retry-1")
+		authorizeTestRequest(t, r, owner)
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.handlerUploadVideo(responses[i], r)
+		}()
+	}
+	wg.Wait()
+
+	replayed := 0
+	for i, w := range responses {
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("request %d: status = %d, want %d: %s", i, w.Code, http.StatusAccepted, w.Body)
+		}
+		var body struct {
+			ID uuid.UUID `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("request %d: couldn't decode response: %v", i, err)
+		}
+		if body.ID != video.ID {
+			t.Errorf("request %d: id = %s, want %s", i, body.ID, video.ID)
+		}
+		if w.Header().Get(idempotentReplayedHeader) == "true" {
+			replayed++
+		}
+	}
+	if replayed != requests-1 {
+		t.Errorf("%d responses were replayed, want %d", replayed, requests-1)
+	}
+	if len(cfg.videoJobs) != 1 {
+		t.Errorf("%d video jobs queued, want 1", len(cfg.videoJobs))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testEXIFJPEG is a 64x36 JPEG, red down its left quarter and blue
+// elsewhere, with EXIF data holding orientation and a GPS position
+func testEXIFJPEG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 36))
+	for x := range 64 {
+		for y := range 36 {
+			c := color.RGBA{B: 255, A: 255}
+			if x < 16 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("couldn't encode JPEG: %v", err)
+	}
+
+	// Big-endian TIFF: IFD0 at 8 with the orientation and a pointer to
+	// the GPS IFD at 38, which holds the latitude ref
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0x00, 0x00)
+	tiff = append(tiff, 0x88, 0x25, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x26)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = append(tiff, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02, 'N', 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(exif)+2))
+	app1 = append(app1, exif...)
+
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestHandlerUploadThumbnailEXIF(t *testing.T) {
+	tests := []struct {
+		name        string
+		orientation uint16
+		wantRed     string // side the red band should end up on
+		wantWide    bool
+	}{
+		{name: "upright", orientation: 1, wantRed: "left", wantWide: true},
+		{name: "upside down", orientation: 3, wantRed: "right", wantWide: true},
+		{name: "turned a quarter clockwise", orientation: 6, wantRed: "top", wantWide: false},
+		{name: "turned a quarter anticlockwise", orientation: 8, wantRed: "bottom", wantWide: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			upload := testEXIFJPEG(t, tc.orientation)
+			if got := jpegOrientation(bytes.NewReader(upload)); got != int(tc.orientation) {
+				t.Fatalf("test JPEG has orientation %d, want %d", got, tc.orientation)
+			}
+			r := newThumbnailUploadRequest(t, video.ID, "image/jpeg", upload)
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			stored, err := filepath.Glob(filepath.Join(cfg.assetsRoot, "*"))
+			if err != nil || len(stored) == 0 {
+				t.Fatalf("no thumbnails were stored: %v", err)
+			}
+			for _, path := range stored {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("couldn't read %s: %v", path, err)
+				}
+				if bytes.Contains(data, []byte("Exif\x00\x00")) || bytes.Contains(data, []byte("MM\x00\x2a")) {
+					t.Errorf("%s still has EXIF data", filepath.Base(path))
+				}
+				img, _, err := image.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("couldn't decode %s: %v", path, err)
+				}
+				b := img.Bounds()
+				if wide := b.Dx() > b.Dy(); wide != tc.wantWide {
+					t.Errorf("%s is %dx%d, want it wide: %v", filepath.Base(path), b.Dx(), b.Dy(), tc.wantWide)
+				}
+				if side := redSide(img); side != tc.wantRed {
+					t.Errorf("%s has red on the %s, want the %s", filepath.Base(path), side, tc.wantRed)
+				}
+			}
+		})
+	}
+}
+
+// redSide reports which edge of img is red, the others being blue
+func redSide(img image.Image) string {
+	b := img.Bounds()
+	sides := []struct {
+		name string
+		x, y int
+	}{
+		{"left", b.Min.X + b.Dx()/8, b.Min.Y + b.Dy()/2},
+		{"right", b.Max.X - 1 - b.Dx()/8, b.Min.Y + b.Dy()/2},
+		{"top", b.Min.X + b.Dx()/2, b.Min.Y + b.Dy()/8},
+		{"bottom", b.Min.X + b.Dx()/2, b.Max.Y - 1 - b.Dy()/8},
+	}
+	for _, side := range sides {
+		r, _, bl, _ := img.At(side.x, side.y).RGBA()
+		if r > 0x8000 && bl < 0x8000 {
+			return side.name
+		}
+	}
+	return "none"
+}
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -20,6 +22,27 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
+// RoleAdmin may use admin-only endpoints, such as the audit log
+const RoleAdmin = "admin"
+
+// accessClaims carry the user's role and tenant, so admin and tenant
+// checks don't need a database lookup
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Role   string `json:"role,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// AccessClaims are who an access token was issued to
+type AccessClaims struct {
+	UserID uuid.UUID
+	// Role is empty for regular users
+	Role string
+	// TenantID is empty for users who belong to no tenant, and in tokens
+	// issued before tenants were introduced
+	TenantID string
+}
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
 func HashPassword(password string) (string, error) {
@@ -40,48 +63,68 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 
 func MakeJWT(
 	userID uuid.UUID,
+	role string,
+	tenantID string,
 	tokenSecret string,
 	expiresIn time.Duration,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		Role:   role,
+		Tenant: tenantID,
 	})
 	return token.SignedString(signingKey)
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+	id, _, err := ValidateJWTWithRole(tokenString, tokenSecret)
+	return id, err
+}
+
+// ValidateJWTWithRole is ValidateJWT that also returns the role the token
+// was issued with, empty for regular users
+func ValidateJWTWithRole(tokenString, tokenSecret string) (uuid.UUID, string, error) {
+	claims, err := ValidateAccessJWT(tokenString, tokenSecret)
+	return claims.UserID, claims.Role, err
+}
+
+// ValidateAccessJWT validates an access token and returns everything it
+// says about the user
+func ValidateAccessJWT(tokenString, tokenSecret string) (AccessClaims, error) {
+	claimsStruct := accessClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return AccessClaims{}, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return AccessClaims{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	return AccessClaims{UserID: id, Role: claimsStruct.Role, TenantID: claimsStruct.Tenant}, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -106,6 +149,34 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+func MakeAPIKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// MakeShareToken is the secret part of a public share link, 256 random
+// bits that are safe to put in a URL path. Like API keys, only a hash of
+// it is stored.
+func MakeShareToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// HashAPIKey is what gets stored instead of the key itself. Keys are random
+// 256-bit values, so a plain SHA-256 is enough and keeps lookups indexable.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type APIKey struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	UserID    uuid.UUID  `json:"user_id"`
+}
+
+// CreateAPIKey stores the hash of a key, the key itself is never saved
+func (c Client) CreateAPIKey(userID uuid.UUID, keyHash string) (APIKey, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO api_keys (
+		id,
+		created_at,
+		updated_at,
+		key_hash,
+		user_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, keyHash, userID)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return c.getAPIKey(`id = ?`, id)
+}
+
+func (c Client) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	return c.getAPIKey(`key_hash = ?`, keyHash)
+}
+
+func (c Client) getAPIKey(where string, arg any) (APIKey, error) {
+	query := `
+	SELECT id, created_at, updated_at, revoked_at, user_id
+	FROM api_keys
+	WHERE ` + where
+
+	var key APIKey
+	err := c.db.QueryRow(query, arg).Scan(&key.ID, &key.CreatedAt, &key.UpdatedAt, &key.RevokedAt, &key.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, nil
+		}
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// RevokeAPIKey only revokes keys belonging to the given user, and reports
+// whether one was found
+func (c Client) RevokeAPIKey(id, userID uuid.UUID) (bool, error) {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.Exec(query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
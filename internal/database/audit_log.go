@@ -0,0 +1,92 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEntry records who uploaded what, and from where
+type AuditEntry struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UserID      uuid.UUID `json:"user_id"`
+	VideoID     uuid.UUID `json:"video_id"`
+	Action      string    `json:"action"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	RemoteIP    string    `json:"remote_ip"`
+}
+
+type CreateAuditEntryParams struct {
+	UserID      uuid.UUID
+	VideoID     uuid.UUID
+	Action      string
+	ContentType string
+	Size        int64
+	RemoteIP    string
+}
+
+func (c Client) CreateAuditEntry(params CreateAuditEntryParams) error {
+	query := `
+	INSERT INTO audit_log (
+		id,
+		created_at,
+		user_id,
+		video_id,
+		action,
+		content_type,
+		size,
+		remote_ip
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uuid.New(), params.UserID, params.VideoID, params.Action, params.ContentType, params.Size, params.RemoteIP)
+	return err
+}
+
+// ListAuditEntries returns one page of audit entries, newest first, along
+// with the total number of entries. A non-nil userID only lists that
+// user's entries.
+func (c Client) ListAuditEntries(userID uuid.UUID, limit, offset int) ([]AuditEntry, int, error) {
+	where := ``
+	args := []any{}
+	if userID != uuid.Nil {
+		where = `WHERE user_id = ?`
+		args = append(args, userID)
+	}
+
+	var total int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM audit_log `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT id, created_at, user_id, video_id, action, content_type, size, remote_ip
+	FROM audit_log
+	` + where + `
+	ORDER BY created_at DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.CreatedAt, &entry.UserID, &entry.VideoID, &entry.Action, &entry.ContentType, &entry.Size, &entry.RemoteIP)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey records the outcome of an upload sent with an
+// Idempotency-Key header, so a retry of it can be answered the same way
+type IdempotencyKey struct {
+	Key       string    `json:"key"`
+	UserID    uuid.UUID `json:"user_id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Status    int       `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SaveIdempotencyKey stores the outcome of a request, replacing an expired
+// entry for the same key
+func (c Client) SaveIdempotencyKey(key IdempotencyKey) error {
+	query := `
+	INSERT OR REPLACE INTO idempotency_keys (
+		user_id,
+		key,
+		video_id,
+		status,
+		created_at
+	) VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, key.UserID, key.Key, key.VideoID, key.Status, time.Now().UTC())
+	return err
+}
+
+// GetIdempotencyKey finds a key the given user sent since the cutoff.
+// Older ones are treated as never sent.
+func (c Client) GetIdempotencyKey(userID uuid.UUID, key string, since time.Time) (IdempotencyKey, error) {
+	query := `
+	SELECT key, user_id, video_id, status, created_at
+	FROM idempotency_keys
+	WHERE user_id = ? AND key = ? AND created_at >= ?
+	`
+	var entry IdempotencyKey
+	err := c.db.QueryRow(query, userID, key, since.UTC()).Scan(&entry.Key, &entry.UserID, &entry.VideoID, &entry.Status, &entry.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyKey{}, nil
+		}
+		return IdempotencyKey{}, err
+	}
+	return entry, nil
+}
+
+// DeleteIdempotencyKeysBefore removes keys that have expired
+func (c Client) DeleteIdempotencyKeysBefore(cutoff time.Time) error {
+	_, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, cutoff.UTC())
+	return err
+}
+
+// DeleteIdempotencyKeysForVideo removes the keys of uploads to a video, for
+// when the video itself is gone
+func (c Client) DeleteIdempotencyKeysForVideo(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM idempotency_keys WHERE video_id = ?`, videoID)
+	return err
+}
@@ -0,0 +1,116 @@
+-- The schema as it stood when migrations were introduced. Databases
+-- created before then already have these tables, so nothing here may
+-- fail if they exist.
+
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	role TEXT
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS videos (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	thumbnails TEXT,
+	video_url TEXT,
+	renditions TEXT,
+	hls_playlist_url TEXT,
+	sprite_sheet_url TEXT,
+	sprite_vtt_url TEXT,
+	captions TEXT,
+	duration REAL,
+	status TEXT,
+	file_size INTEGER,
+	storage_class TEXT,
+	content_hash TEXT,
+	format_name TEXT,
+	video_codec TEXT,
+	width INTEGER,
+	height INTEGER,
+	deleted_at TIMESTAMP,
+	original_url TEXT,
+	original_media_type TEXT,
+	normalize_audio BOOLEAN,
+	version INTEGER NOT NULL DEFAULT 1,
+	user_id INTEGER,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	s3_upload_id TEXT NOT NULL,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	s3_key TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	key_hash TEXT UNIQUE NOT NULL,
+	user_id TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS share_links (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	token_hash TEXT UNIQUE NOT NULL,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	video_id TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY(user_id, key),
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	user_id TEXT NOT NULL,
+	video_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	remote_ip TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_videos_content_hash ON videos(content_hash);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_user_created ON audit_log(user_id, created_at);
@@ -0,0 +1,12 @@
+-- Access to a video granted to users other than its owner
+CREATE TABLE video_permissions (
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	role TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(video_id, user_id),
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE INDEX idx_video_permissions_user ON video_permissions(user_id);
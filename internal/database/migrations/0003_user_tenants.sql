@@ -0,0 +1,4 @@
+-- The customer a user belongs to, empty for users who belong to none. Their
+-- objects are stored under tenants/<tenant_id>/, so it has to be safe in a
+-- key.
+ALTER TABLE users ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '' CHECK (tenant_id NOT GLOB '*[^A-Za-z0-9_-]*');
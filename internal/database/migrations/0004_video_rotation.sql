@@ -0,0 +1,3 @@
+-- Degrees clockwise a video has been rotated by since it was uploaded,
+-- reapplied when it's reprocessed from its original
+ALTER TABLE videos ADD COLUMN rotation INTEGER NOT NULL DEFAULT 0 CHECK (rotation IN (0, 90, 180, 270));
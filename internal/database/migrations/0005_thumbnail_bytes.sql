@@ -0,0 +1,7 @@
+-- Bytes every stored size of a video's thumbnail takes up, counted against
+-- its owner's storage quota. Thumbnails stored before then count the sizes
+-- recorded for them.
+ALTER TABLE videos ADD COLUMN thumbnail_bytes INTEGER NOT NULL DEFAULT 0;
+UPDATE videos
+SET thumbnail_bytes = (SELECT COALESCE(SUM(json_extract(value, '$.size')), 0) FROM json_each(videos.thumbnails))
+WHERE thumbnails IS NOT NULL AND thumbnails != '';
@@ -0,0 +1,5 @@
+-- Bytes the files processing makes from an upload take up, its renditions,
+-- HLS segments, sprite sheet and a kept original, counted against its
+-- owner's storage quota along with the playback file. Videos processed
+-- before then count nothing for them until they're reprocessed.
+ALTER TABLE videos ADD COLUMN derived_bytes INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// openTestDB is an empty SQLite database in the test's temp directory
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schemaState is the schema and applied migrations of db, to compare
+// before and after
+func schemaState(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var state []string
+	for _, query := range []string{
+		"SELECT type || ' ' || name || ' ' || COALESCE(sql, '') FROM sqlite_master ORDER BY name",
+		"SELECT version || ' ' || name || ' ' || applied_at FROM schema_migrations ORDER BY version",
+	} {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatalf("couldn't read schema: %v", err)
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				t.Fatalf("couldn't read schema: %v", err)
+			}
+			state = append(state, line)
+		}
+		rows.Close()
+	}
+	return strings.Join(state, "\n")
+}
+
+func TestRunMigrationsTwice(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, db *sql.DB)
+		wantVideos int
+	}{
+		{
+			name:  "empty database",
+			setup: func(*testing.T, *sql.DB) {},
+		},
+		{
+			name: "database with videos",
+			setup: func(t *testing.T, db *sql.DB) {
+				if err := runMigrations(db); err != nil {
+					t.Fatalf("runMigrations: %v", err)
+				}
+				c := Client{db}
+				user, err := c.CreateUser(CreateUserParams{Email: "owner@example.com", Password: "unused"})
+				if err != nil {
+					t.Fatalf("CreateUser: %v", err)
+				}
+				if _, err := c.CreateVideo(CreateVideoParams{Title: "Kept", UserID: user.ID}); err != nil {
+					t.Fatalf("CreateVideo: %v", err)
+				}
+			},
+			wantVideos: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openTestDB(t)
+			tc.setup(t, db)
+
+			if err := runMigrations(db); err != nil {
+				t.Fatalf("first runMigrations: %v", err)
+			}
+			before := schemaState(t, db)
+			if err := runMigrations(db); err != nil {
+				t.Fatalf("second runMigrations: %v", err)
+			}
+			if after := schemaState(t, db); after != before {
+				t.Errorf("second run changed the schema:\n%s\nwant:\n%s", after, before)
+			}
+
+			var applied, videos int
+			if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+				t.Fatalf("couldn't count migrations: %v", err)
+			}
+			if applied != len(migrations) {
+				t.Errorf("%d migrations recorded, want %d", applied, len(migrations))
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM videos").Scan(&videos); err != nil {
+				t.Fatalf("couldn't count videos: %v", err)
+			}
+			if videos != tc.wantVideos {
+				t.Errorf("%d videos after migrating again, want %d", videos, tc.wantVideos)
+			}
+		})
+	}
+}
+
+func TestRunMigrationsNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("runMigrations: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (9999, '9999_from_the_future.sql')"); err != nil {
+		t.Fatalf("couldn't record migration: %v", err)
+	}
+	err := runMigrations(db)
+	if err == nil || !strings.Contains(err.Error(), "newer than this build's") {
+		t.Errorf("runMigrations error = %v, want a schema newer than the build", err)
+	}
+}
+
+func TestApplyMigration(t *testing.T) {
+	tests := []struct {
+		name      string
+		sql       string
+		wantErr   bool
+		wantTable bool
+	}{
+		{
+			name:      "good migration is recorded",
+			sql:       "CREATE TABLE extras (id INTEGER PRIMARY KEY);",
+			wantTable: true,
+		},
+		{
+			name:    "bad migration is rolled back",
+			sql:     "CREATE TABLE extras (id INTEGER PRIMARY KEY); ALTER TABLE nowhere ADD COLUMN x TEXT;",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if err := runMigrations(db); err != nil {
+				t.Fatalf("runMigrations: %v", err)
+			}
+
+			err := applyMigration(db, migration{version: 9000, name: "9000_extras.sql", sql: tc.sql})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("applyMigration error = %v, want error: %v", err, tc.wantErr)
+			}
+			var tables, recorded int
+			if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'extras'").Scan(&tables); err != nil {
+				t.Fatalf("couldn't look for the table: %v", err)
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = 9000").Scan(&recorded); err != nil {
+				t.Fatalf("couldn't look for the migration: %v", err)
+			}
+			if (tables == 1) != tc.wantTable || (recorded == 1) != tc.wantTable {
+				t.Errorf("table created: %v, migration recorded: %v, want both %v", tables == 1, recorded == 1, tc.wantTable)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     fstest.MapFS
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"migrations/0010_later.sql":  {Data: []byte("SELECT 1;")},
+				"migrations/0002_second.sql": {Data: []byte("SELECT 1;")},
+				"migrations/0001_first.sql":  {Data: []byte("SELECT 1;")},
+			},
+			wantNames: []string{"0001_first.sql", "0002_second.sql", "0010_later.sql"},
+		},
+		{
+			name:    "unnumbered file",
+			files:   fstest.MapFS{"migrations/initial.sql": {Data: []byte("SELECT 1;")}},
+			wantErr: "isn't named NNNN_description.sql",
+		},
+		{
+			name:    "version zero",
+			files:   fstest.MapFS{"migrations/0000_nothing.sql": {Data: []byte("SELECT 1;")}},
+			wantErr: "isn't named NNNN_description.sql",
+		},
+		{
+			name: "same version twice",
+			files: fstest.MapFS{
+				"migrations/0001_first.sql": {Data: []byte("SELECT 1;")},
+				"migrations/0001_other.sql": {Data: []byte("SELECT 1;")},
+			},
+			wantErr: "have the same version",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tc.files)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("loadMigrations error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadMigrations: %v", err)
+			}
+			var names []string
+			for _, m := range migrations {
+				names = append(names, m.name)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.wantNames, ",") {
+				t.Errorf("migrations = %v, want %v", names, tc.wantNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink lets anyone holding its token play a video without an account
+type ShareLink struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	VideoID   uuid.UUID  `json:"video_id"`
+	UserID    uuid.UUID  `json:"user_id"`
+}
+
+type CreateShareLinkParams struct {
+	VideoID   uuid.UUID
+	UserID    uuid.UUID
+	TokenHash string
+	// ExpiresAt is nil for links that work until they're revoked
+	ExpiresAt *time.Time
+}
+
+// CreateShareLink stores the hash of a share token, the token itself is
+// never saved
+func (c Client) CreateShareLink(params CreateShareLinkParams) (ShareLink, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO share_links (
+		id,
+		created_at,
+		token_hash,
+		video_id,
+		user_id,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	var expiresAt *time.Time
+	if params.ExpiresAt != nil {
+		utc := params.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	_, err := c.db.Exec(query, id, params.TokenHash, params.VideoID, params.UserID, expiresAt)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	return c.getShareLink(`id = ?`, id)
+}
+
+func (c Client) GetShareLinkByHash(tokenHash string) (ShareLink, error) {
+	return c.getShareLink(`token_hash = ?`, tokenHash)
+}
+
+func (c Client) getShareLink(where string, arg any) (ShareLink, error) {
+	query := `
+	SELECT id, created_at, expires_at, revoked_at, video_id, user_id
+	FROM share_links
+	WHERE ` + where
+
+	var link ShareLink
+	err := c.db.QueryRow(query, arg).Scan(&link.ID, &link.CreatedAt, &link.ExpiresAt, &link.RevokedAt, &link.VideoID, &link.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+// RevokeShareLink only revokes links belonging to the given user, and
+// reports whether one was found
+func (c Client) RevokeShareLink(id, userID uuid.UUID) (bool, error) {
+	query := `
+	UPDATE share_links
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.Exec(query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteShareLinksForVideo removes every link to a video, for when the
+// video itself is gone
+func (c Client) DeleteShareLinksForVideo(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM share_links WHERE video_id = ?`, videoID)
+	return err
+}
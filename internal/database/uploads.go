@@ -0,0 +1,104 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Upload struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreateUploadParams
+}
+
+type CreateUploadParams struct {
+	ID          string    `json:"upload_id"`
+	S3UploadID  string    `json:"-"`
+	VideoID     uuid.UUID `json:"video_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Bucket      string    `json:"-"`
+	Key         string    `json:"-"`
+	ContentType string    `json:"content_type"`
+}
+
+func (c Client) CreateUpload(params CreateUploadParams) (Upload, error) {
+	query := `
+	INSERT INTO uploads (
+		id,
+		created_at,
+		updated_at,
+		s3_upload_id,
+		video_id,
+		user_id,
+		bucket,
+		s3_key,
+		content_type
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		params.ID,
+		params.S3UploadID,
+		params.VideoID,
+		params.UserID,
+		params.Bucket,
+		params.Key,
+		params.ContentType,
+	)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	return c.GetUpload(params.ID, params.UserID)
+}
+
+// GetUpload only finds uploads started by the given user
+func (c Client) GetUpload(id string, userID uuid.UUID) (Upload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		s3_upload_id,
+		video_id,
+		user_id,
+		bucket,
+		s3_key,
+		content_type
+	FROM uploads
+	WHERE id = ? AND user_id = ?
+	`
+
+	var upload Upload
+	err := c.db.QueryRow(query, id, userID).Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.S3UploadID,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Bucket,
+		&upload.Key,
+		&upload.ContentType,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, nil
+		}
+		return Upload{}, err
+	}
+
+	return upload, nil
+}
+
+func (c Client) DeleteUpload(id string) error {
+	query := `
+	DELETE FROM uploads
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles a video's owner can grant other users. The owner's own access is
+// implied by Video.UserID and never stored.
+const (
+	// VideoRoleViewer may watch the video and read its metadata
+	VideoRoleViewer = "viewer"
+	// VideoRoleEditor may also change its metadata, thumbnails and captions
+	VideoRoleEditor = "editor"
+)
+
+// VideoPermission is access to a video granted to someone other than its
+// owner
+type VideoPermission struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GrantAccess gives userID role on a video, replacing any role they had
+func (c Client) GrantAccess(videoID, userID uuid.UUID, role string) error {
+	query := `
+	INSERT INTO video_permissions (video_id, user_id, role, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT (video_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	_, err := c.db.Exec(query, videoID, userID, role)
+	return err
+}
+
+// RevokeAccess takes away userID's role on a video, and reports whether
+// they had one
+func (c Client) RevokeAccess(videoID, userID uuid.UUID) (bool, error) {
+	result, err := c.db.Exec(`DELETE FROM video_permissions WHERE video_id = ? AND user_id = ?`, videoID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CheckAccess returns the role userID was granted on a video, empty if
+// none. It doesn't know about owners, check Video.UserID first.
+func (c Client) CheckAccess(videoID, userID uuid.UUID) (string, error) {
+	var role string
+	err := c.db.QueryRow(`SELECT role FROM video_permissions WHERE video_id = ? AND user_id = ?`, videoID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// GetVideoPermissions lists who has been granted access to a video, oldest
+// grant first
+func (c Client) GetVideoPermissions(videoID uuid.UUID) ([]VideoPermission, error) {
+	query := `
+	SELECT p.video_id, p.user_id, u.email, p.role, p.created_at
+	FROM video_permissions p
+	JOIN users u ON u.id = p.user_id
+	WHERE p.video_id = ?
+	ORDER BY p.created_at, u.email
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []VideoPermission{}
+	for rows.Next() {
+		var p VideoPermission
+		if err := rows.Scan(&p.VideoID, &p.UserID, &p.Email, &p.Role, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// DeleteVideoPermissions removes every grant on a video, for when the
+// video itself is gone
+func (c Client) DeleteVideoPermissions(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM video_permissions WHERE video_id = ?`, videoID)
+	return err
+}
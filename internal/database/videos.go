@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -9,33 +10,211 @@ import (
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID             uuid.UUID        `json:"id"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	ThumbnailURL   *string          `json:"thumbnail_url"`
+	Thumbnails     []VideoThumbnail `json:"thumbnails"`
+	VideoURL       *string          `json:"video_url"`
+	Renditions     []VideoRendition `json:"renditions"`
+	HLSPlaylistURL *string          `json:"hls_playlist_url"`
+	SpriteSheetURL *string          `json:"sprite_sheet_url"`
+	SpriteVTTURL   *string          `json:"sprite_vtt_url"`
+	Captions       []VideoCaption   `json:"captions"`
+	Duration       float64          `json:"duration"`
+	Status         string           `json:"status"`
+	FileSize       int64            `json:"file_size"`
+	StorageClass   string           `json:"storage_class"`
+	ContentHash    string           `json:"content_hash"`
+	FormatName     string           `json:"format_name"`
+	VideoCodec     string           `json:"video_codec"`
+	Width          int              `json:"width"`
+	Height         int              `json:"height"`
+	DeletedAt      *time.Time       `json:"deleted_at"`
+	// OriginalURL is the upload as it was received, kept so the video can
+	// be reprocessed, as "bucket,key". Watermarked uploads don't keep one.
+	OriginalURL       *string `json:"-"`
+	OriginalMediaType string  `json:"-"`
+	// NormalizeAudio is whether the upload asked for loudness normalization
+	NormalizeAudio bool `json:"normalize_audio"`
+	// Rotation is how many degrees clockwise the video has been rotated by
+	// since it was uploaded, one of 0, 90, 180 and 270
+	Rotation int `json:"rotation"`
+	// ThumbnailBytes is what every stored size of the thumbnail takes up,
+	// including an animated original
+	ThumbnailBytes int64 `json:"-"`
+	// DerivedBytes is what every other file processing stored for the
+	// video takes up, next to the FileSize of its playback file:
+	// renditions, HLS segments, its sprite sheet and a kept original
+	DerivedBytes int64 `json:"-"`
+	// Version counts UpdateVideo calls, so clients can tell whether the
+	// video changed since they read it
+	Version int `json:"version"`
+	// IsDefaultThumbnail is set on videos sent to clients whose
+	// ThumbnailURL is the placeholder shown when there's no thumbnail.
+	// It isn't stored.
+	IsDefaultThumbnail bool `json:"is_default_thumbnail"`
 	CreateVideoParams
 }
 
+// Video statuses. A video that has never had a file uploaded has no status.
+const (
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
+type VideoRendition struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// VideoCaption is a WebVTT caption track, at most one per language
+type VideoCaption struct {
+	Language string `json:"language"`
+	URL      string `json:"url"`
+}
+
+type VideoThumbnail struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size,omitempty"` // bytes as stored, 0 for thumbnails saved before sizes were recorded
+	URL    string `json:"url"`
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnails,
 		video_url,
-		user_id
+		renditions,
+		hls_playlist_url,
+		sprite_sheet_url,
+		sprite_vtt_url,
+		captions,
+		duration,
+		status,
+		file_size,
+		storage_class,
+		content_hash,
+		format_name,
+		video_codec,
+		width,
+		height,
+		deleted_at,
+		original_url,
+		original_media_type,
+		normalize_audio,
+		rotation,
+		thumbnail_bytes,
+		derived_bytes,
+		version,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var thumbnails sql.NullString
+	var renditions sql.NullString
+	var captions sql.NullString
+	var duration sql.NullFloat64
+	var status sql.NullString
+	var fileSize sql.NullInt64
+	var storageClass sql.NullString
+	var contentHash sql.NullString
+	var formatName sql.NullString
+	var videoCodec sql.NullString
+	var width sql.NullInt64
+	var height sql.NullInt64
+	var deletedAt sql.NullTime
+	var originalMediaType sql.NullString
+	var normalizeAudio sql.NullBool
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&thumbnails,
+		&video.VideoURL,
+		&renditions,
+		&video.HLSPlaylistURL,
+		&video.SpriteSheetURL,
+		&video.SpriteVTTURL,
+		&captions,
+		&duration,
+		&status,
+		&fileSize,
+		&storageClass,
+		&contentHash,
+		&formatName,
+		&videoCodec,
+		&width,
+		&height,
+		&deletedAt,
+		&video.OriginalURL,
+		&originalMediaType,
+		&normalizeAudio,
+		&video.Rotation,
+		&video.ThumbnailBytes,
+		&video.DerivedBytes,
+		&video.Version,
+		&video.UserID,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	video.Duration = duration.Float64
+	video.Status = status.String
+	video.FileSize = fileSize.Int64
+	video.StorageClass = storageClass.String
+	video.ContentHash = contentHash.String
+	video.FormatName = formatName.String
+	video.VideoCodec = videoCodec.String
+	video.Width = int(width.Int64)
+	video.Height = int(height.Int64)
+	video.OriginalMediaType = originalMediaType.String
+	video.NormalizeAudio = normalizeAudio.Bool
+	if deletedAt.Valid {
+		video.DeletedAt = &deletedAt.Time
+	}
+	if thumbnails.Valid && thumbnails.String != "" {
+		if err := json.Unmarshal([]byte(thumbnails.String), &video.Thumbnails); err != nil {
+			return Video{}, err
+		}
+	}
+	if renditions.Valid && renditions.String != "" {
+		if err := json.Unmarshal([]byte(renditions.String), &video.Renditions); err != nil {
+			return Video{}, err
+		}
+	}
+	if captions.Valid && captions.String != "" {
+		if err := json.Unmarshal([]byte(captions.String), &video.Captions); err != nil {
+			return Video{}, err
+		}
+	}
+	return video, nil
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
+	WHERE user_id = ? AND deleted_at IS NULL
 	ORDER BY created_at DESC
 	`
 
@@ -47,17 +226,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +236,62 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+// ListVideosByUser returns one page of a user's videos, newest first,
+// along with the total number of videos the user has. Deleted videos are
+// left out unless includeDeleted is set.
+func (c Client) ListVideosByUser(userID uuid.UUID, limit, offset int, includeDeleted bool) ([]Video, int, error) {
+	where := `WHERE user_id = ?`
+	if !includeDeleted {
+		where += ` AND deleted_at IS NULL`
+	}
+
+	var total int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos `+where, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	` + where + `
+	ORDER BY created_at DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		videos = append(videos, video)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return videos, total, nil
+}
+
+// GetUserStorageBytes is the total size of every file a user has stored for
+// their videos, everything processing made from them included, and of
+// their thumbnails. Deleted videos that haven't been purged yet count too.
+func (c Client) GetUserStorageBytes(userID uuid.UUID) (int64, error) {
+	var total int64
+	err := c.db.QueryRow(`SELECT COALESCE(SUM(COALESCE(file_size, 0) + derived_bytes + thumbnail_bytes), 0) FROM videos WHERE user_id = ?`, userID).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -86,31 +312,50 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
+// GetVideo treats deleted videos as missing
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+	return c.getVideo(id, false)
+}
+
+// GetVideoIncludingDeleted is GetVideo for restoring and purging videos
+func (c Client) GetVideoIncludingDeleted(id uuid.UUID) (Video, error) {
+	return c.getVideo(id, true)
+}
+
+func (c Client) getVideo(id uuid.UUID, includeDeleted bool) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
+	if !includeDeleted {
+		query += ` AND deleted_at IS NULL`
+	}
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+
+	return video, nil
+}
+
+// GetReadyVideoByContentHash finds a processed video whose original upload
+// had the given SHA-256 and whose stored files are under storedPrefix, a
+// "bucket,key" prefix, so identical uploads can share its stored objects
+func (c Client) GetReadyVideoByContentHash(contentHash, storedPrefix string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE content_hash = ? AND status = ? AND instr(video_url, ?) = 1 AND deleted_at IS NULL
+	ORDER BY created_at
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, contentHash, VideoStatusReady, storedPrefix))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,30 +366,350 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// CountVideosByVideoURL is how many videos point at the same stored object
+func (c Client) CountVideosByVideoURL(videoURL string) (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos WHERE video_url = ?`, videoURL).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CountVideosByOriginalURL is how many videos keep the same original
+func (c Client) CountVideosByOriginalURL(originalURL string) (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos WHERE original_url = ?`, originalURL).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// StartVideoReprocessing marks a ready or failed video with a kept original
+// as processing, and reports whether it did. It's a single conditional
+// update, so of two concurrent calls for a video only one succeeds.
+func (c Client) StartVideoReprocessing(id uuid.UUID) (bool, error) {
+	return c.startVideoJob(id, "original_url")
+}
+
+// StartVideoRotation is StartVideoReprocessing for a video with a processed
+// file to rotate, kept original or not
+func (c Client) StartVideoRotation(id uuid.UUID) (bool, error) {
+	return c.startVideoJob(id, "video_url")
+}
+
+// startVideoJob marks the video as processing if it's ready or failed and
+// has a file in fileColumn to process
+func (c Client) startVideoJob(id uuid.UUID, fileColumn string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status IN (?, ?) AND ` + fileColumn + ` IS NOT NULL AND deleted_at IS NULL
+	`
+	result, err := c.db.Exec(query, VideoStatusProcessing, id, VideoStatusReady, VideoStatusFailed)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UpdateVideo saves every field of video and bumps its version. Anything
+// that may run alongside other changes to the video, such as processing
+// or a thumbnail upload, saves only its own fields with one of the
+// narrower updates below instead.
 func (c Client) UpdateVideo(video Video) error {
+	_, err := c.updateVideo(video, false)
+	return err
+}
+
+// UpdateVideoIfVersion is UpdateVideo, but only if the row is still at
+// video.Version, and reports whether it was. The check and the write are a
+// single statement, so of two updates from the same version only one wins.
+func (c Client) UpdateVideoIfVersion(video Video) (bool, error) {
+	return c.updateVideo(video, true)
+}
+
+func (c Client) updateVideo(video Video, checkVersion bool) (bool, error) {
 	query := `
 	UPDATE videos
 	SET
+		updated_at = CURRENT_TIMESTAMP,
+		version = version + 1,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnails = ?,
 		video_url = ?,
+		renditions = ?,
+		hls_playlist_url = ?,
+		sprite_sheet_url = ?,
+		sprite_vtt_url = ?,
+		captions = ?,
+		duration = ?,
+		status = ?,
+		file_size = ?,
+		storage_class = ?,
+		content_hash = ?,
+		format_name = ?,
+		video_codec = ?,
+		width = ?,
+		height = ?,
+		original_url = ?,
+		original_media_type = ?,
+		normalize_audio = ?,
+		rotation = ?,
+		thumbnail_bytes = ?,
+		derived_bytes = ?,
 		user_id = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
-		query,
+	thumbnails, err := marshalNullableJSON(len(video.Thumbnails), video.Thumbnails)
+	if err != nil {
+		return false, err
+	}
+	renditions, err := marshalNullableJSON(len(video.Renditions), video.Renditions)
+	if err != nil {
+		return false, err
+	}
+	captions, err := marshalNullableJSON(len(video.Captions), video.Captions)
+	if err != nil {
+		return false, err
+	}
+
+	args := []any{
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		thumbnails,
 		&video.VideoURL,
+		renditions,
+		&video.HLSPlaylistURL,
+		&video.SpriteSheetURL,
+		&video.SpriteVTTURL,
+		captions,
+		video.Duration,
+		video.Status,
+		video.FileSize,
+		video.StorageClass,
+		video.ContentHash,
+		video.FormatName,
+		video.VideoCodec,
+		video.Width,
+		video.Height,
+		&video.OriginalURL,
+		video.OriginalMediaType,
+		video.NormalizeAudio,
+		video.Rotation,
+		video.ThumbnailBytes,
+		video.DerivedBytes,
 		video.UserID,
 		video.ID,
+	}
+	if checkVersion {
+		query += ` AND version = ?`
+		args = append(args, video.Version)
+	}
+	result, err := c.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UpdateProcessedVideo saves what processing produced for video: its
+// stored files, status and what was probed from it. Title, description,
+// captions and a thumbnail, all of which can change while it's being
+// processed, are left as they are, and a generated thumbnail is only saved
+// if the video still has none. It returns the video as now saved.
+func (c Client) UpdateProcessedVideo(video Video) (Video, error) {
+	query := `
+	UPDATE videos
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		version = version + 1,
+		thumbnail_url = CASE WHEN thumbnail_url IS NULL THEN ? ELSE thumbnail_url END,
+		thumbnails = CASE WHEN thumbnail_url IS NULL THEN ? ELSE thumbnails END,
+		thumbnail_bytes = CASE WHEN thumbnail_url IS NULL THEN ? ELSE thumbnail_bytes END,
+		video_url = ?,
+		renditions = ?,
+		hls_playlist_url = ?,
+		sprite_sheet_url = ?,
+		sprite_vtt_url = ?,
+		duration = ?,
+		status = ?,
+		file_size = ?,
+		storage_class = ?,
+		content_hash = ?,
+		format_name = ?,
+		video_codec = ?,
+		width = ?,
+		height = ?,
+		original_url = ?,
+		original_media_type = ?,
+		normalize_audio = ?,
+		rotation = ?,
+		derived_bytes = ?
+	WHERE id = ?
+	`
+
+	thumbnails, err := marshalNullableJSON(len(video.Thumbnails), video.Thumbnails)
+	if err != nil {
+		return Video{}, err
+	}
+	renditions, err := marshalNullableJSON(len(video.Renditions), video.Renditions)
+	if err != nil {
+		return Video{}, err
+	}
+
+	_, err = c.db.Exec(query,
+		&video.ThumbnailURL,
+		thumbnails,
+		video.ThumbnailBytes,
+		&video.VideoURL,
+		renditions,
+		&video.HLSPlaylistURL,
+		&video.SpriteSheetURL,
+		&video.SpriteVTTURL,
+		video.Duration,
+		video.Status,
+		video.FileSize,
+		video.StorageClass,
+		video.ContentHash,
+		video.FormatName,
+		video.VideoCodec,
+		video.Width,
+		video.Height,
+		&video.OriginalURL,
+		video.OriginalMediaType,
+		video.NormalizeAudio,
+		video.Rotation,
+		video.DerivedBytes,
+		video.ID,
 	)
+	if err != nil {
+		return Video{}, err
+	}
+	return c.GetVideoIncludingDeleted(video.ID)
+}
+
+// UpdateVideoThumbnail saves video's thumbnail, every size of it, and
+// returns the video as now saved
+func (c Client) UpdateVideoThumbnail(video Video) (Video, error) {
+	query := `
+	UPDATE videos
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		version = version + 1,
+		thumbnail_url = ?,
+		thumbnails = ?,
+		thumbnail_bytes = ?
+	WHERE id = ?
+	`
+
+	thumbnails, err := marshalNullableJSON(len(video.Thumbnails), video.Thumbnails)
+	if err != nil {
+		return Video{}, err
+	}
+	if _, err := c.db.Exec(query, &video.ThumbnailURL, thumbnails, video.ThumbnailBytes, video.ID); err != nil {
+		return Video{}, err
+	}
+	return c.GetVideoIncludingDeleted(video.ID)
+}
+
+// UpdateVideoCaptions saves video's caption tracks and returns the video
+// as now saved
+func (c Client) UpdateVideoCaptions(video Video) (Video, error) {
+	query := `
+	UPDATE videos
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		version = version + 1,
+		captions = ?
+	WHERE id = ?
+	`
+
+	captions, err := marshalNullableJSON(len(video.Captions), video.Captions)
+	if err != nil {
+		return Video{}, err
+	}
+	if _, err := c.db.Exec(query, captions, video.ID); err != nil {
+		return Video{}, err
+	}
+	return c.GetVideoIncludingDeleted(video.ID)
+}
+
+// SetVideoStatus changes only the status of a video
+func (c Client) SetVideoStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET updated_at = CURRENT_TIMESTAMP, version = version + 1, status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
 	return err
 }
 
+// marshalNullableJSON stores empty lists as NULL
+func marshalNullableJSON(n int, v any) (*string, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(dat)
+	return &s, nil
+}
+
+// SoftDeleteVideo hides a video without touching its files
+func (c Client) SoftDeleteVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE videos SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, time.Now().UTC(), id)
+	return err
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE videos SET deleted_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// ListVideosDeletedBefore returns videos deleted before cutoff, oldest first
+func (c Client) ListVideosDeletedBefore(cutoff time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+	ORDER BY deleted_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, cutoff.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
@@ -4,21 +4,117 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
+	"unicode"
 )
 
+// Stable, machine readable error codes sent alongside the message. Clients
+// should key off these, the wording of messages may change.
+const (
+	errCodeInvalidID           = "INVALID_ID"
+	errCodeUnauthorized        = "UNAUTHORIZED"
+	errCodeInvalidAPIKey       = "INVALID_API_KEY"
+	errCodeVideoNotFound       = "VIDEO_NOT_FOUND"
+	errCodeUploadNotFound      = "UPLOAD_NOT_FOUND"
+	errCodeUploadIncomplete    = "UPLOAD_INCOMPLETE"
+	errCodeShareLinkNotFound   = "SHARE_LINK_NOT_FOUND"
+	errCodeUserNotFound        = "USER_NOT_FOUND"
+	errCodeGrantNotFound       = "GRANT_NOT_FOUND"
+	errCodeInvalidRole         = "INVALID_ROLE"
+	errCodeNotOwner            = "NOT_OWNER"
+	errCodeInvalidForm         = "INVALID_FORM"
+	errCodeInvalidJSON         = "INVALID_JSON"
+	errCodeUnknownField        = "UNKNOWN_FIELD"
+	errCodeBodyTooLarge        = "BODY_TOO_LARGE"
+	errCodeMissingFile         = "MISSING_FILE"
+	errCodeMissingContentType  = "MISSING_CONTENT_TYPE"
+	errCodeInvalidMediaType    = "INVALID_MEDIA_TYPE"
+	errCodeContentMismatch     = "CONTENT_MISMATCH"
+	errCodeInvalidChecksum     = "INVALID_CHECKSUM"
+	errCodeChecksumMismatch    = "CHECKSUM_MISMATCH"
+	errCodeInvalidVideo        = "INVALID_VIDEO"
+	errCodeNoVideoStream       = "NO_VIDEO_STREAM"
+	errCodeUnsupportedCodec    = "UNSUPPORTED_CODEC"
+	errCodeFileTooLarge        = "FILE_TOO_LARGE"
+	errCodeImageTooLarge       = "IMAGE_TOO_LARGE"
+	errCodeInvalidImage        = "INVALID_IMAGE"
+	errCodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	errCodeInvalidStorageClass = "INVALID_STORAGE_CLASS"
+	errCodeInvalidRegion       = "INVALID_REGION"
+	errCodeInvalidSourceURL    = "INVALID_SOURCE_URL"
+	errCodeInvalidCaptions     = "INVALID_CAPTIONS"
+	errCodeInvalidLanguage     = "INVALID_LANGUAGE"
+	errCodeSourceUnavailable   = "SOURCE_UNAVAILABLE"
+	errCodeQueueFull           = "QUEUE_FULL"
+	errCodeAlreadyProcessing   = "ALREADY_PROCESSING"
+	errCodeNoOriginal          = "NO_ORIGINAL"
+	errCodeInvalidRotation     = "INVALID_ROTATION"
+	errCodeBadIdempotencyKey   = "INVALID_IDEMPOTENCY_KEY"
+	errCodeIdempotencyKeyUsed  = "IDEMPOTENCY_KEY_REUSED"
+	errCodeMissingIfMatch      = "PRECONDITION_REQUIRED"
+	errCodeVersionMismatch     = "PRECONDITION_FAILED"
+	errCodeRateLimited         = "RATE_LIMITED"
+	errCodeInvalidPartNumber   = "INVALID_PART_NUMBER"
+	errCodeLengthRequired      = "LENGTH_REQUIRED"
+	errCodeNoParts             = "NO_PARTS"
+	errCodeNotSupported        = "NOT_SUPPORTED"
+	errCodeProcessingFailed    = "PROCESSING_FAILED"
+	errCodeProcessingTimeout   = "PROCESSING_TIMEOUT"
+	errCodeMediaBusy           = "MEDIA_BUSY"
+	errCodeStorageError        = "STORAGE_ERROR"
+	errCodeAssetUnavailable    = "ASSET_UNAVAILABLE"
+	errCodeInternal            = "INTERNAL_ERROR"
+)
+
+// respondWithError picks a generic code from the status, e.g. "NOT_FOUND".
+// Use respondWithErrorCode where the client needs something more specific.
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	respondWithErrorCode(w, code, statusErrorCode(code), msg, err)
+}
+
+// respondWithErrorCode sends msg, written in English, in the language the
+// request asked for if a catalog has errCode in it
+func respondWithErrorCode(w http.ResponseWriter, status int, errCode, msg string, err error) {
+	respondWithErrorFields(w, status, errCode, msg, err, nil)
+}
+
+// respondWithErrorFields is respondWithErrorCode for errors the client
+// gets more detail on, e.g. the usage a quota error was over, sent
+// alongside the code in fields
+func respondWithErrorFields(w http.ResponseWriter, status int, errCode, msg string, err error, fields map[string]any) {
 	if err != nil {
 		log.Println(err)
 	}
-	if code > 499 {
+	if status > 499 {
 		log.Printf("Responding with 5XX error: %s", msg)
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	localized, language := localizeMessage(w, errCode, msg)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", language)
+	body := map[string]any{}
+	for k, v := range fields {
+		body[k] = v
+	}
+	body["error"] = localized
+	body["code"] = errCode
+	// Set by requestLogger, quoted by users in support tickets
+	if requestID := w.Header().Get(requestIDHeader); requestID != "" {
+		body["request_id"] = requestID
+	}
+	respondWithJSON(w, status, body)
+}
+
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return errCodeInternal
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, text)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBodyBytes caps the JSON bodies endpoints take. The biggest are
+// bulk deletes, a few thousand video IDs fit.
+const maxJSONBodyBytes = 1 << 20 // 1 MB
+
+// jsonBodyError is why a request body couldn't be decoded. It's always the
+// client's fault, so it's answered with a 400 and message.
+type jsonBodyError struct {
+	code    string
+	message string
+	err     error
+}
+
+func (e *jsonBodyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *jsonBodyError) Unwrap() error {
+	return e.err
+}
+
+// decodeJSONBody decodes a body holding a single JSON object into dst,
+// turning down fields dst doesn't have and bodies over maxJSONBodyBytes.
+// Failures are a *jsonBodyError, wrapping io.EOF if the body was empty.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	return decodeJSONBodyLimit(w, r, dst, maxJSONBodyBytes)
+}
+
+// decodeJSONBodyLimit is decodeJSONBody for bodies allowed up to limit bytes
+func decodeJSONBodyLimit(w http.ResponseWriter, r *http.Request, dst any, limit int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		return jsonDecodeError(err)
+	}
+
+	// Whatever follows the object would otherwise be silently ignored
+	err := decoder.Decode(&json.RawMessage{})
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return jsonDecodeError(err)
+	}
+	if err == nil {
+		err = errors.New("trailing data after JSON object")
+	}
+	return &jsonBodyError{errCodeInvalidJSON, "Request body must hold a single JSON object", err}
+}
+
+func jsonDecodeError(err error) *jsonBodyError {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &jsonBodyError{errCodeBodyTooLarge, fmt.Sprintf("Request body must be at most %d bytes", maxBytesErr.Limit), err}
+	case errors.As(err, &syntaxErr):
+		return &jsonBodyError{errCodeInvalidJSON, fmt.Sprintf("Request body has malformed JSON at byte %d", syntaxErr.Offset), err}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &jsonBodyError{errCodeInvalidJSON, "Request body has malformed JSON", err}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &jsonBodyError{errCodeInvalidJSON, "Request body must be a JSON object", err}
+		}
+		return &jsonBodyError{errCodeInvalidJSON, fmt.Sprintf("Request body has the wrong type for field %q", typeErr.Field), err}
+	case errors.Is(err, io.EOF):
+		return &jsonBodyError{errCodeInvalidJSON, "Request body must not be empty", err}
+	}
+	// encoding/json has no type for this one
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &jsonBodyError{errCodeUnknownField, fmt.Sprintf("Request body has unknown field %s", field), err}
+	}
+	// e.g. a malformed UUID or timestamp
+	return &jsonBodyError{errCodeInvalidJSON, "Couldn't decode parameters", err}
+}
+
+func respondWithJSONBodyError(w http.ResponseWriter, err error) {
+	var bodyErr *jsonBodyError
+	if errors.As(err, &bodyErr) {
+		respondWithErrorCode(w, http.StatusBadRequest, bodyErr.code, bodyErr.message, bodyErr.err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidJSON, "Couldn't decode parameters", err)
+}
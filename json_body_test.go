@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	type params struct {
+		Title   string    `json:"title"`
+		Count   int       `json:"count"`
+		VideoID uuid.UUID `json:"video_id"`
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		limit       int64 // maxJSONBodyBytes if 0
+		wantCode    string
+		wantMessage string
+		wantEOF     bool
+	}{
+		{
+			name: "valid object",
+			body: `{"title":"A video","count":2}`,
+		},
+		{
+			name: "valid object and trailing whitespace",
+			body: "{\"title\":\"A video\"}\n\n",
+		},
+		{
+			name:        "empty body",
+			body:        "",
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body must not be empty",
+			wantEOF:     true,
+		},
+		{
+			name:        "syntax error",
+			body:        `{"title":"A video",}`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body has malformed JSON at byte 20",
+		},
+		{
+			name:        "truncated object",
+			body:        `{"title":"A vid`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body has malformed JSON",
+		},
+		{
+			name:        "unknown field",
+			body:        `{"title":"A video","owner":"someone"}`,
+			wantCode:    errCodeUnknownField,
+			wantMessage: `Request body has unknown field "owner"`,
+		},
+		{
+			name:        "wrong type for a field",
+			body:        `{"count":"two"}`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: `Request body has the wrong type for field "count"`,
+		},
+		{
+			name:        "array instead of an object",
+			body:        `[{"title":"A video"}]`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body must be a JSON object",
+		},
+		{
+			name:        "two objects",
+			body:        `{"title":"A video"}{"title":"Another"}`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body must hold a single JSON object",
+		},
+		{
+			name:        "trailing garbage",
+			body:        `{"title":"A video"} and more`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Request body must hold a single JSON object",
+		},
+		{
+			name:        "malformed UUID",
+			body:        `{"video_id":"not-a-uuid"}`,
+			wantCode:    errCodeInvalidJSON,
+			wantMessage: "Couldn't decode parameters",
+		},
+		{
+			name:        "too large",
+			body:        `{"title":"` + strings.Repeat("a", 64) + `"}`,
+			limit:       32,
+			wantCode:    errCodeBodyTooLarge,
+			wantMessage: "Request body must be at most 32 bytes",
+		},
+		{
+			name:        "too large after the object",
+			body:        `{"title":"A video"}` + strings.Repeat(" ", 64),
+			limit:       32,
+			wantCode:    errCodeBodyTooLarge,
+			wantMessage: "Request body must be at most 32 bytes",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			limit := tc.limit
+			if limit == 0 {
+				limit = maxJSONBodyBytes
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+
+			var dst params
+			err := decodeJSONBodyLimit(w, r, &dst, limit)
+			if tc.wantCode == "" {
+				if err != nil {
+					t.Fatalf("decodeJSONBody: %v", err)
+				}
+				if dst.Title != "A video" {
+					t.Errorf("title = %q, want %q", dst.Title, "A video")
+				}
+				return
+			}
+
+			var bodyErr *jsonBodyError
+			if !errors.As(err, &bodyErr) {
+				t.Fatalf("decodeJSONBody error = %v, want a *jsonBodyError", err)
+			}
+			if bodyErr.code != tc.wantCode || bodyErr.message != tc.wantMessage {
+				t.Errorf("error = %s %q, want %s %q", bodyErr.code, bodyErr.message, tc.wantCode, tc.wantMessage)
+			}
+			if errors.Is(err, io.EOF) != tc.wantEOF {
+				t.Errorf("error wraps io.EOF: %v, want %v", errors.Is(err, io.EOF), tc.wantEOF)
+			}
+
+			respondWithJSONBodyError(w, err)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var resp struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if resp.Code != tc.wantCode || resp.Error != tc.wantMessage {
+				t.Errorf("response = %s %q, want %s %q", resp.Code, resp.Error, tc.wantCode, tc.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// keyedLocks is a mutex per name. Entries only live while someone holds or
+// waits for them.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu sync.Mutex
+	// refs counts those holding or waiting for mu
+	refs int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*keyedLock)}
+}
+
+// lock blocks until nobody else holds name, and returns the function that
+// releases it
+func (l *keyedLocks) lock(name string) func() {
+	l.mu.Lock()
+	entry, ok := l.locks[name]
+	if !ok {
+		entry = &keyedLock{}
+		l.locks[name] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+		l.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
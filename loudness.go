@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// defaultLoudnessTarget is where streaming services commonly normalize
+	// to, in LUFS
+	defaultLoudnessTarget = -14.0
+	// loudnorm accepts integrated loudness targets in this range
+	minLoudnessTarget = -70.0
+	maxLoudnessTarget = -5.0
+)
+
+// audioCodecArgs are the ffmpeg arguments for the audio of a re-encoded
+// video. With normalizeAudio, loudnorm brings it to cfg.loudnessTarget.
+// loudnorm resamples internally, so the output rate is set back to 48kHz.
+func (cfg *apiConfig) audioCodecArgs(normalizeAudio bool) []string {
+	if !normalizeAudio {
+		return []string{"-c:a", "aac"}
+	}
+	return []string{
+		"-af", fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", cfg.loudnessTarget),
+		"-ar", "48000",
+		"-c:a", "aac",
+	}
+}
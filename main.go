@@ -3,16 +3,18 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type apiConfig struct {
@@ -21,86 +23,103 @@ type apiConfig struct {
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
-	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	ffmpegPath       string
+	ffprobePath      string
+	ffmpegTimeout    time.Duration
+	// transcodeTimeout bounds ffmpeg runs that decode a whole video, which
+	// take much longer than ffmpegTimeout allows
+	transcodeTimeout time.Duration
+	mediaLimiter     *mediaLimiter
+	// loudnessTarget is the integrated loudness, in LUFS, that uploads
+	// asking for normalized audio are brought to
+	loudnessTarget float64
+
+	maxVideoUploadBytes int64
+	storageQuotaBytes   int64
+	uploadLimiter       *rateLimiter
+	presignExpiry       time.Duration
+	presignCache        *presignCache
+	storageRegions      *storageRegions
+	// localStorage is the storage when STORAGE_BACKEND is local, served
+	// under /storage/, nil otherwise
+	localStorage     *localStorage
+	webhookURL       string
+	webhookSecret    string
+	videoJobs        chan videoJob
+	videoWorkers     int
+	videoProgress    *videoProgress
+	pendingVideoJobs *sync.WaitGroup
+	// videoRetention is how long deleted videos can be restored before
+	// they're purged
+	videoRetention time.Duration
+	cors           corsConfig
+	// assetCDNBaseURL, if set, is the CDN asset URLs point at, with no
+	// trailing slash
+	assetCDNBaseURL string
+	// publicBaseURL is where clients reach this server, with no trailing
+	// slash, for the URLs it hands out that point back at it
+	publicBaseURL string
+	// defaultThumbnail, if set, is the URL, or asset name, of the image
+	// videos without a thumbnail are sent with
+	defaultThumbnail string
+	// thumbnailsInStorage keeps thumbnails in the default region's storage,
+	// presigned like videos, instead of the local assets directory
+	thumbnailsInStorage bool
+	// thumbnailJPEGQuality is what JPEG thumbnails are encoded at, 1-100
+	thumbnailJPEGQuality int
+	// allowedThumbnailTypes are the media types thumbnails may be uploaded
+	// as, some of supportedThumbnailTypes
+	allowedThumbnailTypes []string
+	// thumbnailMaxBytes, if set, is the most a stored thumbnail size may
+	// take up. Bigger ones are re-encoded down to fit.
+	thumbnailMaxBytes int64
+	// keepOriginals stores each upload as received next to its processed
+	// video, so it can be reprocessed later
+	keepOriginals bool
+	// tempDir is where uploads are staged and processed, the system temp
+	// directory if empty
+	tempDir string
+	// tempFileMaxAge is how long files of ours are left in tempDir before
+	// they're taken for leftovers of a crash and deleted
+	tempFileMaxAge time.Duration
+	// unsupportedCodecPolicy is codecPolicyReject or codecPolicyTranscode,
+	// for videos in a codec browsers can't play
+	unsupportedCodecPolicy string
+	// maxVideoBitrate, if set, is the bits/s videos over it are re-encoded
+	// down to
+	maxVideoBitrate int64
+	// idempotencyKeyTTL is how long a retried upload is answered from the
+	// first request with its Idempotency-Key
+	idempotencyKeyTTL time.Duration
+	idempotencyLocks  *keyedLocks
+	// objectTags are added to the tags of every stored video object
+	objectTags map[string]string
+	// missingObjects, set when VERIFY_STORED_OBJECTS is, remembers stored
+	// objects found missing before signing them
+	missingObjects *missingObjectCache
+	// purgeLocks keeps videos sharing stored objects from being purged at
+	// the same time
+	purgeLocks *keyedLocks
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	// e.g. "debug" to include the full output of failed ffmpeg runs
+	var logLevel slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			log.Fatalf("LOG_LEVEL must be debug, info, warn or error, got %q", v)
+		}
 	}
+	slog.SetDefault(slog.New(contextLogHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})}))
 
-	db, err := database.NewClient(pathToDB)
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
-	}
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
-	}
-
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
-	}
-
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
-	}
-
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
-	}
-
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
-	}
-
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
-	}
-
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
-	}
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
-	}
-
-	// Load AWS configuration (automatically uses credentials from `aws configure`)
-	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
-	if err != nil {
-		log.Fatalf("Unable to load AWS SDK config: %v", err)
-	}
-
-	// Create S3 client from configuration
-	s3Client := s3.NewFromConfig(awsCfg)
-
-	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -108,33 +127,90 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	cfg.startVideoWorkers(workerCtx, cfg.videoWorkers)
+
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.HandleFunc("GET /assets/{assetPath}", cfg.handlerAssetGet)
+
+	if cfg.localStorage != nil {
+		mux.Handle("/storage/", http.StripPrefix("/storage", cfg.localStorage))
+	}
+
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.Handle("GET /metrics", promhttp.Handler())
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/api_keys", cfg.handlerAPIKeyCreate)
+	mux.HandleFunc("DELETE /api/api_keys/{keyID}", cfg.handlerAPIKeyRevoke)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/thumbnail_upload/batch", cfg.handlerBatchUploadThumbnails)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/generate", cfg.handlerGenerateThumbnail)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerUploadCaptions)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("POST /api/video_upload/url", cfg.handlerUploadVideoFromURL)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart", cfg.handlerInitiateUpload)
+	mux.HandleFunc("PUT /api/video_upload/{videoID}/multipart/{uploadID}/parts/{partNumber}", cfg.handlerUploadPart)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart/{uploadID}/complete", cfg.handlerCompleteUpload)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/upload_url", cfg.handlerCreateUploadURL)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/upload_url/{uploadID}/finalize", cfg.handlerFinalizeUpload)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/upload_policy", cfg.handlerCreatePostPolicy)
+	mux.HandleFunc("GET /api/videos", cfg.handlerListVideos)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("HEAD /api/videos/{videoID}", cfg.handlerVideoHead)
+	mux.HandleFunc("PUT /api/videos/{videoID}", cfg.handlerUpdateVideoMetadata)
+	mux.HandleFunc("GET /api/videos/{videoID}/playlist.m3u8", cfg.handlerVideoPlaylist)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerStreamVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerDeleteVideo)
+	mux.HandleFunc("POST /api/videos/bulk_delete", cfg.handlerBulkDeleteVideos)
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerRestoreVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/reprocess", cfg.handlerReprocessVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/rotate", cfg.handlerRotateVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/share_links", cfg.handlerCreateShareLink)
+	mux.HandleFunc("DELETE /api/share_links/{shareID}", cfg.handlerRevokeShareLink)
+	mux.HandleFunc("GET /api/videos/{videoID}/permissions", cfg.handlerListVideoPermissions)
+	mux.HandleFunc("PUT /api/videos/{videoID}/permissions/{userID}", cfg.handlerGrantVideoPermission)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/permissions/{userID}", cfg.handlerRevokeVideoPermission)
+	mux.HandleFunc("GET /share/{token}", cfg.handlerGetSharedVideo)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /admin/audit", cfg.handlerListAudit)
 
+	requests := &requestTracker{}
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:    ":" + cfg.port,
+		Handler: requests.middleware(requestLogger(cfg.jwtSecret, cfg.corsMiddleware(cfg.tenantMiddleware(languageMiddleware(gzipMiddleware(mux)))))),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg.startVideoReaper(ctx, cfg.videoRetention)
+	cfg.startTempSweeper(ctx, cfg.tempFileMaxAge)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	log.Printf("Serving on: %s\n", cfg.publicURL("/app/"))
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-ctx.Done():
 	}
+	stop()
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	cfg.shutdown(srv, requests, cancelWorkers)
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	testJWTSecret = "test-secret"
+	testRegion    = "us-east-1"
+	testBucket    = "tubely-test"
+)
+
+// testProbeOutput is what the fake ffprobe of newTestConfig reports: a
+// 3 second 1280x720 H.264 MP4 with an audio track
+const testProbeOutput = `{"streams":[{"codec_type":"video","codec_name":"h264","width":1280,"height":720,"bit_rate":"1000000"},{"codec_type":"audio","codec_name":"aac"}],"format":{"format_name":"mov,mp4,m4a,3gp,3g2,mj2","duration":"3.000000","size":"4096","bit_rate":"1100000"}}`
+
+// testFFmpegScript stands in for ffmpeg by creating an empty output file,
+// the last argument, and an HLS segment if it's asked for segments
+const testFFmpegScript = `for a; do
+	last=$a
+	case "$a" in *segment_%05d.ts) touch "$(dirname "$a")/segment_00000.ts";; esac
+done
+touch "$last"`
+
+// newTestConfig is an apiConfig backed by a fresh SQLite database, a fake
+// S3 bucket and fake ffmpeg and ffprobe binaries, nothing outside the
+// test's temp directories
+func newTestConfig(t *testing.T) (*apiConfig, *fakeS3) {
+	t.Helper()
+
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+
+	bucket := newFakeS3()
+	storage := newS3Storage(bucket, fakePresigner{}, testBucket, nil, "", 1)
+	regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+	if err != nil {
+		t.Fatalf("couldn't create storage regions: %v", err)
+	}
+
+	return &apiConfig{
+		db:                     db,
+		jwtSecret:              testJWTSecret,
+		platform:               "dev",
+		assetsRoot:             t.TempDir(),
+		s3Region:               testRegion,
+		port:                   "8091",
+		publicBaseURL:          "http://localhost:8091",
+		ffmpegPath:             writeFakeCommand(t, "ffmpeg", testFFmpegScript),
+		ffprobePath:            writeFakeCommand(t, "ffprobe", "echo '"+testProbeOutput+"'"),
+		ffmpegTimeout:          time.Minute,
+		transcodeTimeout:       time.Minute,
+		mediaLimiter:           newMediaLimiter(2, time.Second),
+		loudnessTarget:         defaultLoudnessTarget,
+		maxVideoUploadBytes:    1 << 30,
+		storageQuotaBytes:      10 << 30,
+		uploadLimiter:          newRateLimiter(100, time.Minute),
+		presignExpiry:          time.Hour,
+		presignCache:           newPresignCache(16),
+		storageRegions:         regions,
+		videoJobs:              make(chan videoJob, 4),
+		videoWorkers:           1,
+		videoProgress:          newVideoProgress(),
+		pendingVideoJobs:       &sync.WaitGroup{},
+		videoRetention:         24 * time.Hour,
+		thumbnailJPEGQuality:   defaultThumbnailJPEGQuality,
+		allowedThumbnailTypes:  supportedThumbnailTypes,
+		tempDir:                t.TempDir(),
+		tempFileMaxAge:         time.Hour,
+		unsupportedCodecPolicy: codecPolicyTranscode,
+		idempotencyKeyTTL:      time.Hour,
+		idempotencyLocks:       newKeyedLocks(),
+		purgeLocks:             newKeyedLocks(),
+	}, bucket
+}
+
+// writeFakeCommand writes a shell script standing in for name, ffmpeg or
+// ffprobe, and returns its path
+func writeFakeCommand(t *testing.T, name, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatalf("couldn't write fake %s: %v", name, err)
+	}
+	return path
+}
+
+// setFakeProbe makes cfg's ffprobe report output, ffprobe JSON, for
+// every file
+func setFakeProbe(t *testing.T, cfg *apiConfig, output string) {
+	t.Helper()
+	cfg.ffprobePath = writeFakeCommand(t, "ffprobe", "echo '"+output+"'")
+}
+
+// recordFFmpegRuns makes cfg's fake ffmpeg log its arguments, and returns
+// a function listing them, one line per run so far
+func recordFFmpegRuns(t *testing.T, cfg *apiConfig) func() []string {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "ffmpeg.log")
+	cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", `echo "$*" >> '`+logPath+"'\n"+testFFmpegScript)
+	return func() []string {
+		data, err := os.ReadFile(logPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("couldn't read ffmpeg log: %v", err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// runQueuedVideoJobs processes every job queued on cfg, as the workers
+// would
+func runQueuedVideoJobs(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+	for len(cfg.videoJobs) > 0 {
+		cfg.runVideoJob(context.Background(), <-cfg.videoJobs)
+		cfg.pendingVideoJobs.Done()
+	}
+}
+
+// createTestUser adds a user to cfg's database and returns its ID
+func createTestUser(t *testing.T, cfg *apiConfig, email string) uuid.UUID {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: email, Password: "unused"})
+	if err != nil {
+		t.Fatalf("couldn't create user: %v", err)
+	}
+	return user.ID
+}
+
+// createTestVideo adds a video owned by userID and returns it
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test video", UserID: userID})
+	if err != nil {
+		t.Fatalf("couldn't create video: %v", err)
+	}
+	return video
+}
+
+// authorizeTestRequest sets a bearer JWT for userID on r
+func authorizeTestRequest(t *testing.T, r *http.Request, userID uuid.UUID) {
+	t.Helper()
+	token, err := auth.MakeJWT(userID, "", "", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't make JWT: %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errMediaTimeout = errors.New("timed out")
+
+// How much of ffmpeg's stderr makes it into error messages. Its last lines
+// are the ones saying why it gave up.
+const mediaStderrTailBytes = 1024
+
+// mediaCommandError keeps everything a failed ffmpeg or ffprobe run wrote to
+// stderr, the error message only includes the tail of it
+type mediaCommandError struct {
+	err    error
+	stderr string
+}
+
+func (e *mediaCommandError) Error() string {
+	tail := strings.TrimSpace(e.stderr)
+	if tail == "" {
+		return e.err.Error()
+	}
+	if len(tail) > mediaStderrTailBytes {
+		tail = "..." + tail[len(tail)-mediaStderrTailBytes:]
+	}
+	return fmt.Sprintf("%v: %s", e.err, tail)
+}
+
+func (e *mediaCommandError) Unwrap() error {
+	return e.err
+}
+
+// mediaCmd is an ffmpeg or ffprobe invocation bounded by a timeout and
+// counted against cfg.mediaLimiter
+type mediaCmd struct {
+	*exec.Cmd
+	cancel  context.CancelFunc
+	timeout time.Duration
+	limiter *mediaLimiter
+}
+
+// mediaCommand is exec.Command for ffmpeg and ffprobe. A file that makes
+// them hang gets the process, and anything it spawned, killed once
+// cfg.ffmpegTimeout passes.
+func (cfg *apiConfig) mediaCommand(name string, args ...string) *mediaCmd {
+	// The timeout only starts once Run gets a slot, so it's a plain cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroupOnCancel(cmd)
+	// Don't wait forever on output pipes held open by orphaned children
+	cmd.WaitDelay = 5 * time.Second
+	return &mediaCmd{Cmd: cmd, cancel: cancel, timeout: cfg.ffmpegTimeout, limiter: cfg.mediaLimiter}
+}
+
+// transcodeCommand is mediaCommand for runs that decode the whole video,
+// such as re-encodes, which take as long as the video does. They're bounded
+// by cfg.transcodeTimeout instead.
+func (cfg *apiConfig) transcodeCommand(name string, args ...string) *mediaCmd {
+	cmd := cfg.mediaCommand(name, args...)
+	cmd.timeout = cfg.transcodeTimeout
+	return cmd
+}
+
+// Run waits for a free slot, returning errMediaBusy if none frees up in
+// time. It reports a killed command as errMediaTimeout, and any failure as
+// a *mediaCommandError carrying the command's stderr.
+func (c *mediaCmd) Run() error {
+	defer c.cancel()
+	if c.limiter != nil {
+		if err := c.limiter.acquire(); err != nil {
+			return err
+		}
+		defer c.limiter.release()
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(c.timeout, func() {
+		timedOut.Store(true)
+		c.cancel()
+	})
+	defer timer.Stop()
+
+	var stderr bytes.Buffer
+	if c.Stderr == nil {
+		c.Stderr = &stderr
+	}
+	err := c.Cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if timedOut.Load() {
+		err = fmt.Errorf("%w after %s: %v", errMediaTimeout, c.timeout, err)
+	}
+	return &mediaCommandError{err: err, stderr: stderr.String()}
+}
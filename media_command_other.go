@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// Without process groups only ffmpeg itself is killed, which is
+// exec.CommandContext's default
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestProcessVideoForFastStartTimeout(t *testing.T) {
+	tests := []struct {
+		name             string
+		sleep            string // seconds the fake ffmpeg runs for
+		transcode        bool
+		ffmpegTimeout    time.Duration
+		transcodeTimeout time.Duration
+		wantTimeout      bool
+	}{
+		{
+			name:             "hung faststart copy is killed",
+			sleep:            "30",
+			ffmpegTimeout:    100 * time.Millisecond,
+			transcodeTimeout: time.Minute,
+			wantTimeout:      true,
+		},
+		{
+			name:             "transcode outlasting FFMPEG_TIMEOUT finishes",
+			sleep:            "0.5",
+			transcode:        true,
+			ffmpegTimeout:    100 * time.Millisecond,
+			transcodeTimeout: time.Minute,
+		},
+		{
+			name:             "hung transcode is killed",
+			sleep:            "30",
+			transcode:        true,
+			ffmpegTimeout:    time.Minute,
+			transcodeTimeout: 100 * time.Millisecond,
+			wantTimeout:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			// The sleep is a child of the script, so it only dies this
+			// quickly if the whole process group is killed
+			cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", "sleep "+tc.sleep+"\n"+testFFmpegScript)
+			cfg.ffmpegTimeout = tc.ffmpegTimeout
+			cfg.transcodeTimeout = tc.transcodeTimeout
+
+			srcPath := filepath.Join(t.TempDir(), "upload.mp4")
+			if err := os.WriteFile(srcPath, []byte("an upload"), 0o600); err != nil {
+				t.Fatalf("couldn't write upload: %v", err)
+			}
+
+			start := time.Now()
+			processedPath, err := cfg.processVideoForFastStart(uuid.New(), srcPath, "video/mp4", 3, false, tc.transcode, 0)
+			elapsed := time.Since(start)
+
+			if got := errors.Is(err, errMediaTimeout); got != tc.wantTimeout {
+				t.Fatalf("processVideoForFastStart error = %v, want timeout: %v", err, tc.wantTimeout)
+			}
+			if !tc.wantTimeout {
+				if err != nil {
+					t.Fatalf("processVideoForFastStart: %v", err)
+				}
+				os.Remove(processedPath)
+				return
+			}
+			if elapsed > 3*time.Second {
+				t.Errorf("timed out run took %s to return", elapsed)
+			}
+			if _, err := os.Stat(srcPath + ".processing"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("timed out run left its output behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoProbeTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		probe      string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "ffprobe within the timeout",
+			probe:      "echo '" + testProbeOutput + "'",
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "hung ffprobe",
+			probe:      "sleep 30",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeProcessingTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.ffprobePath = writeFakeCommand(t, "ffprobe", tc.probe)
+			cfg.ffmpegTimeout = 200 * time.Millisecond
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+		})
+	}
+}
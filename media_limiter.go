@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errMediaBusy = errors.New("too many ffmpeg jobs running")
+
+// mediaBusyRetryAfter is what clients turned away by a full mediaLimiter
+// are told to wait
+const mediaBusyRetryAfter = 30 * time.Second
+
+// mediaLimiter caps how many ffmpeg and ffprobe processes run at once, each
+// one can use a lot of memory on a large upload
+type mediaLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newMediaLimiter(maxJobs int, timeout time.Duration) *mediaLimiter {
+	return &mediaLimiter{slots: make(chan struct{}, maxJobs), timeout: timeout}
+}
+
+// acquire waits up to l.timeout for a free slot, returning errMediaBusy if
+// none frees up. Every successful acquire must be paired with a release.
+func (l *mediaLimiter) acquire() error {
+	select {
+	case l.slots <- struct{}{}:
+		ffmpegJobsRunning.Inc()
+		return nil
+	default:
+	}
+
+	ffmpegJobsWaiting.Inc()
+	defer ffmpegJobsWaiting.Dec()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		ffmpegJobsRunning.Inc()
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w, waited %s", errMediaBusy, l.timeout)
+	}
+}
+
+func (l *mediaLimiter) release() {
+	<-l.slots
+	ffmpegJobsRunning.Dec()
+}
+
+// setMediaBusyRetryAfter tells the client when to retry if err is due to
+// the mediaLimiter being full
+func setMediaBusyRetryAfter(w http.ResponseWriter, err error) {
+	if errors.Is(err, errMediaBusy) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(mediaBusyRetryAfter.Seconds())))
+	}
+}
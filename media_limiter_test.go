@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMediaLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxJobs     int
+		held        int
+		releaseHeld time.Duration // after which one held slot is released, never if 0
+		timeout     time.Duration
+		wantErr     error
+		wantBlocked bool
+	}{
+		{
+			name:    "free slot is taken at once",
+			maxJobs: 2,
+			held:    1,
+			timeout: time.Second,
+		},
+		{
+			name:        "N+1th job waits for a release",
+			maxJobs:     2,
+			held:        2,
+			releaseHeld: 100 * time.Millisecond,
+			timeout:     5 * time.Second,
+			wantBlocked: true,
+		},
+		{
+			name:    "N+1th job gives up at the timeout",
+			maxJobs: 2,
+			held:    2,
+			timeout: 100 * time.Millisecond,
+			wantErr: errMediaBusy,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := newMediaLimiter(tc.maxJobs, tc.timeout)
+			for i := range tc.held {
+				if err := limiter.acquire(); err != nil {
+					t.Fatalf("acquire %d: %v", i, err)
+				}
+			}
+			if tc.releaseHeld > 0 {
+				timer := time.AfterFunc(tc.releaseHeld, limiter.release)
+				defer timer.Stop()
+			}
+
+			start := time.Now()
+			err := limiter.acquire()
+			waited := time.Since(start)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("acquire error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantBlocked && waited < tc.releaseHeld {
+				t.Errorf("acquire returned after %s, before a slot was released", waited)
+			}
+			if !tc.wantBlocked && tc.wantErr == nil && waited > tc.timeout/2 {
+				t.Errorf("acquire of a free slot took %s", waited)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoMediaBusy(t *testing.T) {
+	tests := []struct {
+		name           string
+		held           int
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			name:       "slot free",
+			held:       1,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:           "every slot taken",
+			held:           2,
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "30",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.mediaLimiter = newMediaLimiter(2, 50*time.Millisecond)
+			for range tc.held {
+				if err := cfg.mediaLimiter.acquire(); err != nil {
+					t.Fatalf("acquire: %v", err)
+				}
+			}
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tc.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tc.wantRetryAfter)
+			}
+		})
+	}
+}
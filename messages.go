@@ -0,0 +1,176 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is what error messages are written in where they're
+// sent, and what requests get unless they ask for one we have a catalog
+// for
+const defaultLanguage = "en"
+
+// messageFiles are the catalogs of error messages, one per language named
+// after its tag, e.g. messages/es.json or messages/pt-BR.json. Each maps
+// error codes to the message sent with them. The English catalog lists
+// every code and is what the others are translated from. Adding a
+// language is adding its file.
+//
+//go:embed messages/*.json
+var messageFiles embed.FS
+
+type messageCatalog map[string]string
+
+var messageCatalogs = mustLoadMessageCatalogs(messageFiles)
+
+func mustLoadMessageCatalogs(files fs.FS) map[string]messageCatalog {
+	catalogs, err := loadMessageCatalogs(files)
+	if err != nil {
+		panic(err)
+	}
+	return catalogs
+}
+
+// loadMessageCatalogs reads the catalogs in files by lowercased language
+// tag. Catalogs with codes the English one doesn't have, likely a typo,
+// fail it.
+func loadMessageCatalogs(files fs.FS) (map[string]messageCatalog, error) {
+	paths, err := fs.Glob(files, "messages/*.json")
+	if err != nil {
+		return nil, err
+	}
+	catalogs := map[string]messageCatalog{}
+	for _, p := range paths {
+		data, err := fs.ReadFile(files, p)
+		if err != nil {
+			return nil, err
+		}
+		catalog := messageCatalog{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("message catalog %s: %w", p, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(path.Base(p), ".json"))] = catalog
+	}
+
+	reference, ok := catalogs[defaultLanguage]
+	if !ok {
+		return nil, fmt.Errorf("no message catalog for %s", defaultLanguage)
+	}
+	for language, catalog := range catalogs {
+		for code := range catalog {
+			if _, ok := reference[code]; !ok {
+				return nil, fmt.Errorf("message catalog %s has unknown error code %s", language, code)
+			}
+		}
+	}
+	return catalogs, nil
+}
+
+// negotiateLanguage picks the catalog best matching an Accept-Language
+// header, e.g. "es-MX,es;q=0.9,en;q=0.5". Tags are tried by preference,
+// each as given and then by its primary language, so es-MX gets the
+// Spanish catalog if there's none for Mexico.
+func negotiateLanguage(header string) string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		pref := preference{tag: strings.ToLower(strings.TrimSpace(tag)), q: 1}
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					q = 0
+				}
+				pref.q = q
+			}
+		}
+		if pref.tag != "" && pref.q > 0 {
+			preferences = append(preferences, pref)
+		}
+	}
+	slices.SortStableFunc(preferences, func(a, b preference) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+
+	for _, pref := range preferences {
+		if pref.tag == "*" {
+			return defaultLanguage
+		}
+		if _, ok := messageCatalogs[pref.tag]; ok {
+			return pref.tag
+		}
+		if primary, _, ok := strings.Cut(pref.tag, "-"); ok {
+			if _, ok := messageCatalogs[primary]; ok {
+				return primary
+			}
+		}
+	}
+	return defaultLanguage
+}
+
+// languageWriter carries the language a request asked for down to
+// respondWithErrorCode, which only gets the ResponseWriter
+type languageWriter struct {
+	http.ResponseWriter
+	language string
+}
+
+func (lw *languageWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// languageMiddleware picks from the Accept-Language header which language
+// error messages are sent in
+func languageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&languageWriter{ResponseWriter: w, language: negotiateLanguage(r.Header.Get("Accept-Language"))}, r)
+	})
+}
+
+// responseLanguage is the language languageMiddleware picked for w, found
+// through whatever writers have wrapped it since
+func responseLanguage(w http.ResponseWriter) string {
+	for {
+		switch rw := w.(type) {
+		case *languageWriter:
+			return rw.language
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return defaultLanguage
+		}
+	}
+}
+
+// localizeMessage is msg, the message sent with errCode, in the language
+// picked for w. Catalogs have one message per code, so a translation is
+// more general than the message it stands for, e.g. it doesn't say which
+// limit a file went over. Requests in the default language, and codes a
+// catalog has no message for, keep msg.
+func localizeMessage(w http.ResponseWriter, errCode, msg string) (string, string) {
+	language := responseLanguage(w)
+	if language == defaultLanguage {
+		return msg, language
+	}
+	if localized, ok := messageCatalogs[language][errCode]; ok {
+		return localized, language
+	}
+	return msg, defaultLanguage
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics. Labels are limited to values
+// from fixed sets (allowedVideoTypes, results), never IDs, to keep the
+// number of series bounded.
+var (
+	videoUploadsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_video_uploads_started_total",
+		Help: "Video uploads received with an accepted media type.",
+	}, []string{"media_type"})
+	videoUploadsSucceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_video_uploads_succeeded_total",
+		Help: "Video uploads staged and queued for processing, or matched to an identical upload.",
+	}, []string{"media_type"})
+	videoUploadsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_video_uploads_failed_total",
+		Help: "Video uploads rejected or failed after their media type was accepted.",
+	}, []string{"media_type"})
+	videoUploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tubely_video_uploaded_bytes_total",
+		Help: "Bytes of video received from clients and staged in storage.",
+	})
+
+	ffmpegDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_ffmpeg_duration_seconds",
+		Help:    "Time spent in ffmpeg passes.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12), // 0.25s to ~8.5m
+	}, []string{"step", "result"})
+
+	ffmpegJobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tubely_ffmpeg_jobs_running",
+		Help: "ffmpeg and ffprobe processes currently holding a slot.",
+	})
+	ffmpegJobsWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tubely_ffmpeg_jobs_waiting",
+		Help: "ffmpeg and ffprobe runs waiting for a free slot.",
+	})
+
+	s3PutDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_s3_put_duration_seconds",
+		Help:    "Time taken by S3 uploads, retries included.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12), // 50ms to ~1.7m
+	}, []string{"result"})
+)
+
+func metricResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errAssetUnavailable is a stored object the database still points at
+// but that's gone from storage, deleted by hand or by a lifecycle rule
+var errAssetUnavailable = errors.New("asset no longer available")
+
+// videoStatusUnavailable is reported, never stored, for videos whose
+// playback file has gone missing from storage
+const videoStatusUnavailable = "unavailable"
+
+const (
+	// Missing objects are remembered this long, long enough to spare S3 a
+	// client's retries and short enough to notice a restored object
+	missingObjectTTL = 30 * time.Second
+	// Past this many remembered objects, expired ones are pruned
+	missingObjectCacheSize = 10000
+)
+
+// missingObjectCache remembers which objects were found missing, for a
+// short while
+type missingObjectCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	expires map[string]time.Time
+}
+
+func newMissingObjectCache(ttl time.Duration) *missingObjectCache {
+	return &missingObjectCache{ttl: ttl, expires: map[string]time.Time{}}
+}
+
+func (c *missingObjectCache) missing(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiresAt, ok := c.expires[key]
+	if ok && time.Now().After(expiresAt) {
+		delete(c.expires, key)
+		return false
+	}
+	return ok
+}
+
+func (c *missingObjectCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.expires) >= missingObjectCacheSize {
+		for k, expiresAt := range c.expires {
+			if now.After(expiresAt) {
+				delete(c.expires, k)
+			}
+		}
+	}
+	c.expires[key] = now.Add(c.ttl)
+}
+
+// checkObjectExists returns errAssetUnavailable if nothing is stored at
+// key. It costs a HEAD request per object, so it only runs when
+// VERIFY_STORED_OBJECTS is set.
+func (cfg *apiConfig) checkObjectExists(ctx context.Context, storage Storage, key string) error {
+	if cfg.missingObjects == nil {
+		return nil
+	}
+	cacheKey := storage.Bucket() + "/" + key
+	if cfg.missingObjects.missing(cacheKey) {
+		return errAssetUnavailable
+	}
+	_, err := storage.Head(ctx, key)
+	if errors.Is(err, errObjectNotFound) {
+		slog.WarnContext(ctx, "stored object is missing", "bucket", storage.Bucket(), "key", key)
+		cfg.missingObjects.add(cacheKey)
+		return errAssetUnavailable
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestEncodeObjectTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{
+			name: "sorted by key",
+			tags: map[string]string{"tier": "STANDARD", "contentType": "video/mp4", "orientation": "landscape"},
+			want: "contentType=video%2Fmp4&orientation=landscape&tier=STANDARD",
+		},
+		{
+			name: "spaces and plus signs",
+			tags: map[string]string{"team": "video ops", "plan": "pro+"},
+			want: "plan=pro%2B&team=video%20ops",
+		},
+		{
+			name: "query characters",
+			tags: map[string]string{"a&b": "c=d"},
+			want: "a%26b=c%3Dd",
+		},
+		{
+			name: "no tags",
+			tags: map[string]string{},
+			want: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := encodeObjectTags(tc.tags); got != tc.want {
+				t.Errorf("encodeObjectTags = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseObjectTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "pairs", s: "team=video, env=prod", want: map[string]string{"team": "video", "env": "prod"}},
+		{name: "empty value", s: "team=", want: map[string]string{"team": ""}},
+		{name: "not a pair", s: "team", wantErr: `"team" isn't a key=value pair`},
+		{name: "built-in tag", s: "tier=gold", wantErr: "tier is set by the server"},
+		{name: "listed twice", s: "env=prod,env=dev", wantErr: "env is listed twice"},
+		{name: "reserved prefix", s: "aws:owner=me", wantErr: "reserved aws: prefix"},
+		{name: "disallowed character", s: "team=video!", wantErr: "a character S3 doesn't allow"},
+		{name: "too many", s: "a=1,b=2,c=3,d=4,e=5,f=6,g=7", wantErr: "at most 6 tags can be added"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseObjectTags(tc.s)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseObjectTags error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseObjectTags: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("parseObjectTags = %v, want %v", got, tc.want)
+			}
+			for key, value := range tc.want {
+				if got[key] != value {
+					t.Errorf("tag %s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+// TestHandlerUploadVideoObjectTags checks the stored video is put with a
+// well-formed Tagging string holding the built-in and configured tags
+func TestHandlerUploadVideoObjectTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectTags map[string]string
+		probe      string
+		want       map[string]string // besides userID
+	}{
+		{
+			name:  "built-in tags",
+			probe: testProbeOutput,
+			want:  map[string]string{"tier": defaultStorageClass, "orientation": "landscape", "contentType": "video/mp4"},
+		},
+		{
+			name:  "portrait video",
+			probe: strings.Replace(testProbeOutput, `"width":1280,"height":720`, `"width":1080,"height":1440`, 1),
+			want:  map[string]string{"tier": defaultStorageClass, "orientation": "portrait", "contentType": "video/mp4"},
+		},
+		{
+			name:       "configured tags",
+			objectTags: map[string]string{"team": "video ops", "env": "prod"},
+			probe:      testProbeOutput,
+			want:       map[string]string{"tier": defaultStorageClass, "orientation": "landscape", "contentType": "video/mp4", "team": "video ops", "env": "prod"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			cfg.objectTags = tc.objectTags
+			setFakeProbe(t, cfg, tc.probe)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("a video"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			var tagging string
+			for _, put := range bucket.puts {
+				if strings.HasSuffix(aws.ToString(put.Key), "/"+playbackVideoName) {
+					tagging = aws.ToString(put.Tagging)
+				}
+			}
+			if tagging == "" {
+				t.Fatal("the playback video was put without Tagging")
+			}
+			if strings.ContainsAny(tagging, " +") {
+				t.Errorf("Tagging %q has unescaped spaces or plus signs", tagging)
+			}
+			tags, err := url.ParseQuery(tagging)
+			if err != nil {
+				t.Fatalf("Tagging %q isn't a URL query: %v", tagging, err)
+			}
+
+			want := map[string]string{"userID": owner.String()}
+			for key, value := range tc.want {
+				want[key] = value
+			}
+			if len(tags) != len(want) {
+				t.Errorf("Tagging %q has %d tags, want %d", tagging, len(tags), len(want))
+			}
+			for key, value := range want {
+				if got := tags.Get(key); got != value {
+					t.Errorf("tag %s = %q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	presignCacheSize = 10000
+	// Cached URLs are only handed out while they have at least this long left
+	presignCacheMargin = 5 * time.Minute
+)
+
+// presignCache is a size bounded LRU of signed URLs, so repeatedly fetched
+// videos don't get re-signed on every request
+type presignCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+}
+
+type presignCacheEntry struct {
+	key       string
+	url       string
+	expiresAt time.Time
+}
+
+func newPresignCache(capacity int) *presignCache {
+	return &presignCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *presignCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*presignCacheEntry)
+	if time.Now().Add(presignCacheMargin).After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.url, true
+}
+
+func (c *presignCache) set(key, url string, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*presignCacheEntry)
+		entry.url = url
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&presignCacheEntry{
+		key:       key,
+		url:       url,
+		expiresAt: expiresAt,
+	})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*presignCacheEntry).key)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const quotaExceededMessage = "Upload would exceed your storage quota"
+
+// quotaExceededError is an upload that would take its owner over
+// cfg.storageQuotaBytes
+type quotaExceededError struct {
+	usageBytes int64
+	quotaBytes int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: using %d of %d bytes", e.usageBytes, e.quotaBytes)
+}
+
+// checkQuota is nil if storing newBytes in place of replacedBytes keeps
+// userID within cfg.storageQuotaBytes, a *quotaExceededError if it doesn't
+func (cfg *apiConfig) checkQuota(userID uuid.UUID, replacedBytes, newBytes int64) error {
+	usage, err := cfg.db.GetUserStorageBytes(userID)
+	if err != nil {
+		return err
+	}
+	if usage-replacedBytes+newBytes <= cfg.storageQuotaBytes {
+		return nil
+	}
+	return &quotaExceededError{usageBytes: usage, quotaBytes: cfg.storageQuotaBytes}
+}
+
+// respondWithQuotaError writes the error checkQuota returned, a 403
+// including the current usage if it was over quota
+func respondWithQuotaError(w http.ResponseWriter, err error) {
+	var quotaErr *quotaExceededError
+	if !errors.As(err, &quotaErr) {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check storage usage", err)
+		return
+	}
+	respondWithErrorFields(w, http.StatusForbidden, errCodeQuotaExceeded, quotaExceededMessage, nil, map[string]any{
+		"usage_bytes": quotaErr.usageBytes,
+		"quota_bytes": quotaErr.quotaBytes,
+	})
+}
+
+// checkStorageQuota reports whether replacing the video's file, and
+// everything processing made from it, with an upload of newBytes keeps its
+// owner within cfg.storageQuotaBytes. If it doesn't, a 403 including the
+// current usage has already been written. What processing the upload will
+// store besides isn't known yet, it counts from then on.
+func (cfg *apiConfig) checkStorageQuota(w http.ResponseWriter, video database.Video, newBytes int64) bool {
+	if err := cfg.checkQuota(video.UserID, video.FileSize+video.DerivedBytes, newBytes); err != nil {
+		respondWithQuotaError(w, err)
+		return false
+	}
+	return true
+}
+
+// checkThumbnailQuota is checkStorageQuota for replacing the video's
+// thumbnail with an upload of newBytes
+func (cfg *apiConfig) checkThumbnailQuota(w http.ResponseWriter, video database.Video, newBytes int64) bool {
+	if err := cfg.checkQuota(video.UserID, video.ThumbnailBytes, newBytes); err != nil {
+		respondWithQuotaError(w, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testSizedFFmpegScript is testFFmpegScript writing a few bytes into every
+// file, so what's stored has a size to count
+const testSizedFFmpegScript = `for a; do
+	last=$a
+	case "$a" in *segment_%05d.ts) printf 'segment' > "$(dirname "$a")/segment_00000.ts";; esac
+done
+printf 'ffmpeg output' > "$last"`
+
+// TestStorageUsageCountsDerivedFiles checks everything processing stores
+// for a video counts towards its owner's usage, not only the playback file
+func TestStorageUsageCountsDerivedFiles(t *testing.T) {
+	tests := []struct {
+		name         string
+		keepOriginal bool
+		rotate       bool // rotate the processed video, which keeps its original where it is
+	}{
+		{name: "original discarded"},
+		{name: "original kept", keepOriginal: true},
+		{name: "original kept, then rotated", keepOriginal: true, rotate: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", testSizedFFmpegScript)
+			cfg.keepOriginals = tc.keepOriginal
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			if tc.rotate {
+				r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/rotate", strings.NewReader(`{"degrees":180}`))
+				r.Header.Set("Content-Type", "application/json")
+				r.SetPathValue("videoID", video.ID.String())
+				authorizeTestRequest(t, r, owner)
+				w := httptest.NewRecorder()
+				cfg.handlerRotateVideo(w, r)
+				if w.Code != http.StatusAccepted {
+					t.Fatalf("rotate status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+				}
+				runQueuedVideoJobs(t, cfg)
+			}
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.VideoURL == nil {
+				t.Fatal("video wasn't processed")
+			}
+			_, playbackKey, err := splitStoredURL(*stored.VideoURL)
+			if err != nil {
+				t.Fatalf("splitStoredURL: %v", err)
+			}
+
+			// Everything under the video's key besides the playback file
+			var wantDerived int64
+			keys := bucket.keys(path.Dir(playbackKey) + "/")
+			for _, key := range keys {
+				if key == playbackKey {
+					continue
+				}
+				body, _ := bucket.object(key)
+				wantDerived += int64(len(body))
+			}
+			if len(keys) < 3 {
+				t.Fatalf("only %v stored, want renditions and HLS files too", keys)
+			}
+			if stored.OriginalURL != nil {
+				_, originalKey, err := splitStoredURL(*stored.OriginalURL)
+				if err != nil {
+					t.Fatalf("splitStoredURL: %v", err)
+				}
+				if path.Dir(originalKey) != path.Dir(playbackKey) {
+					body, ok := bucket.object(originalKey)
+					if !ok {
+						t.Fatalf("original %q isn't stored", originalKey)
+					}
+					wantDerived += int64(len(body))
+				}
+			}
+			if stored.DerivedBytes != wantDerived {
+				t.Errorf("derived bytes = %d, want %d for %v", stored.DerivedBytes, wantDerived, keys)
+			}
+			if got := stored.OriginalURL != nil; got != tc.keepOriginal {
+				t.Errorf("original kept = %v, want %v", got, tc.keepOriginal)
+			}
+
+			usage, err := cfg.db.GetUserStorageBytes(owner)
+			if err != nil {
+				t.Fatalf("GetUserStorageBytes: %v", err)
+			}
+			if want := stored.FileSize + stored.DerivedBytes + stored.ThumbnailBytes; usage != want {
+				t.Errorf("usage = %d, want %d", usage, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rateLimiter is a token bucket per user. Each bucket holds up to burst
+// tokens and refills at burst per interval, so a user can make burst
+// requests at once and then one every interval/burst.
+type rateLimiter struct {
+	mu        sync.Mutex
+	burst     float64
+	interval  time.Duration
+	buckets   map[uuid.UUID]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:    float64(burst),
+		interval: interval,
+		buckets:  make(map[uuid.UUID]*tokenBucket),
+	}
+}
+
+// allow takes a token from userID's bucket. When the bucket is empty it
+// reports how long until the next token is available instead.
+func (l *rateLimiter) allow(userID uuid.UUID) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[userID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[userID] = bucket
+	}
+
+	rate := l.burst / l.interval.Seconds() // tokens per second
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have been idle long enough to refill, which is
+// lossless since a new bucket starts full. This keeps memory bounded by the
+// number of users active within the last interval.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.interval {
+		return
+	}
+	l.lastSweep = now
+	for userID, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= l.interval {
+			delete(l.buckets, userID)
+		}
+	}
+}
+
+// allowUpload responds with 429 and a Retry-After header when userID has
+// used up their uploads for now
+func (cfg *apiConfig) allowUpload(w http.ResponseWriter, userID uuid.UUID) bool {
+	ok, wait := cfg.uploadLimiter.allow(userID)
+	if ok {
+		return true
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	respondWithErrorCode(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many uploads, try again later", nil)
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHandlerUploadVideoRateLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		ownUploads   int // uploads by the user before the one checked
+		otherUploads int // uploads by someone else before it
+		wantStatus   int
+	}{
+		{
+			name:       "Nth upload is allowed",
+			limit:      3,
+			ownUploads: 2,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "N+1th upload is rejected",
+			limit:      3,
+			ownUploads: 3,
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:         "other users' uploads don't count",
+			limit:        3,
+			otherUploads: 3,
+			wantStatus:   http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.uploadLimiter = newRateLimiter(tc.limit, time.Minute)
+			cfg.videoJobs = make(chan videoJob, tc.ownUploads+tc.otherUploads+1)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			other := createTestUser(t, cfg, "other@example.com")
+
+			upload := func(userID uuid.UUID, n int) *httptest.ResponseRecorder {
+				video := createTestVideo(t, cfg, userID)
+				r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte(fmt.Sprintf("upload %d by %s", n, userID)))
+				authorizeTestRequest(t, r, userID)
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, r)
+				return w
+			}
+			for i := range tc.otherUploads {
+				if w := upload(other, i); w.Code != http.StatusAccepted {
+					t.Fatalf("other user's upload %d: status = %d: %s", i, w.Code, w.Body)
+				}
+			}
+			for i := range tc.ownUploads {
+				if w := upload(owner, i); w.Code != http.StatusAccepted {
+					t.Fatalf("upload %d: status = %d: %s", i, w.Code, w.Body)
+				}
+			}
+
+			w := upload(owner, tc.ownUploads)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			retryAfter := w.Header().Get("Retry-After")
+			if tc.wantStatus != http.StatusTooManyRequests {
+				if retryAfter != "" {
+					t.Errorf("Retry-After = %q on an allowed upload", retryAfter)
+				}
+				return
+			}
+			if seconds, err := strconv.Atoi(retryAfter); err != nil || seconds < 1 || seconds > 60 {
+				t.Errorf("Retry-After = %q, want the seconds until the next upload", retryAfter)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := newRateLimiter(1, time.Minute)
+	active, idle := uuid.New(), uuid.New()
+	start := time.Now()
+	limiter.buckets[idle] = &tokenBucket{tokens: 0, last: start.Add(-2 * time.Minute)}
+	limiter.buckets[active] = &tokenBucket{tokens: 0, last: start}
+
+	limiter.sweep(start)
+
+	if _, ok := limiter.buckets[idle]; ok {
+		t.Error("idle user's bucket was kept")
+	}
+	if _, ok := limiter.buckets[active]; !ok {
+		t.Error("active user's bucket was dropped")
+	}
+	if ok, _ := limiter.allow(active); ok {
+		t.Error("active user's empty bucket allowed an upload")
+	}
+}
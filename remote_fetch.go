@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	remoteVideoTimeout      = 5 * time.Minute
+	remoteVideoMaxRedirects = 5
+)
+
+var errDisallowedRemoteAddress = errors.New("remote address is not publicly routable")
+
+// Carrier-grade NAT space, which netip doesn't count as private
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// remoteVideoClient fetches user-supplied URLs. The address check runs on
+// every connection after DNS resolution, so neither a redirect nor a record
+// that changes between lookups can reach an internal host. Proxies from the
+// environment are ignored, since they'd do the dialing instead.
+var remoteVideoClient = &http.Client{
+	Timeout: remoteVideoTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkRemoteDial,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= remoteVideoMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", remoteVideoMaxRedirects)
+		}
+		return validateRemoteURL(req.URL)
+	},
+}
+
+// validateRemoteURL rejects anything but absolute http(s) URLs and hosts
+// that are literal internal addresses. Hostnames are checked once resolved,
+// by checkRemoteDial.
+func validateRemoteURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed, use http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	if u.User != nil {
+		return errors.New("URL must not contain credentials")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicAddr(addr) {
+		return errDisallowedRemoteAddress
+	}
+	return nil
+}
+
+func checkRemoteDial(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("couldn't parse dial address %q: %w", address, err)
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return errDisallowedRemoteAddress
+	}
+	return nil
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() &&
+		!addr.IsPrivate() &&
+		!sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Rendition struct {
+	Name   string
+	Height int
+	Path   string
+}
+
+// renditionHeights are measured along the short side of the frame, so a
+// portrait 1080x1920 source still counts as 1080p
+var renditionHeights = []int{480, 720, 1080}
+
+// processVideoRenditions scales the video down to each rendition height
+// under its own, as meta reports it
+func (cfg *apiConfig) processVideoRenditions(filePath string, meta VideoMeta) ([]Rendition, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := meta.Width, meta.Height
+	shortSide := min(width, height)
+
+	renditions := []Rendition{}
+	for _, target := range renditionHeights {
+		// Never upscale
+		if target > shortSide {
+			continue
+		}
+
+		scale := fmt.Sprintf("scale=-2:%d", target)
+		if height > width {
+			scale = fmt.Sprintf("scale=%d:-2", target)
+		}
+
+		name := fmt.Sprintf("%dp", target)
+		outPath := fmt.Sprintf("%s.%s.mp4", absPath, name)
+
+		cmd := cfg.transcodeCommand(
+			cfg.ffmpegPath,
+			"-i", absPath,
+			"-vf", scale,
+			"-c:v", "libx264",
+			"-preset", "medium",
+			"-crf", "23",
+			"-c:a", "aac",
+			"-movflags", "faststart",
+			"-f", "mp4",
+			outPath,
+		)
+		start := time.Now()
+		err := cmd.Run()
+		ffmpegDuration.WithLabelValues("rendition", metricResult(err)).Observe(time.Since(start).Seconds())
+		if err != nil {
+			os.Remove(outPath)
+			for _, rendition := range renditions {
+				os.Remove(rendition.Path)
+			}
+			return nil, fmt.Errorf("failed to generate %s rendition: %w", name, err)
+		}
+
+		renditions = append(renditions, Rendition{
+			Name:   name,
+			Height: target,
+			Path:   outPath,
+		})
+	}
+
+	return renditions, nil
+}
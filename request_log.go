@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestInfoKey struct{}
+
+// requestInfo is shared between requestLogger and the handler it wraps, so
+// handlers can say who the request was made by
+type requestInfo struct {
+	id     string
+	userID uuid.UUID
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestUser records who made the request for the access log
+func setRequestUser(r *http.Request, userID uuid.UUID) {
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		info.userID = userID
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestLogger tags every request with an ID, taken from X-Request-ID if
+// the client sent a sane one, and echoes it back in the response headers.
+// Logs written with the request's context carry the ID.
+func requestLogger(jwtSecret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(c rune) bool { return c < 0x21 || c > 0x7e }) {
+			id = uuid.NewString()
+		}
+		info := &requestInfo{id: id}
+		w.Header().Set(requestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		// Handlers that authenticate with an API key set the user
+		// themselves, JWTs can be read here without a DB lookup
+		if info.userID == uuid.Nil {
+			if token, err := auth.GetBearerToken(r.Header); err == nil {
+				if userID, err := auth.ValidateJWT(token, jwtSecret); err == nil {
+					info.userID = userID
+				}
+			}
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+		}
+		if info.userID != uuid.Nil {
+			attrs = append(attrs, "user_id", info.userID)
+		}
+		slog.InfoContext(ctx, "request", attrs...)
+	})
+}
+
+// contextLogHandler adds the request ID to any record logged with a
+// request's context
+type contextLogHandler struct {
+	slog.Handler
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := requestInfoFromContext(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/google/uuid"
+)
+
+// userVideoKeyBase is the key a new video is stored under, minus the
+// extension. Its renditions and HLS segments nest below it. Keys are
+// partitioned by user so lifecycle rules and cleanup can target one user's
+// prefix, e.g. users/<userID>/videos/landscape/<id>. Users of a tenant
+// get it under the tenant's prefix, see tenantKey.
+//
+// Videos stored before this are at the bucket root as
+// "<orientation>-<id>.mp4". Nothing parses the layout of a key, the stored
+// "bucket,key" values are signed and deleted as they are, so those videos
+// keep working without being moved.
+func userVideoKeyBase(userID uuid.UUID, orientation string) string {
+	return fmt.Sprintf("%svideos/%s/%x", userKeyPrefix(userID), orientation, uuid.New())
+}
+
+// userKeyPrefix is the prefix every key of userID's files starts with,
+// before the tenant's prefix
+func userKeyPrefix(userID uuid.UUID) string {
+	return fmt.Sprintf("users/%s/", userID)
+}
+
+// splitStoredURL splits a "bucket,key" value as stored in the database
+func splitStoredURL(stored string) (bucket, key string, err error) {
+	bucket, key, ok := strings.Cut(stored, ",")
+	if !ok || bucket == "" || key == "" || strings.Contains(key, ",") {
+		return "", "", fmt.Errorf("invalid stored video URL format")
+	}
+	return bucket, key, nil
+}
+
+// storedURL is the "bucket,key" value recorded in the database for a key
+func storedURL(storage Storage, key string) string {
+	return fmt.Sprintf("%s,%s", storage.Bucket(), key)
+}
+
+func uploadFile(ctx context.Context, storage Storage, filePath, key string, opts PutOptions) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return storage.Put(ctx, key, file, opts)
+}
+
+// storedObjectSize is the size of the object behind a stored "bucket,key"
+// value
+func (cfg *apiConfig) storedObjectSize(ctx context.Context, stored string) (int64, error) {
+	storage, key, err := cfg.storageFor(stored)
+	if err != nil {
+		return 0, err
+	}
+	return storage.Head(ctx, key)
+}
+
+// deleteStoredObject removes the object behind a stored "bucket,key" value.
+// An object that is already gone counts as deleted.
+func (cfg *apiConfig) deleteStoredObject(ctx context.Context, stored string) error {
+	storage, key, err := cfg.storageFor(stored)
+	if err != nil {
+		return err
+	}
+	return storage.Delete(ctx, key)
+}
+
+// deleteStoredPrefix removes every object in the same "directory" as the
+// stored "bucket,key" value, e.g. all the segments next to an HLS playlist
+func (cfg *apiConfig) deleteStoredPrefix(ctx context.Context, stored string) error {
+	storage, key, err := cfg.storageFor(stored)
+	if err != nil {
+		return err
+	}
+
+	keys, err := storage.List(ctx, path.Dir(key)+"/")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := storage.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isS3InvalidRange(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange"
+}
+
+func isS3NotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const s3PutInitialBackoff = 200 * time.Millisecond
+
+// remainingSize is how many bytes are left to read from r, if it can be
+// told without reading them
+func remainingSize(r io.Reader) (int64, bool) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return end - current, true
+}
+
+// putWithRetry runs put until it succeeds, fails with an error that won't
+// go away by retrying, or maxAttempts is reached. The SDK already retries
+// single requests; this covers an upload failing as a whole. Bodies that
+// can't be rewound only get one attempt.
+func putWithRetry(ctx context.Context, r io.Reader, maxAttempts int, put func() error) error {
+	seeker, canRewind := r.(io.Seeker)
+
+	backoff := s3PutInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := put()
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxAttempts || !canRewind || !isRetryableS3Error(err) {
+			if attempt > 1 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		// Full jitter keeps retries from many uploads from lining up
+		select {
+		case <-time.After(rand.N(backoff)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("couldn't rewind upload body for retry: %w", err)
+		}
+	}
+}
+
+// isRetryableS3Error reports throttling, timeouts and 5xx responses.
+// Anything else, e.g. AccessDenied, fails the same way every time.
+func isRetryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "RequestTimeout", "RequestTimeTooSkewed", "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() >= 500
+	}
+	return false
+}
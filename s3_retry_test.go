@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestS3StoragePutRetry(t *testing.T) {
+	slowDown := &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate"}
+	internal := &smithy.GenericAPIError{Code: "InternalError", Message: "We encountered an internal error"}
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+
+	tests := []struct {
+		name         string
+		putErrs      []error
+		maxAttempts  int
+		unrewindable bool
+		cancelled    bool
+		wantErr      error
+		wantPuts     int
+	}{
+		{
+			name:        "fails twice then succeeds",
+			putErrs:     []error{slowDown, internal},
+			maxAttempts: 3,
+			wantPuts:    3,
+		},
+		{
+			name:        "gives up after max attempts",
+			putErrs:     []error{slowDown, slowDown, slowDown},
+			maxAttempts: 3,
+			wantErr:     slowDown,
+			wantPuts:    3,
+		},
+		{
+			name:        "access denied fails fast",
+			putErrs:     []error{denied},
+			maxAttempts: 3,
+			wantErr:     denied,
+			wantPuts:    1,
+		},
+		{
+			name:         "body that can't be rewound isn't retried",
+			putErrs:      []error{slowDown},
+			maxAttempts:  3,
+			unrewindable: true,
+			wantErr:      slowDown,
+			wantPuts:     1,
+		},
+		{
+			name:        "cancelled request stops retrying",
+			putErrs:     []error{slowDown},
+			maxAttempts: 3,
+			cancelled:   true,
+			wantErr:     context.Canceled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+			bucket := newFakeS3()
+			bucket.putErrs = tc.putErrs
+			storage := newS3Storage(bucket, fakePresigner{}, testBucket, nil, "", tc.maxAttempts)
+
+			var body io.Reader = strings.NewReader("video bytes")
+			if tc.unrewindable {
+				body = io.MultiReader(body)
+			}
+			err := storage.Put(ctx, "videos/a.mp4", body, PutOptions{ContentType: "video/mp4"})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Put error = %v, want %v", err, tc.wantErr)
+			}
+			if !tc.cancelled && len(bucket.puts) != tc.wantPuts {
+				t.Errorf("PutObject called %d times, want %d", len(bucket.puts), tc.wantPuts)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if got, _ := bucket.object("videos/a.mp4"); string(got) != "video bytes" {
+				t.Errorf("stored %q after retries, want the whole body", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long in-flight requests, then background video jobs, get to finish
+	shutdownTimeout = 30 * time.Second
+	// Grace period for work that was cancelled to clean up after itself
+	shutdownCleanupTimeout = 5 * time.Second
+)
+
+// requestTracker counts in-flight requests so shutdown can report on them
+// and wait for handlers' deferred cleanup after connections are closed
+type requestTracker struct {
+	active atomic.Int64
+	wg     sync.WaitGroup
+}
+
+func (t *requestTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		t.active.Add(1)
+		defer func() {
+			t.active.Add(-1)
+			t.wg.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *requestTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown stops accepting requests, drains the ones in flight and then
+// lets the video workers finish. Anything that overruns shutdownTimeout is
+// cancelled, which still runs the deferred removal of its temp files.
+func (cfg *apiConfig) shutdown(srv *http.Server, requests *requestTracker, cancelWorkers context.CancelFunc) {
+	inFlight := requests.active.Load()
+	log.Printf("Shutting down, draining %d in-flight requests", inFlight)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Couldn't drain all requests, closing %d connections: %v", requests.active.Load(), err)
+		srv.Close()
+		if !requests.wait(shutdownCleanupTimeout) {
+			log.Printf("%d requests still running after close", requests.active.Load())
+		}
+	}
+	log.Printf("Drained %d of %d in-flight requests", inFlight-requests.active.Load(), inFlight)
+
+	if !cfg.waitForVideoJobs(shutdownTimeout) {
+		log.Println("Video processing didn't finish in time, cancelling remaining jobs")
+		cancelWorkers()
+		if !cfg.waitForVideoJobs(shutdownCleanupTimeout) {
+			log.Println("Some video jobs were still running at exit")
+		}
+	}
+	log.Println("Shutdown complete")
+}
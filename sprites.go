@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	spriteIntervalSeconds = 10.0
+	spriteTileWidth       = 160
+	spriteColumns         = 10
+	// Long videos get a wider interval rather than an ever larger image
+	spriteMaxFrames = 100
+	// Cues in the WebVTT file point at the sheet by this name, so it's
+	// also the name the sheet is stored under, next to the VTT file
+	spriteSheetName = "sprite.jpg"
+	spriteVTTName   = "sprite.vtt"
+)
+
+// generateSpriteSheet tiles a frame from every interval seconds of the video
+// into one JPEG for scrubbing previews, and writes a WebVTT file mapping
+// each interval to its tile. Both are written next to videoPath, and the
+// caller is responsible for removing them. meta is the video as probed.
+func (cfg *apiConfig) generateSpriteSheet(videoPath string, meta VideoMeta, interval float64) (imagePath string, vttPath string, err error) {
+	absPath, err := filepath.Abs(videoPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	duration, width, height := meta.Duration, meta.Width, meta.Height
+	if duration <= 0 {
+		return "", "", fmt.Errorf("video has no duration to sample")
+	}
+
+	frames := int(math.Ceil(duration / interval))
+	if frames > spriteMaxFrames {
+		frames = spriteMaxFrames
+		interval = duration / spriteMaxFrames
+	}
+	columns := min(frames, spriteColumns)
+	rows := (frames + columns - 1) / columns
+	// libjpeg wants even dimensions, and the cues need the exact tile size
+	tileHeight := int(math.Round(float64(spriteTileWidth)*float64(height)/float64(width)/2)) * 2
+	tileHeight = max(tileHeight, 2)
+
+	imagePath = absPath + "." + spriteSheetName
+	vttPath = absPath + "." + spriteVTTName
+	defer func() {
+		if err != nil {
+			os.Remove(imagePath)
+			os.Remove(vttPath)
+		}
+	}()
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d",
+		strconv.FormatFloat(interval, 'f', 3, 64), spriteTileWidth, tileHeight, columns, rows)
+	cmd := cfg.transcodeCommand(
+		cfg.ffmpegPath,
+		"-y",
+		"-i", absPath,
+		"-vf", filter,
+		"-an",
+		"-frames:v", "1",
+		"-q:v", "5",
+		imagePath,
+	)
+	start := time.Now()
+	err = cmd.Run()
+	ffmpegDuration.WithLabelValues("sprite", metricResult(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate sprite sheet: %w", err)
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := range frames {
+		cueStart := float64(i) * interval
+		cueEnd := min(float64(i+1)*interval, duration)
+		x := (i % columns) * spriteTileWidth
+		y := (i / columns) * tileHeight
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(cueStart), formatVTTTimestamp(cueEnd), spriteSheetName, x, y, spriteTileWidth, tileHeight)
+	}
+	if err = os.WriteFile(vttPath, []byte(vtt.String()), 0o644); err != nil {
+		return "", "", err
+	}
+
+	return imagePath, vttPath, nil
+}
+
+// formatVTTTimestamp formats seconds as WebVTT's hh:mm:ss.ttt
+func formatVTTTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Storage is where video objects live. Keys look the same on every
+// backend, and the database records objects as "bucket,key" pairs using
+// the backend's Bucket name.
+type Storage interface {
+	Bucket() string
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error
+	// Get returns errObjectNotFound if there's nothing at key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange is Get along with the headers needed to pass the object on.
+	// A non-empty byteRange, an HTTP Range header value, selects part of it.
+	GetRange(ctx context.Context, key, byteRange string) (*StoredObject, error)
+	// Head returns the size of the object at key, or errObjectNotFound if
+	// there's nothing there
+	Head(ctx context.Context, key string) (int64, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	SignedURL(ctx context.Context, key string, expiry time.Duration, opts SignOptions) (string, error)
+	// Ping checks the backend is reachable, for health checks
+	Ping(ctx context.Context) error
+}
+
+// PutOptions describe how an object is stored. Backends ignore options
+// they have no equivalent for.
+type PutOptions struct {
+	ContentType string
+	// StorageClass is an S3 storage class, empty meaning the bucket default
+	StorageClass string
+	// CacheControl, if set, is sent with the object wherever it's served
+	// from, S3 or a CDN in front of it
+	CacheControl string
+	// Tags are S3 object tags, for lifecycle rules and cost allocation.
+	// Local storage doesn't keep them.
+	Tags map[string]string
+	// ChecksumSHA256 is the base64 SHA-256 the body must have, for S3 to
+	// reject it if it doesn't. Bodies uploaded in parts are checked part by
+	// part instead. Local storage doesn't check it.
+	ChecksumSHA256 string
+}
+
+// StoredObject is an object body as fetched by GetRange
+type StoredObject struct {
+	Body          io.ReadCloser
+	ContentType   string
+	ContentLength int64
+	// ContentRange, e.g. "bytes 0-99/1000", is set when only part of the
+	// object was returned
+	ContentRange string
+}
+
+var (
+	errObjectNotFound = errors.New("object not found")
+	errInvalidRange   = errors.New("range not satisfiable")
+)
+
+// SignOptions override response headers for whoever follows a signed URL
+type SignOptions struct {
+	// ContentDisposition, e.g. `attachment; filename="clip.mp4"`, makes
+	// browsers save the object instead of playing it inline
+	ContentDisposition string
+	// ContentType, if set, is sent in place of the type the object was
+	// stored with, for objects stored with a wrong or missing one that
+	// browsers would refuse to play
+	ContentType string
+}
+
+// S3API is the part of *s3.Client that S3 storage and resumable uploads
+// use, so something other than real S3 can stand in for it
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// S3PresignAPI is the part of *s3.PresignClient used to sign playback URLs
+// and direct uploads
+type S3PresignAPI interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPostObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignPostOptions)) (*s3.PresignedPostRequest, error)
+}
+
+type s3Storage struct {
+	client    S3API
+	presigner S3PresignAPI
+	bucket    string
+	// cloudFront, when set, signs playback URLs through the CDN instead of
+	// presigning them against S3
+	cloudFront *cloudFrontSigner
+	// kmsKeyID, when set, encrypts every object with SSE-KMS under that key
+	// rather than leaving it to the bucket default
+	kmsKeyID string
+	// putMaxAttempts bounds how often a transiently failing Put is tried
+	putMaxAttempts int
+}
+
+// newS3Storage stores in bucket through client, signing URLs with
+// presigner, usually an *s3.Client and its s3.NewPresignClient
+func newS3Storage(client S3API, presigner S3PresignAPI, bucket string, cloudFront *cloudFrontSigner, kmsKeyID string, putMaxAttempts int) *s3Storage {
+	return &s3Storage{
+		client:         client,
+		presigner:      presigner,
+		bucket:         bucket,
+		cloudFront:     cloudFront,
+		kmsKeyID:       kmsKeyID,
+		putMaxAttempts: putMaxAttempts,
+	}
+}
+
+func (s *s3Storage) Bucket() string {
+	return s.bucket
+}
+
+// Put goes through the multipart uploader, which streams the body in parts
+// rather than needing it all up front. Transient failures are retried.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String(opts.ContentType),
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = types.StorageClass(opts.StorageClass)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	if len(opts.Tags) > 0 {
+		input.Tagging = aws.String(encodeObjectTags(opts.Tags))
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	if opts.ChecksumSHA256 != "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		// A whole object checksum is only valid for a single PutObject,
+		// the uploader sends bigger bodies as parts, each checksummed
+		if size, ok := remainingSize(r); ok && size < manager.DefaultUploadPartSize {
+			input.ChecksumSHA256 = aws.String(opts.ChecksumSHA256)
+		}
+	}
+
+	uploader := manager.NewUploader(s.client)
+	start := time.Now()
+	err := putWithRetry(ctx, r, s.putMaxAttempts, func() error {
+		_, err := uploader.Upload(ctx, input)
+		return err
+	})
+	s3PutDuration.WithLabelValues(metricResult(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (s *s3Storage) Ping(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	return obj.Body, nil
+}
+
+func (s *s3Storage) GetRange(ctx context.Context, key, byteRange string) (*StoredObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	obj, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, errObjectNotFound
+		}
+		if isS3InvalidRange(err) {
+			return nil, errInvalidRange
+		}
+		return nil, err
+	}
+	return &StoredObject{
+		Body:          obj.Body,
+		ContentType:   aws.ToString(obj.ContentType),
+		ContentLength: aws.ToInt64(obj.ContentLength),
+		ContentRange:  aws.ToString(obj.ContentRange),
+	}, nil
+}
+
+// Delete treats an object that is already gone as deleted
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isS3NotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *s3Storage) SignedURL(ctx context.Context, key string, expiry time.Duration, opts SignOptions) (string, error) {
+	if s.cloudFront != nil {
+		return s.cloudFront.SignedURL(key, expiry, opts)
+	}
+	return generatePresignedURL(ctx, s.presigner, s.bucket, key, expiry, opts)
+}
+
+// presignPut signs a PUT of exactly size bytes of contentType to key, for
+// clients uploading straight to S3. The returned headers are covered by
+// the signature and have to be sent with the PUT as they are.
+func (s *s3Storage) presignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (string, http.Header, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	req, err := s.presigner.PresignPutObject(ctx, input, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", nil, err
+	}
+	// Host is implied by the URL, clients can't set it anyway
+	req.SignedHeader.Del("Host")
+	return req.URL, req.SignedHeader, nil
+}
+
+// presignPost signs a POST policy for browsers uploading a form straight
+// to S3: one file of contentType to key, of at most maxSize bytes. The
+// returned fields are covered by the policy and have to be sent as form
+// fields as they are, before the file, which S3 wants last.
+func (s *s3Storage) presignPost(ctx context.Context, key, contentType string, maxSize int64, expiry time.Duration) (string, map[string]string, error) {
+	// Every field but the file and the signature has to appear in the
+	// policy, the SDK only adds those it sets itself
+	fields := map[string]string{"Content-Type": contentType}
+	if s.kmsKeyID != "" {
+		fields["x-amz-server-side-encryption"] = string(types.ServerSideEncryptionAwsKms)
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = s.kmsKeyID
+	}
+	conditions := []any{
+		[]any{"content-length-range", 1, maxSize},
+		// Pinned exactly, rather than to a prefix, so the object is where
+		// the upload was recorded
+		map[string]string{"key": key},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+
+	req, err := s.presigner.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = expiry
+		o.Conditions = conditions
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for name, value := range req.Values {
+		fields[name] = value
+	}
+	return req.URL, fields, nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (int64, error) {
+	obj, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return 0, errObjectNotFound
+		}
+		return 0, err
+	}
+	return aws.ToInt64(obj.ContentLength), nil
+}
+
+// generatePresignedURL presigns a GET for the object. SSE-KMS objects need
+// no extra parameters, S3 decrypts them as long as the signing credentials
+// may use the key. The headers opts override are signed into the URL as
+// response-* parameters, which S3 answers with. A cancelled ctx fails it,
+// the SDK would sign regardless, as signing never leaves the process.
+func generatePresignedURL(ctx context.Context, presigner S3PresignAPI, bucket, key string, expireTime time.Duration, opts SignOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.ContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(opts.ContentDisposition)
+	}
+	if opts.ContentType != "" {
+		input.ResponseContentType = aws.String(opts.ContentType)
+	}
+
+	req, err := presigner.PresignGetObject(ctx, input, s3.WithPresignExpires(expireTime))
+
+	if err != nil {
+		return "", err
+	}
+
+	return req.URL, nil
+}
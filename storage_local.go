@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const localStorageBucket = "local"
+
+// localStorage keeps objects on disk so the app can run without AWS. Signed
+// URLs point back at this server and carry an HMAC over the key and expiry.
+type localStorage struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+func newLocalStorage(root, baseURL string, secret []byte) (*localStorage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+func (s *localStorage) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("storage root %s is not a directory", s.root)
+	}
+	return nil
+}
+
+func (s *localStorage) Bucket() string {
+	return localStorageBucket
+}
+
+// path maps a key onto disk, refusing anything that would escape the root
+func (s *localStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean("/" + key)
+	if cleaned == "/" {
+		return "", errors.New("empty storage key")
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetRange supports a single "bytes=" range, anything else returns the
+// whole object as servers are allowed to
+func (s *localStorage) GetRange(ctx context.Context, key, byteRange string) (*StoredObject, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
+
+	obj := &StoredObject{
+		Body:          f,
+		ContentType:   mime.TypeByExtension(filepath.Ext(p)),
+		ContentLength: size,
+	}
+	start, end, ok, err := parseByteRange(byteRange, size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !ok {
+		return obj, nil
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	obj.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, end-start+1), f}
+	obj.ContentLength = end - start + 1
+	obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	return obj, nil
+}
+
+// parseByteRange reads a single range ("bytes=0-99", "bytes=100-" or
+// "bytes=-100") as inclusive offsets into an object of size bytes. ok is
+// false for an empty header and for multiple or unrecognised ranges.
+func parseByteRange(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		return max(size-suffix, 0), size - 1, size > 0, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, errInvalidRange
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true, nil
+}
+
+func (s *localStorage) Head(ctx context.Context, key string) (int64, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, errObjectNotFound
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *localStorage) SignedURL(ctx context.Context, key string, expiry time.Duration, opts SignOptions) (string, error) {
+	expires := time.Now().Add(expiry).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	if opts.ContentDisposition != "" {
+		query.Set("disposition", opts.ContentDisposition)
+	}
+	if opts.ContentType != "" {
+		query.Set("type", opts.ContentType)
+	}
+	query.Set("signature", s.sign(key, expires, opts.ContentDisposition, opts.ContentType))
+	return fmt.Sprintf("%s/%s?%s", s.baseURL, strings.TrimPrefix(key, "/"), query.Encode()), nil
+}
+
+func (s *localStorage) sign(key string, expires int64, disposition, contentType string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d\n%s", key, expires, disposition)
+	// Left out when unset, so URLs signed before it existed stay valid
+	if contentType != "" {
+		fmt.Fprintf(mac, "\n%s", contentType)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves objects behind URLs produced by SignedURL, mounted with
+// the URL prefix stripped so the request path is the key
+func (s *localStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		http.Error(w, "URL expired", http.StatusForbidden)
+		return
+	}
+	disposition := r.URL.Query().Get("disposition")
+	contentType := r.URL.Query().Get("type")
+	expected := s.sign(key, expires, disposition, contentType)
+	if !hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("signature"))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	p, err := s.path(key)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeFile(w, r, p)
+}
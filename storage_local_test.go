@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStorage(t *testing.T) *localStorage {
+	t.Helper()
+	storage, err := newLocalStorage(filepath.Join(t.TempDir(), "storage"), "http://localhost:8091/storage", []byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("newLocalStorage: %v", err)
+	}
+	return storage
+}
+
+func TestLocalStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		put      map[string]string
+		delete   string
+		get      string
+		want     string
+		wantErr  error
+		wantKeys []string
+	}{
+		{
+			name:     "stored object is read back",
+			put:      map[string]string{"videos/a.mp4": "video bytes"},
+			get:      "videos/a.mp4",
+			want:     "video bytes",
+			wantKeys: []string{"videos/a.mp4"},
+		},
+		{
+			name:    "missing object is errObjectNotFound",
+			get:     "videos/missing.mp4",
+			wantErr: errObjectNotFound,
+		},
+		{
+			name:    "deleted object is gone",
+			put:     map[string]string{"videos/a.mp4": "video bytes"},
+			delete:  "videos/a.mp4",
+			get:     "videos/a.mp4",
+			wantErr: errObjectNotFound,
+		},
+		{
+			name:     "key can't escape the root",
+			put:      map[string]string{"../../escaped.mp4": "video bytes"},
+			get:      "escaped.mp4",
+			want:     "video bytes",
+			wantKeys: []string{"escaped.mp4"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := newTestLocalStorage(t)
+			for key, body := range tc.put {
+				if err := storage.Put(ctx, key, strings.NewReader(body), PutOptions{ContentType: "video/mp4"}); err != nil {
+					t.Fatalf("Put(%q): %v", key, err)
+				}
+			}
+			if tc.delete != "" {
+				if err := storage.Delete(ctx, tc.delete); err != nil {
+					t.Fatalf("Delete(%q): %v", tc.delete, err)
+				}
+			}
+
+			keys, err := storage.List(ctx, "")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if !slices.Equal(keys, tc.wantKeys) {
+				t.Errorf("List = %v, want %v", keys, tc.wantKeys)
+			}
+
+			if body, err := storage.Get(ctx, tc.get); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Get(%q) error = %v, want %v", tc.get, err, tc.wantErr)
+			} else if err == nil {
+				body.Close()
+			}
+
+			obj, err := storage.GetRange(ctx, tc.get, "")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("GetRange(%q) error = %v, want %v", tc.get, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer obj.Body.Close()
+			body, err := io.ReadAll(obj.Body)
+			if err != nil {
+				t.Fatalf("reading %q: %v", tc.get, err)
+			}
+			if string(body) != tc.want {
+				t.Errorf("GetRange(%q) = %q, want %q", tc.get, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiry     time.Duration
+		tamper     func(u *url.URL)
+		wantStatus int
+	}{
+		{
+			name:       "signed URL serves the object",
+			expiry:     time.Hour,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "expired URL is refused",
+			expiry:     -time.Minute,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "URL for another key is refused",
+			expiry: time.Hour,
+			tamper: func(u *url.URL) {
+				u.Path = "/storage/videos/b.mp4"
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "extended expiry is refused",
+			expiry: time.Hour,
+			tamper: func(u *url.URL) {
+				q := u.Query()
+				q.Set("expires", "99999999999")
+				u.RawQuery = q.Encode()
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := newTestLocalStorage(t)
+			for _, key := range []string{"videos/a.mp4", "videos/b.mp4"} {
+				if err := storage.Put(ctx, key, strings.NewReader("bytes of "+key), PutOptions{}); err != nil {
+					t.Fatalf("Put(%q): %v", key, err)
+				}
+			}
+
+			signed, err := storage.SignedURL(ctx, "videos/a.mp4", tc.expiry, SignOptions{})
+			if err != nil {
+				t.Fatalf("SignedURL: %v", err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatalf("couldn't parse signed URL %q: %v", signed, err)
+			}
+			if tc.tamper != nil {
+				tc.tamper(u)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+			w := httptest.NewRecorder()
+			http.StripPrefix("/storage", storage).ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantStatus == http.StatusOK && w.Body.String() != "bytes of videos/a.mp4" {
+				t.Errorf("body = %q, want the signed object", w.Body)
+			}
+		})
+	}
+}
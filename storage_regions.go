@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// regionHeader lets clients pick which region a new upload is stored in
+const regionHeader = "X-Region"
+
+var (
+	errUnknownRegion = errors.New("unknown storage region")
+	errUnknownBucket = errors.New("unknown storage bucket")
+)
+
+// storageRegions is the storage for every region videos can be kept in.
+// New uploads go to the region the client asks for, falling back to
+// defaultRegion. Anything already stored is read, signed and deleted
+// through whichever bucket its "bucket,key" value names.
+type storageRegions struct {
+	defaultRegion string
+	regions       map[string]Storage
+}
+
+func newStorageRegions(defaultRegion string, regions map[string]Storage) (*storageRegions, error) {
+	if _, ok := regions[defaultRegion]; !ok {
+		return nil, fmt.Errorf("default region %q has no bucket", defaultRegion)
+	}
+	buckets := map[string]string{}
+	for region, storage := range regions {
+		if other, ok := buckets[storage.Bucket()]; ok {
+			return nil, fmt.Errorf("bucket %q is configured for both %s and %s", storage.Bucket(), other, region)
+		}
+		buckets[storage.Bucket()] = region
+	}
+	return &storageRegions{defaultRegion: defaultRegion, regions: regions}, nil
+}
+
+// parseRegionBuckets parses S3_BUCKETS, e.g.
+// "us-east-1=tubely-east,eu-west-1=tubely-eu", into region -> bucket
+func parseRegionBuckets(s string) (map[string]string, error) {
+	buckets := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		region, bucket, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || region == "" || bucket == "" {
+			return nil, fmt.Errorf("%q is not region=bucket", pair)
+		}
+		if _, ok := buckets[region]; ok {
+			return nil, fmt.Errorf("region %s is listed twice", region)
+		}
+		buckets[region] = bucket
+	}
+	return buckets, nil
+}
+
+// forRegion is the storage new uploads to region go to, "" meaning the
+// default region
+func (s *storageRegions) forRegion(region string) (Storage, error) {
+	if region == "" {
+		region = s.defaultRegion
+	}
+	storage, ok := s.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownRegion, region)
+	}
+	return storage, nil
+}
+
+// forBucket is the storage holding objects recorded under bucket
+func (s *storageRegions) forBucket(bucket string) (Storage, error) {
+	for _, storage := range s.regions {
+		if storage.Bucket() == bucket {
+			return storage, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownBucket, bucket)
+}
+
+// names lists the configured regions, sorted, for error messages
+func (s *storageRegions) names() []string {
+	names := make([]string, 0, len(s.regions))
+	for region := range s.regions {
+		names = append(names, region)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ping checks every region's storage is reachable
+func (s *storageRegions) ping(ctx context.Context) error {
+	for _, region := range s.names() {
+		if err := s.regions[region].Ping(ctx); err != nil {
+			return fmt.Errorf("%s: %w", region, err)
+		}
+	}
+	return nil
+}
+
+// storageForRequest picks the storage a new upload goes to from the
+// X-Region header, writing an error response and returning false if the
+// region isn't configured
+func (cfg *apiConfig) storageForRequest(w http.ResponseWriter, r *http.Request) (Storage, bool) {
+	storage, err := cfg.storageRegions.forRegion(r.Header.Get(regionHeader))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRegion, fmt.Sprintf("Invalid %s: must be one of %s", regionHeader, strings.Join(cfg.storageRegions.names(), ", ")), err)
+		return nil, false
+	}
+	return storage, true
+}
+
+// storageFor resolves a "bucket,key" value as stored in the database to
+// the storage holding it and the key within it
+func (cfg *apiConfig) storageFor(stored string) (Storage, string, error) {
+	bucket, key, err := splitStoredURL(stored)
+	if err != nil {
+		return nil, "", err
+	}
+	storage, err := cfg.storageRegions.forBucket(bucket)
+	if err != nil {
+		return nil, "", err
+	}
+	return storage, key, nil
+}
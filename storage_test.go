@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3 is an in-memory bucket standing in for S3. Calls to methods it
+// doesn't implement panic on the embedded nil S3API, so a test using one
+// it didn't expect fails loudly.
+type fakeS3 struct {
+	S3API
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	// putErrs are returned by the next PutObject calls, one each, before
+	// any succeed
+	putErrs []error
+	// puts is every PutObject input received, failed or not
+	puts []*s3.PutObjectInput
+	// gets is every GetObject input received
+	gets []*s3.GetObjectInput
+}
+
+type fakeS3Object struct {
+	body        []byte
+	contentType string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]fakeS3Object{}}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts = append(f.puts, params)
+	if len(f.putErrs) > 0 {
+		err := f.putErrs[0]
+		f.putErrs = f.putErrs[1:]
+		return nil, err
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = fakeS3Object{body: body, contentType: aws.ToString(params.ContentType)}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets = append(f.gets, params)
+	obj, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	out := &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(obj.body)),
+		ContentType:   aws.String(obj.contentType),
+		ContentLength: aws.Int64(int64(len(obj.body))),
+	}
+	// Ranges are answered like S3 does
+	size := int64(len(obj.body))
+	start, end, ok, err := parseByteRange(aws.ToString(params.Range), size)
+	if err != nil {
+		return nil, &smithy.GenericAPIError{Code: "InvalidRange", Message: "The requested range is not satisfiable"}
+	}
+	if ok {
+		out.Body = io.NopCloser(bytes.NewReader(obj.body[start : end+1]))
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	return out, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentType:   aws.String(obj.contentType),
+		ContentLength: aws.Int64(int64(len(obj.body))),
+	}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsV2 lists every key under the prefix in a single page
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	keys := f.keys(aws.ToString(params.Prefix))
+	slices.Sort(keys)
+	out := &s3.ListObjectsV2Output{KeyCount: aws.Int32(int32(len(keys)))}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+// object returns the body stored under key
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	return obj.body, ok
+}
+
+// keys lists the stored keys starting with prefix
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// fakePresigner signs URLs that only say what they were signed for
+type fakePresigner struct{}
+
+func (fakePresigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return &v4.PresignedHTTPRequest{
+		URL:    fmt.Sprintf("https://%s.s3.test/%s?signed=get", aws.ToString(params.Bucket), aws.ToString(params.Key)),
+		Method: http.MethodGet,
+	}, nil
+}
+
+func (fakePresigner) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return &v4.PresignedHTTPRequest{
+		URL:          fmt.Sprintf("https://%s.s3.test/%s?signed=put", aws.ToString(params.Bucket), aws.ToString(params.Key)),
+		Method:       http.MethodPut,
+		SignedHeader: http.Header{},
+	}, nil
+}
+
+func (fakePresigner) PresignPostObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignPostOptions)) (*s3.PresignedPostRequest, error) {
+	return &s3.PresignedPostRequest{
+		URL:    fmt.Sprintf("https://%s.s3.test", aws.ToString(params.Bucket)),
+		Values: map[string]string{"key": aws.ToString(params.Key)},
+	}, nil
+}
+
+func TestS3Storage(t *testing.T) {
+	tests := []struct {
+		name    string
+		put     map[string]string
+		delete  string
+		get     string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "stored object is read back",
+			put:  map[string]string{"videos/a.mp4": "video bytes"},
+			get:  "videos/a.mp4",
+			want: "video bytes",
+		},
+		{
+			name:    "missing object is errObjectNotFound",
+			get:     "videos/missing.mp4",
+			wantErr: errObjectNotFound,
+		},
+		{
+			name:    "deleted object is gone",
+			put:     map[string]string{"videos/a.mp4": "video bytes"},
+			delete:  "videos/a.mp4",
+			get:     "videos/a.mp4",
+			wantErr: errObjectNotFound,
+		},
+		{
+			name:   "deleting a missing object succeeds",
+			put:    map[string]string{"videos/a.mp4": "video bytes"},
+			delete: "videos/missing.mp4",
+			get:    "videos/a.mp4",
+			want:   "video bytes",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := newS3Storage(newFakeS3(), fakePresigner{}, testBucket, nil, "", 1)
+			for key, body := range tc.put {
+				if err := storage.Put(ctx, key, strings.NewReader(body), PutOptions{ContentType: "video/mp4"}); err != nil {
+					t.Fatalf("Put(%q): %v", key, err)
+				}
+			}
+			if tc.delete != "" {
+				if err := storage.Delete(ctx, tc.delete); err != nil {
+					t.Fatalf("Delete(%q): %v", tc.delete, err)
+				}
+			}
+
+			if body, err := storage.Get(ctx, tc.get); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Get(%q) error = %v, want %v", tc.get, err, tc.wantErr)
+			} else if err == nil {
+				body.Close()
+			}
+
+			obj, err := storage.GetRange(ctx, tc.get, "")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("GetRange(%q) error = %v, want %v", tc.get, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer obj.Body.Close()
+			body, err := io.ReadAll(obj.Body)
+			if err != nil {
+				t.Fatalf("reading %q: %v", tc.get, err)
+			}
+			if string(body) != tc.want {
+				t.Errorf("GetRange(%q) = %q, want %q", tc.get, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestS3StorageSignedURL(t *testing.T) {
+	storage := newS3Storage(newFakeS3(), fakePresigner{}, testBucket, nil, "", 1)
+	got, err := storage.SignedURL(context.Background(), "videos/a.mp4", time.Hour, SignOptions{})
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+	want := "https://" + testBucket + ".s3.test/videos/a.mp4?signed=get"
+	if got != want {
+		t.Errorf("SignedURL = %q, want %q", got, want)
+	}
+}
+
+func TestS3StoragePutEncryption(t *testing.T) {
+	const keyID = "arn:aws:kms:us-east-1:123456789012:key/test-key"
+
+	tests := []struct {
+		name           string
+		kmsKeyID       string
+		wantEncryption types.ServerSideEncryption
+		wantKeyID      *string
+	}{
+		{
+			name:           "configured key encrypts with SSE-KMS",
+			kmsKeyID:       keyID,
+			wantEncryption: types.ServerSideEncryptionAwsKms,
+			wantKeyID:      aws.String(keyID),
+		},
+		{
+			name: "no key leaves it to the bucket default",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			bucket := newFakeS3()
+			storage := newS3Storage(bucket, fakePresigner{}, testBucket, nil, tc.kmsKeyID, 1)
+			if err := storage.Put(ctx, "videos/a.mp4", strings.NewReader("video bytes"), PutOptions{ContentType: "video/mp4"}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			if len(bucket.puts) != 1 {
+				t.Fatalf("PutObject called %d times, want 1", len(bucket.puts))
+			}
+			input := bucket.puts[0]
+			if input.ServerSideEncryption != tc.wantEncryption {
+				t.Errorf("ServerSideEncryption = %q, want %q", input.ServerSideEncryption, tc.wantEncryption)
+			}
+			if aws.ToString(input.SSEKMSKeyId) != aws.ToString(tc.wantKeyID) {
+				t.Errorf("SSEKMSKeyId = %q, want %q", aws.ToString(input.SSEKMSKeyId), aws.ToString(tc.wantKeyID))
+			}
+
+			// Presigned GETs need nothing extra for SSE-KMS objects
+			if _, err := storage.SignedURL(ctx, "videos/a.mp4", time.Hour, SignOptions{}); err != nil {
+				t.Errorf("SignedURL: %v", err)
+			}
+		})
+	}
+}
+
+// countingPresigner is a fakePresigner counting the GETs it signs
+type countingPresigner struct {
+	fakePresigner
+	gets int
+}
+
+func (p *countingPresigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	p.gets++
+	return p.fakePresigner.PresignGetObject(ctx, params, optFns...)
+}
+
+func TestSignedURLCancelled(t *testing.T) {
+	tests := []struct {
+		name      string
+		cancelled bool
+		wantErr   error
+		wantSigns int
+	}{
+		{
+			name:      "live request is signed",
+			wantSigns: 2,
+		},
+		{
+			name:      "cancelled request isn't signed",
+			cancelled: true,
+			wantErr:   context.Canceled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(withRequestTenant(context.Background(), ""))
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+
+			cfg, bucket := newTestConfig(t)
+			presigner := &countingPresigner{}
+			storage := newS3Storage(bucket, presigner, testBucket, nil, "", 1)
+			regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+			if err != nil {
+				t.Fatalf("newStorageRegions: %v", err)
+			}
+			cfg.storageRegions = regions
+			cfg.presignCache = nil
+
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			videoURL := testBucket + ",users/owner/videos/landscape/abc/playback.mp4"
+			video.VideoURL = &videoURL
+
+			_, err = cfg.dbVideoToSignedVideo(ctx, video, time.Hour)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("dbVideoToSignedVideo error = %v, want %v", err, tc.wantErr)
+			}
+			if _, err := storage.SignedURL(ctx, "videos/a.mp4", time.Hour, SignOptions{}); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("SignedURL error = %v, want %v", err, tc.wantErr)
+			}
+			if presigner.gets != tc.wantSigns {
+				t.Errorf("presigned %d URLs, want %d", presigner.gets, tc.wantSigns)
+			}
+		})
+	}
+}
+
+// testS3Presigner is the SDK's own presigner with made up credentials,
+// signing happens locally so nothing is sent anywhere
+func testS3Presigner() *s3.PresignClient {
+	client := s3.New(s3.Options{
+		Region: testRegion,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return s3.NewPresignClient(client)
+}
+
+func TestGeneratePresignedURLResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            SignOptions
+		wantType        string
+		wantDisposition string
+	}{
+		{
+			name: "as stored",
+		},
+		{
+			name:     "forced content type",
+			opts:     SignOptions{ContentType: "video/mp4"},
+			wantType: "video/mp4",
+		},
+		{
+			name:            "forced content type and disposition",
+			opts:            SignOptions{ContentType: "video/mp4", ContentDisposition: `attachment; filename="a.mp4"`},
+			wantType:        "video/mp4",
+			wantDisposition: `attachment; filename="a.mp4"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			signed, err := generatePresignedURL(context.Background(), testS3Presigner(), testBucket, "videos/a.mp4", time.Hour, tc.opts)
+			if err != nil {
+				t.Fatalf("generatePresignedURL: %v", err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatalf("couldn't parse %q: %v", signed, err)
+			}
+			query := u.Query()
+			if got := query.Get("response-content-type"); got != tc.wantType {
+				t.Errorf("response-content-type = %q, want %q", got, tc.wantType)
+			}
+			if got := query.Get("response-content-disposition"); got != tc.wantDisposition {
+				t.Errorf("response-content-disposition = %q, want %q", got, tc.wantDisposition)
+			}
+			if query.Get("X-Amz-Signature") == "" {
+				t.Errorf("%q isn't signed", signed)
+			}
+		})
+	}
+}
+
+// TestDBVideoToSignedVideoContentType checks the playback file is signed
+// as video/mp4 whatever it was stored as
+func TestDBVideoToSignedVideoContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		storedType string
+	}{
+		{name: "stored as video/mp4", storedType: "video/mp4"},
+		{name: "stored without a type", storedType: ""},
+		{name: "stored as a generic type", storedType: "application/octet-stream"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			storage := newS3Storage(bucket, testS3Presigner(), testBucket, nil, "", 1)
+			regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+			if err != nil {
+				t.Fatalf("newStorageRegions: %v", err)
+			}
+			cfg.storageRegions = regions
+
+			key := "users/owner/videos/landscape/abc/playback.mp4"
+			bucket.objects[key] = fakeS3Object{body: []byte("video"), contentType: tc.storedType}
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			videoURL := testBucket + "," + key
+			video.VideoURL = &videoURL
+
+			signed, err := cfg.dbVideoToSignedVideo(withRequestTenant(context.Background(), ""), video, time.Hour)
+			if err != nil {
+				t.Fatalf("dbVideoToSignedVideo: %v", err)
+			}
+			if signed.VideoURL == nil {
+				t.Fatal("video_url wasn't signed")
+			}
+			u, err := url.Parse(*signed.VideoURL)
+			if err != nil {
+				t.Fatalf("couldn't parse %q: %v", *signed.VideoURL, err)
+			}
+			if got := u.Query().Get("response-content-type"); got != "video/mp4" {
+				t.Errorf("response-content-type = %q, want %q", got, "video/mp4")
+			}
+		})
+	}
+}
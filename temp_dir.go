@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tempFilePrefix starts the name of everything uploads and processing
+	// leave in the temp directory, derived files and HLS directories
+	// included
+	tempFilePrefix = "tubely-"
+	// The shortest TEMP_FILE_MAX_AGE, so staged uploads waiting on a busy
+	// ffmpeg aren't taken for leftovers
+	minTempFileMaxAge = time.Hour
+	tempSweepInterval = time.Hour
+)
+
+// checkTempDir makes sure uploads can be staged in dir, by creating and
+// removing a file there. It's checked at startup so a missing or read only
+// volume fails fast rather than on the first upload.
+func checkTempDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	file, err := os.CreateTemp(dir, "tubely-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// startTempSweeper deletes what crashed or killed processes left behind in
+// the temp directory, at startup and then every tempSweepInterval, until
+// ctx is cancelled
+func (cfg *apiConfig) startTempSweeper(ctx context.Context, maxAge time.Duration) {
+	dir := cfg.tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	go func() {
+		ticker := time.NewTicker(tempSweepInterval)
+		defer ticker.Stop()
+		for {
+			files, bytes, err := sweepTempDir(dir, time.Now().Add(-maxAge))
+			if err != nil {
+				log.Printf("couldn't clean up temp directory %s: %v", dir, err)
+			}
+			if files > 0 {
+				log.Printf("deleted %d leftover temp files from %s, reclaiming %d bytes", files, dir, bytes)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sweepTempDir deletes the files and directories of ours in dir last
+// modified before cutoff, reporting how many files and bytes went. Work in
+// progress keeps being written to, so only what's been left alone for long
+// enough goes. Failures to delete are logged and skipped.
+func sweepTempDir(dir string, cutoff time.Time) (files int, bytes int64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		n, size := 1, info.Size()
+		if entry.IsDir() {
+			n, size = 0, 0
+			filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					if info, err := d.Info(); err == nil {
+						n++
+						size += info.Size()
+					}
+				}
+				return nil
+			})
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("couldn't delete leftover temp file %s: %v", path, err)
+			continue
+		}
+		files += n
+		bytes += size
+	}
+	return files, bytes, nil
+}
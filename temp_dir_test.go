@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepTempDir(t *testing.T) {
+	type entry struct {
+		name string
+		age  time.Duration
+		size int
+		dir  bool // an HLS directory holding a file of size
+	}
+	tests := []struct {
+		name      string
+		entries   []entry
+		wantKept  []string
+		wantFiles int
+		wantBytes int64
+	}{
+		{
+			name:      "old upload is removed, fresh one kept",
+			entries:   []entry{{name: "tubely-upload-1.mp4", age: 48 * time.Hour, size: 100}, {name: "tubely-upload-2.mp4", age: time.Minute, size: 200}},
+			wantKept:  []string{"tubely-upload-2.mp4"},
+			wantFiles: 1,
+			wantBytes: 100,
+		},
+		{
+			name:      "old processing file is removed",
+			entries:   []entry{{name: "tubely-upload-1.mp4.processing", age: 48 * time.Hour, size: 300}},
+			wantFiles: 1,
+			wantBytes: 300,
+		},
+		{
+			name:      "old HLS directory is removed with its files",
+			entries:   []entry{{name: "tubely-hls-1", age: 48 * time.Hour, size: 50, dir: true}},
+			wantFiles: 1,
+			wantBytes: 50,
+		},
+		{
+			name:     "file just inside the age is kept",
+			entries:  []entry{{name: "tubely-upload-1.mp4", age: 23 * time.Hour, size: 100}},
+			wantKept: []string{"tubely-upload-1.mp4"},
+		},
+		{
+			name:     "someone else's old file is kept",
+			entries:  []entry{{name: "other-app.tmp", age: 48 * time.Hour, size: 100}},
+			wantKept: []string{"other-app.tmp"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, e := range tc.entries {
+				path := filepath.Join(dir, e.name)
+				file := path
+				if e.dir {
+					if err := os.Mkdir(path, 0o700); err != nil {
+						t.Fatalf("couldn't create %s: %v", e.name, err)
+					}
+					file = filepath.Join(path, "segment_00000.ts")
+				}
+				if err := os.WriteFile(file, make([]byte, e.size), 0o600); err != nil {
+					t.Fatalf("couldn't write %s: %v", e.name, err)
+				}
+				modTime := time.Now().Add(-e.age)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatalf("couldn't age %s: %v", e.name, err)
+				}
+			}
+
+			files, bytes, err := sweepTempDir(dir, time.Now().Add(-24*time.Hour))
+			if err != nil {
+				t.Fatalf("sweepTempDir: %v", err)
+			}
+			if files != tc.wantFiles || bytes != tc.wantBytes {
+				t.Errorf("sweepTempDir reclaimed %d files and %d bytes, want %d and %d", files, bytes, tc.wantFiles, tc.wantBytes)
+			}
+
+			left, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("couldn't list %s: %v", dir, err)
+			}
+			var kept []string
+			for _, e := range left {
+				kept = append(kept, e.Name())
+			}
+			if len(kept) != len(tc.wantKept) {
+				t.Fatalf("kept %v, want %v", kept, tc.wantKept)
+			}
+			for i := range kept {
+				if kept[i] != tc.wantKept[i] {
+					t.Errorf("kept %v, want %v", kept, tc.wantKept)
+				}
+			}
+		})
+	}
+}
+
+// TestStartTempSweeper checks leftovers are swept at startup, without
+// waiting for the first interval
+func TestStartTempSweeper(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	oldPath := filepath.Join(cfg.tempDir, "tubely-upload-old.mp4")
+	freshPath := filepath.Join(cfg.tempDir, "tubely-upload-fresh.mp4")
+	for _, path := range []string{oldPath, freshPath} {
+		if err := os.WriteFile(path, []byte("upload"), 0o600); err != nil {
+			t.Fatalf("couldn't write %s: %v", path, err)
+		}
+	}
+	modTime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldPath, modTime, modTime); err != nil {
+		t.Fatalf("couldn't age %s: %v", oldPath, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg.startTempSweeper(ctx, cfg.tempFileMaxAge)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(oldPath)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old upload wasn't swept at startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(freshPath); err != nil {
+		t.Errorf("fresh upload was swept: %v", err)
+	}
+}
+
+func TestCheckTempDir(t *testing.T) {
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatalf("couldn't write %s: %v", notDir, err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		wantErr bool
+	}{
+		{name: "writable directory", dir: t.TempDir()},
+		{name: "missing directory", dir: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+		{name: "file instead of a directory", dir: notDir, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkTempDir(tc.dir)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkTempDir error = %v, want error: %v", err, tc.wantErr)
+			}
+			if err == nil {
+				if left, _ := os.ReadDir(tc.dir); len(left) != 0 {
+					t.Errorf("checkTempDir left %d files behind", len(left))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// tenantsKeyPrefix is where the objects of users who belong to a tenant
+// are kept, one prefix per tenant. Users with no tenant, everyone before
+// tenants were introduced, keep the unprefixed layout.
+const tenantsKeyPrefix = "tenants/"
+
+var (
+	errWrongTenant     = errors.New("object belongs to another tenant")
+	errNoRequestTenant = errors.New("no tenant to sign objects for")
+)
+
+// tenantKey is key as stored for a user of tenantID
+func tenantKey(tenantID, key string) string {
+	if tenantID == "" {
+		return key
+	}
+	return tenantsKeyPrefix + tenantID + "/" + key
+}
+
+type requestTenantKey struct{}
+
+// withRequestTenant records which tenant objects are fetched for. Requests
+// get the tenant of whoever made them, code that acts for the owner of a
+// video, such as share links and webhooks, sets the owner's.
+func withRequestTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, requestTenantKey{}, tenantID)
+}
+
+// requestTenant is the tenant objects are stored for in ctx, empty if it
+// has none
+func requestTenant(ctx context.Context) string {
+	tenantID, _ := ctx.Value(requestTenantKey{}).(string)
+	return tenantID
+}
+
+// checkTenantKey makes sure key belongs to the tenant objects are fetched
+// for in ctx, so a bug elsewhere can't hand one tenant a URL for another's
+// objects. Contexts that don't say whose objects they fetch can't sign any.
+func checkTenantKey(ctx context.Context, key string) error {
+	tenantID, ok := ctx.Value(requestTenantKey{}).(string)
+	if !ok {
+		return errNoRequestTenant
+	}
+	if tenantID == "" {
+		if strings.HasPrefix(key, tenantsKeyPrefix) {
+			return fmt.Errorf("%w: %s", errWrongTenant, key)
+		}
+		return nil
+	}
+	if !strings.HasPrefix(key, tenantKey(tenantID, "")) {
+		return fmt.Errorf("%w: %s", errWrongTenant, key)
+	}
+	return nil
+}
+
+// userTenant is the tenant userID belongs to
+func (cfg *apiConfig) userTenant(userID uuid.UUID) (string, error) {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", fmt.Errorf("user %s not found", userID)
+	}
+	return user.TenantID, nil
+}
+
+// withOwnerTenant is ctx set to fetch the objects of ownerID's videos
+func (cfg *apiConfig) withOwnerTenant(ctx context.Context, ownerID uuid.UUID) (context.Context, error) {
+	tenantID, err := cfg.userTenant(ownerID)
+	if err != nil {
+		return ctx, err
+	}
+	return withRequestTenant(ctx, tenantID), nil
+}
+
+// tenantMiddleware records the tenant of whoever the request is
+// authenticated as. It doesn't turn anything away: handlers check
+// credentials as before, requests it can't place just get no tenant.
+func (cfg *apiConfig) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenantID, ok := cfg.callerTenant(r); ok {
+			r = r.WithContext(withRequestTenant(r.Context(), tenantID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// callerTenant is the tenant of the API key or JWT the request carries,
+// checked the same way authenticateUploadRequest checks them
+func (cfg *apiConfig) callerTenant(r *http.Request) (string, bool) {
+	if key, err := auth.GetAPIKey(r.Header); err == nil {
+		apiKey, err := cfg.db.GetAPIKeyByHash(auth.HashAPIKey(key))
+		if err != nil || apiKey.ID == uuid.Nil || apiKey.RevokedAt != nil {
+			return "", false
+		}
+		tenantID, err := cfg.userTenant(apiKey.UserID)
+		return tenantID, err == nil
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return "", false
+	}
+	claims, err := auth.ValidateAccessJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return "", false
+	}
+	return claims.TenantID, true
+}
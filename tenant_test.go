@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckTenantKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		key     string
+		wantErr error
+	}{
+		{
+			name: "tenant's own key",
+			ctx:  withRequestTenant(context.Background(), "acme"),
+			key:  "tenants/acme/users/u1/videos/landscape/v1/playback.mp4",
+		},
+		{
+			name:    "another tenant's key",
+			ctx:     withRequestTenant(context.Background(), "acme"),
+			key:     "tenants/globex/users/u2/videos/landscape/v2/playback.mp4",
+			wantErr: errWrongTenant,
+		},
+		{
+			name:    "tenant whose ID the key merely starts with",
+			ctx:     withRequestTenant(context.Background(), "acme"),
+			key:     "tenants/acme-evil/users/u2/videos/landscape/v2/playback.mp4",
+			wantErr: errWrongTenant,
+		},
+		{
+			name:    "tenant signing an unprefixed key",
+			ctx:     withRequestTenant(context.Background(), "acme"),
+			key:     "users/u1/videos/landscape/v1/playback.mp4",
+			wantErr: errWrongTenant,
+		},
+		{
+			name: "no tenant, unprefixed key",
+			ctx:  withRequestTenant(context.Background(), ""),
+			key:  "users/u1/videos/landscape/v1/playback.mp4",
+		},
+		{
+			name:    "no tenant, a tenant's key",
+			ctx:     withRequestTenant(context.Background(), ""),
+			key:     "tenants/acme/users/u1/videos/landscape/v1/playback.mp4",
+			wantErr: errWrongTenant,
+		},
+		{
+			name:    "context that doesn't say",
+			ctx:     context.Background(),
+			key:     "users/u1/videos/landscape/v1/playback.mp4",
+			wantErr: errNoRequestTenant,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkTenantKey(tc.ctx, tc.key); !errors.Is(err, tc.wantErr) {
+				t.Errorf("checkTenantKey error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestSignStoredURLOtherTenant checks a key of another tenant isn't signed,
+// not even when a URL for it is already cached
+func TestSignStoredURLOtherTenant(t *testing.T) {
+	const globexKey = "tenants/globex/users/u2/videos/landscape/v2/playback.mp4"
+
+	tests := []struct {
+		name     string
+		tenantID string
+		wantErr  error
+	}{
+		{name: "owning tenant", tenantID: "globex"},
+		{name: "another tenant", tenantID: "acme", wantErr: errWrongTenant},
+		{name: "no tenant", tenantID: "", wantErr: errWrongTenant},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			presigner := &countingPresigner{}
+			storage := newS3Storage(bucket, presigner, testBucket, nil, "", 1)
+			regions, err := newStorageRegions(testRegion, map[string]Storage{testRegion: storage})
+			if err != nil {
+				t.Fatalf("newStorageRegions: %v", err)
+			}
+			cfg.storageRegions = regions
+			stored := testBucket + "," + globexKey
+
+			// The owner's URL is in the presign cache from here on
+			globexCtx := withRequestTenant(context.Background(), "globex")
+			if _, err := cfg.signStoredURL(globexCtx, stored, time.Hour, SignOptions{}); err != nil {
+				t.Fatalf("signing for the owning tenant: %v", err)
+			}
+
+			url, err := cfg.signStoredURL(withRequestTenant(context.Background(), tc.tenantID), stored, time.Hour, SignOptions{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("signStoredURL error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil && url != "" {
+				t.Errorf("signStoredURL handed out %q for another tenant's key", url)
+			}
+			if presigner.gets != 1 {
+				t.Errorf("%d URLs presigned, want 1", presigner.gets)
+			}
+		})
+	}
+}
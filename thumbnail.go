@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const defaultThumbnailSeconds = 1.0
+
+// extractThumbnail grabs a single JPEG frame from the video. The capture
+// time is clamped to its duration, 0 if unknown, so short clips still
+// yield a frame.
+func (cfg *apiConfig) extractThumbnail(videoPath string, duration, atSeconds float64) (string, error) {
+	absPath, err := filepath.Abs(videoPath)
+	if err != nil {
+		return "", err
+	}
+
+	if duration > 0 && atSeconds >= duration {
+		// Seeking to the very last instant yields no frame, so back off a bit
+		atSeconds = max(duration-0.1, 0)
+	}
+	if atSeconds < 0 {
+		atSeconds = 0
+	}
+
+	thumbnailPath := absPath + ".thumbnail.jpg"
+	if err := cfg.extractFrame(absPath, atSeconds, thumbnailPath); err != nil {
+		return "", err
+	}
+	return thumbnailPath, nil
+}
+
+// extractFrame writes the frame at atSeconds of input, a file path or URL,
+// to outputPath as a JPEG. Reading a URL can stall, so this is bounded by
+// cfg.ffmpegTimeout like the probes.
+func (cfg *apiConfig) extractFrame(input string, atSeconds float64, outputPath string) error {
+	cmd := cfg.mediaCommand(
+		cfg.ffmpegPath,
+		"-y",
+		"-ss", strconv.FormatFloat(atSeconds, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1",
+		"-q:v", "2",
+		outputPath,
+	)
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to extract thumbnail: %w", err)
+	}
+	return nil
+}
+
+// saveThumbnailAsset stores a JPEG from disk as videoID's thumbnail, at the
+// same sizes handlerUploadThumbnail produces for uploads.
+func (cfg *apiConfig) saveThumbnailAsset(ctx context.Context, videoID uuid.UUID, thumbnailPath string) ([]database.VideoThumbnail, error) {
+	src, err := os.Open(thumbnailPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	img, err := decodeThumbnail(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.saveThumbnailSizes(ctx, videoID, img, "image/jpeg")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxThumbnailDataURLBytes caps a data URL thumbnail once decoded, the
+// same as the memory a multipart upload is parsed into
+const maxThumbnailDataURLBytes = 10 << 20 // 10 MB
+
+// readThumbnailDataURL reads a JSON body of the form
+// {"thumbnail": "data:image/png;base64,..."} and returns the decoded image
+// and the media type the data URL declares. The bytes aren't checked
+// against that type, storeThumbnail does it as for any upload. Failures
+// are a *thumbnailUploadError.
+func readThumbnailDataURL(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	type parameters struct {
+		Thumbnail string `json:"thumbnail"`
+	}
+
+	// Base64 takes 4 bytes for every 3, plus room for the JSON around it
+	params := parameters{}
+	if err := decodeJSONBodyLimit(w, r, &params, int64(base64.StdEncoding.EncodedLen(maxThumbnailDataURLBytes)+1024)); err != nil {
+		var bodyErr *jsonBodyError
+		if !errors.As(err, &bodyErr) {
+			return nil, "", &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidJSON, "Couldn't decode parameters", err}
+		}
+		if bodyErr.code == errCodeBodyTooLarge {
+			return nil, "", &thumbnailUploadError{http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail exceeds the maximum size of %d MB", maxThumbnailDataURLBytes>>20), err}
+		}
+		return nil, "", &thumbnailUploadError{http.StatusBadRequest, bodyErr.code, bodyErr.message, err}
+	}
+	if params.Thumbnail == "" {
+		return nil, "", &thumbnailUploadError{http.StatusBadRequest, errCodeMissingFile, "Missing 'thumbnail' data URL", nil}
+	}
+
+	data, mediaType, err := decodeDataURL(params.Thumbnail)
+	if err != nil {
+		return nil, "", &thumbnailUploadError{http.StatusBadRequest, errCodeInvalidImage, "Invalid thumbnail data URL", err}
+	}
+	if len(data) > maxThumbnailDataURLBytes {
+		return nil, "", &thumbnailUploadError{http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail exceeds the maximum size of %d MB", maxThumbnailDataURLBytes>>20), nil}
+	}
+	return data, mediaType, nil
+}
+
+// decodeDataURL decodes a base64 data URL, "data:<media type>;base64,<data>",
+// returning its bytes and media type. Padding is optional, not every
+// encoder writes it.
+func decodeDataURL(dataURL string) ([]byte, string, error) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return nil, "", errors.New("not a data URL")
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, "", errors.New("data URL has no data")
+	}
+	header, ok = strings.CutSuffix(header, ";base64")
+	if !ok {
+		return nil, "", errors.New("data URL isn't base64 encoded")
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil, "", fmt.Errorf("data URL media type: %w", err)
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed base64: %w", err)
+	}
+	return data, mediaType, nil
+}
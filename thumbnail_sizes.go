@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Widths the frontend displays thumbnails at, smallest first. The largest
+// one doubles as the video's ThumbnailURL.
+var thumbnailWidths = []int{320, 1280}
+
+// Anything bigger is rejected before decoding, a small compressed file can
+// otherwise expand into gigabytes of pixels
+const maxThumbnailDimension = 8000
+
+const defaultThumbnailJPEGQuality = 85
+
+const (
+	// Fitting a thumbnail into cfg.thumbnailMaxBytes lowers the JPEG
+	// quality down to minFitJPEGQuality, then shrinks the image, but never
+	// narrower than minFitThumbnailWidth
+	minFitJPEGQuality    = 40
+	minFitThumbnailWidth = 64
+	// Small enough limits can't be met even at minFitThumbnailWidth
+	minThumbnailMaxBytes = 16 << 10 // 16 KB
+)
+
+// Thumbnail types that can be decoded, which THUMBNAIL_TYPES picks from
+var supportedThumbnailTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// Thumbnail types that may be animated. They can't be re-encoded without
+// losing the animation, so the upload is stored as-is and the resized sizes
+// are static JPEGs of the first frame.
+var animatedThumbnailTypes = map[string]bool{
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var errThumbnailTooLarge = fmt.Errorf("image dimensions exceed %dpx", maxThumbnailDimension)
+
+var errThumbnailDoesNotFit = errors.New("thumbnail doesn't fit the maximum size")
+
+// decodeThumbnail checks the image header before decoding the full image.
+// JPEGs are turned upright according to their EXIF orientation, since the
+// tag is lost once the pixels are re-encoded.
+func decodeThumbnail(r io.ReadSeeker) (image.Image, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > maxThumbnailDimension || config.Height > maxThumbnailDimension {
+		return nil, errThumbnailTooLarge
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return nil, errors.New("image has no pixels")
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil || format != "jpeg" {
+		return img, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return orientImage(img, jpegOrientation(r)), nil
+}
+
+// saveThumbnailSizes stores a resized copy of img for each of
+// thumbnailWidths, encoded as mediaType (image/jpeg or image/png), for the
+// video videoID. Images narrower than a size are stored at their own width.
+func (cfg *apiConfig) saveThumbnailSizes(ctx context.Context, videoID uuid.UUID, img image.Image, mediaType string) ([]database.VideoThumbnail, error) {
+	thumbnails := make([]database.VideoThumbnail, 0, len(thumbnailWidths))
+	for _, width := range thumbnailWidths {
+		resized := resizeImage(img, width)
+		thumbnail, err := cfg.writeImageAsset(ctx, fmt.Sprintf("%s-%d", videoID, width), resized, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, thumbnail)
+	}
+	return thumbnails, nil
+}
+
+// thumbnailSizesBytes is what thumbnails take up in storage
+func thumbnailSizesBytes(thumbnails []database.VideoThumbnail) int64 {
+	var total int64
+	for _, thumbnail := range thumbnails {
+		total += thumbnail.Size
+	}
+	return total
+}
+
+// saveOriginalAsset stores an upload for the video videoID unchanged and
+// returns the URL to record for it
+func (cfg *apiConfig) saveOriginalAsset(ctx context.Context, videoID uuid.UUID, r io.ReadSeeker, mediaType string) (string, error) {
+	contentHash, err := assetContentHash(r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return cfg.putAsset(ctx, getAssetPath(videoID.String(), contentHash, mediaType), r, mediaType)
+}
+
+// writeImageAsset encodes and stores img under name, reporting the
+// dimensions and byte size it was stored at, which are smaller than img's
+// if it had to be shrunk to fit cfg.thumbnailMaxBytes
+func (cfg *apiConfig) writeImageAsset(ctx context.Context, name string, img image.Image, mediaType string) (database.VideoThumbnail, error) {
+	data, img, err := cfg.encodeThumbnail(img, mediaType)
+	if err != nil {
+		return database.VideoThumbnail{}, err
+	}
+	contentHash, err := assetContentHash(bytes.NewReader(data))
+	if err != nil {
+		return database.VideoThumbnail{}, err
+	}
+	url, err := cfg.putAsset(ctx, getAssetPath(name, contentHash, mediaType), bytes.NewReader(data), mediaType)
+	if err != nil {
+		return database.VideoThumbnail{}, err
+	}
+	return database.VideoThumbnail{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+		Size:   int64(len(data)),
+		URL:    url,
+	}, nil
+}
+
+// encodeThumbnail encodes img as mediaType (image/jpeg or image/png). If
+// the result is over cfg.thumbnailMaxBytes it's re-encoded, at a lower
+// JPEG quality first, then at a lower resolution, until it fits. It
+// returns the image that was encoded along with its bytes.
+func (cfg *apiConfig) encodeThumbnail(img image.Image, mediaType string) ([]byte, image.Image, error) {
+	quality := cfg.thumbnailJPEGQuality
+	for {
+		var buf bytes.Buffer
+		var err error
+		switch mediaType {
+		case "image/png":
+			encoder := png.Encoder{CompressionLevel: png.BestCompression}
+			err = encoder.Encode(&buf, img)
+		default:
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if cfg.thumbnailMaxBytes == 0 || int64(buf.Len()) <= cfg.thumbnailMaxBytes {
+			return buf.Bytes(), img, nil
+		}
+
+		if mediaType != "image/png" && quality > minFitJPEGQuality {
+			quality = max(quality-10, minFitJPEGQuality)
+			continue
+		}
+		width := img.Bounds().Dx() * 3 / 4
+		if width < minFitThumbnailWidth {
+			return nil, nil, fmt.Errorf("%w: still %d bytes at %dpx wide", errThumbnailDoesNotFit, buf.Len(), img.Bounds().Dx())
+		}
+		img = resizeImage(img, width)
+	}
+}
+
+// resizeImage scales img down to width, keeping its aspect ratio, by
+// averaging every source pixel that falls under each destination pixel.
+// Images already narrower than width are returned unchanged.
+func resizeImage(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= width {
+		return img
+	}
+	height := max(srcH*width/srcW, 1)
+
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max((y+1)*srcH/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max((x+1)*srcW/width, x0+1)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(b / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// deleteReplacedThumbnails removes the sizes of previous's thumbnail that
+// current, as now saved, no longer uses. Names are content addressed, so
+// uploading the same image again keeps them. Failures are only logged, the
+// new thumbnail is in place either way.
+func (cfg *apiConfig) deleteReplacedThumbnails(ctx context.Context, previous, current database.Video) {
+	inUse := map[string]bool{}
+	for _, thumbnail := range current.Thumbnails {
+		inUse[thumbnail.URL] = true
+	}
+	if current.ThumbnailURL != nil {
+		inUse[*current.ThumbnailURL] = true
+	}
+
+	replaced := database.Video{ID: previous.ID}
+	for _, thumbnail := range previous.Thumbnails {
+		if !inUse[thumbnail.URL] {
+			replaced.Thumbnails = append(replaced.Thumbnails, thumbnail)
+		}
+	}
+	if previous.ThumbnailURL != nil && !inUse[*previous.ThumbnailURL] {
+		replaced.ThumbnailURL = previous.ThumbnailURL
+	}
+	if err := cfg.deleteThumbnailAssets(ctx, replaced); err != nil {
+		slog.WarnContext(ctx, "couldn't delete replaced thumbnail", "video_id", previous.ID, "error", err)
+	}
+}
+
+// deleteThumbnailAssets removes every stored size of a video's thumbnail
+func (cfg *apiConfig) deleteThumbnailAssets(ctx context.Context, video database.Video) error {
+	urls := make([]string, 0, len(video.Thumbnails)+1)
+	for _, thumbnail := range video.Thumbnails {
+		urls = append(urls, thumbnail.URL)
+	}
+	if video.ThumbnailURL != nil {
+		urls = append(urls, *video.ThumbnailURL)
+	}
+	for _, url := range urls {
+		if err := cfg.deleteAssetByURL(ctx, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
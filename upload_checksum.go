@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+)
+
+// Headers a client can set on the video part of an upload form to have
+// the bytes checked on arrival. Content-MD5 is base64 as in RFC 1864,
+// X-Checksum-SHA256 either base64 or hex, as sha256sum prints it.
+const (
+	contentMD5Header     = "Content-MD5"
+	checksumSHA256Header = "X-Checksum-SHA256"
+)
+
+// uploadChecksums are the digests a client sent with an upload, nil for
+// the ones it didn't
+type uploadChecksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// parseUploadChecksums reads the checksum headers of an upload's form part,
+// failures are a *videoUploadError
+func parseUploadChecksums(header textproto.MIMEHeader) (uploadChecksums, error) {
+	var sums uploadChecksums
+	if v := header.Get(contentMD5Header); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return sums, &videoUploadError{http.StatusBadRequest, errCodeInvalidChecksum, "Content-MD5 must be a base64 MD5 digest", err}
+		}
+		sums.md5 = sum
+	}
+	if v := header.Get(checksumSHA256Header); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return sums, &videoUploadError{http.StatusBadRequest, errCodeInvalidChecksum, "X-Checksum-SHA256 must be a hex or base64 SHA-256 digest", err}
+		}
+		sums.sha256 = sum
+	}
+	return sums, nil
+}
+
+// verify compares the digests the client sent with those of the bytes
+// received, md5Sum only being needed if the client sent one. A mismatch is
+// a *videoUploadError.
+func (s uploadChecksums) verify(md5Sum, sha256Sum []byte) error {
+	if s.md5 != nil && !bytes.Equal(s.md5, md5Sum) {
+		return checksumMismatch(contentMD5Header)
+	}
+	if s.sha256 != nil && !bytes.Equal(s.sha256, sha256Sum) {
+		return checksumMismatch(checksumSHA256Header)
+	}
+	return nil
+}
+
+func checksumMismatch(header string) error {
+	return &videoUploadError{http.StatusBadRequest, errCodeChecksumMismatch, fmt.Sprintf("Video doesn't match its %s, it was corrupted in transit", header), nil}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// newChecksummedVideoUploadRequest is newVideoUploadRequest with headers
+// set on the video part
+func newChecksummedVideoUploadRequest(t *testing.T, videoID uuid.UUID, body []byte, headers map[string]string) *http.Request {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("couldn't create form part: %v", err)
+	}
+	part.Write(body)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &form)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestHandlerUploadVideoChecksum(t *testing.T) {
+	sent := []byte("the video as the client sent it")
+	mangled := bytes.Clone(sent)
+	mangled[4] ^= 0x20
+	md5Sum := md5.Sum(sent)
+	sha256Sum := sha256.Sum256(sent)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		headers    map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "no checksum",
+			body:       sent,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "matching Content-MD5",
+			body:       sent,
+			headers:    map[string]string{contentMD5Header: base64.StdEncoding.EncodeToString(md5Sum[:])},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "matching hex SHA-256",
+			body:       sent,
+			headers:    map[string]string{checksumSHA256Header: hex.EncodeToString(sha256Sum[:])},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "matching base64 SHA-256",
+			body:       sent,
+			headers:    map[string]string{checksumSHA256Header: base64.StdEncoding.EncodeToString(sha256Sum[:])},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "mangled body with the original's Content-MD5",
+			body:       mangled,
+			headers:    map[string]string{contentMD5Header: base64.StdEncoding.EncodeToString(md5Sum[:])},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeChecksumMismatch,
+		},
+		{
+			name:       "mangled body with the original's SHA-256",
+			body:       mangled,
+			headers:    map[string]string{checksumSHA256Header: hex.EncodeToString(sha256Sum[:])},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeChecksumMismatch,
+		},
+		{
+			name: "mangled body with one matching checksum of two",
+			body: mangled,
+			headers: map[string]string{
+				contentMD5Header:     base64.StdEncoding.EncodeToString(md5Sum[:]),
+				checksumSHA256Header: func() string { sum := sha256.Sum256(mangled); return hex.EncodeToString(sum[:]) }(),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeChecksumMismatch,
+		},
+		{
+			name:       "checksum that isn't a digest",
+			body:       sent,
+			headers:    map[string]string{contentMD5Header: "not-a-digest"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeInvalidChecksum,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, bucket := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newChecksummedVideoUploadRequest(t, video.ID, tc.body, tc.headers)
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if body.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tc.wantCode)
+			}
+
+			if tc.wantCode != "" {
+				if len(bucket.puts) != 0 || len(cfg.videoJobs) != 0 {
+					t.Errorf("rejected upload left %d objects and %d jobs", len(bucket.puts), len(cfg.videoJobs))
+				}
+				return
+			}
+			// S3 is asked to check the staged upload against what was
+			// received
+			received := sha256.Sum256(tc.body)
+			var staged bool
+			for _, put := range bucket.puts {
+				if !strings.Contains(aws.ToString(put.Key), "uploads/") {
+					continue
+				}
+				staged = true
+				if put.ChecksumAlgorithm != types.ChecksumAlgorithmSha256 {
+					t.Errorf("ChecksumAlgorithm = %q, want %q", put.ChecksumAlgorithm, types.ChecksumAlgorithmSha256)
+				}
+				if got, want := aws.ToString(put.ChecksumSHA256), base64.StdEncoding.EncodeToString(received[:]); got != want {
+					t.Errorf("ChecksumSHA256 = %q, want %q", got, want)
+				}
+			}
+			if !staged {
+				t.Error("the upload wasn't staged in storage")
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+)
+
+// videoValidation is what a validateOnly upload reports about the file
+type videoValidation struct {
+	Valid       bool     `json:"valid"`
+	MediaType   string   `json:"media_type"`
+	Size        int64    `json:"size"`
+	FormatName  string   `json:"format_name"`
+	VideoCodec  string   `json:"video_codec"`
+	Width       int      `json:"width"`
+	Height      int      `json:"height"`
+	Duration    float64  `json:"duration"`
+	AspectRatio string   `json:"aspect_ratio"`
+	Orientation string   `json:"orientation"`
+	Warnings    []string `json:"warnings"`
+}
+
+// validateVideoUpload runs a local copy of an upload through the checks
+// processing would, up to detecting its orientation, and reports what it
+// found. Nothing is stored. Failures are a *videoUploadError, the same
+// ones a real upload would get.
+func (cfg *apiConfig) validateVideoUpload(filePath, mediaType string, size int64) (videoValidation, error) {
+	meta, err := cfg.validateVideoFile(filePath)
+	if err != nil {
+		return videoValidation{}, videoFileError(err)
+	}
+	if !videoFormatMatchesType(meta.FormatName, mediaType) {
+		return videoValidation{}, &videoUploadError{http.StatusBadRequest, errCodeContentMismatch, "file contents do not match declared type", nil}
+	}
+
+	transcode, err := cfg.codecNeedsTranscode(meta.VideoCodec)
+	if err != nil {
+		return videoValidation{}, &videoUploadError{http.StatusUnprocessableEntity, errCodeUnsupportedCodec, unsupportedCodecMessage(meta.VideoCodec), err}
+	}
+
+	warnings := []string{}
+	if mediaType != "video/mp4" || transcode {
+		warnings = append(warnings, "video will be transcoded to H.264 MP4, which takes longer to process")
+	}
+	if min(meta.Width, meta.Height) < renditionHeights[0] {
+		warnings = append(warnings, "video is smaller than the lowest rendition, only the original will be stored")
+	}
+
+	return videoValidation{
+		Valid:       true,
+		MediaType:   mediaType,
+		Size:        size,
+		FormatName:  meta.FormatName,
+		VideoCodec:  meta.VideoCodec,
+		Width:       meta.Width,
+		Height:      meta.Height,
+		Duration:    meta.Duration,
+		AspectRatio: meta.AspectRatio(),
+		Orientation: classifyOrientation(meta.Width, meta.Height),
+		Warnings:    warnings,
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// accessError carries the status and message a handler should respond
+// with when a request can't be authenticated or may not touch a video
+type accessError struct {
+	status  int
+	code    string
+	message string
+	err     error
+}
+
+func (e *accessError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *accessError) Unwrap() error {
+	return e.err
+}
+
+func respondWithAccessError(w http.ResponseWriter, err error) {
+	var accessErr *accessError
+	if errors.As(err, &accessErr) {
+		respondWithErrorCode(w, accessErr.status, accessErr.code, accessErr.message, accessErr.err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't authorize request", err)
+}
+
+// videoRole is what a user may do with a video, each allowing everything
+// the ones before it do
+type videoRole int
+
+const (
+	videoRoleNone videoRole = iota
+	videoRoleViewer
+	videoRoleEditor
+	// Only the owner may upload, share, delete or manage access
+	videoRoleOwner
+)
+
+// videoRoleOf returns userID's role on video: owner, or whatever the owner
+// granted them
+func (cfg *apiConfig) videoRoleOf(video database.Video, userID uuid.UUID) (videoRole, error) {
+	if video.UserID == userID {
+		return videoRoleOwner, nil
+	}
+	granted, err := cfg.db.CheckAccess(video.ID, userID)
+	if err != nil {
+		return videoRoleNone, err
+	}
+	switch granted {
+	case database.VideoRoleViewer:
+		return videoRoleViewer, nil
+	case database.VideoRoleEditor:
+		return videoRoleEditor, nil
+	}
+	return videoRoleNone, nil
+}
+
+// checkVideoAccess checks userID has at least role need on video, failures
+// are an *accessError. Videos the user can't see at all are reported as
+// not found to readers, so they don't learn which IDs exist.
+func (cfg *apiConfig) checkVideoAccess(video database.Video, userID uuid.UUID, need videoRole) error {
+	role, err := cfg.videoRoleOf(video, userID)
+	if err != nil {
+		return &accessError{http.StatusInternalServerError, errCodeInternal, "Couldn't check video access", err}
+	}
+	if role >= need {
+		return nil
+	}
+	switch {
+	case need == videoRoleViewer:
+		return &accessError{http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil}
+	case need == videoRoleOwner && role != videoRoleNone:
+		return &accessError{http.StatusUnauthorized, errCodeNotOwner, "Only the video's owner can do that", nil}
+	}
+	return &accessError{http.StatusUnauthorized, errCodeNotOwner, "Not authorized to modify this video", nil}
+}
+
+// authorizeVideoAccess authenticates the request and loads the video named
+// by its videoID path value, checking the caller has at least role need on
+// it. It's meant to run before any expensive work, failures are an
+// *accessError.
+func (cfg *apiConfig) authorizeVideoAccess(r *http.Request, need videoRole) (database.Video, uuid.UUID, error) {
+	userID, err := cfg.authenticateUploadRequest(r)
+	if err != nil {
+		return database.Video{}, uuid.Nil, err
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		return database.Video{}, uuid.Nil, &accessError{http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err}
+	}
+	if videoID == uuid.Nil {
+		return database.Video{}, uuid.Nil, &accessError{http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", nil}
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, uuid.Nil, &accessError{http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err}
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, uuid.Nil, &accessError{http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil}
+	}
+	if err := cfg.checkVideoAccess(video, userID, need); err != nil {
+		return database.Video{}, uuid.Nil, err
+	}
+	return video, userID, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoSource is an upload that has been staged on local disk
+type videoSource struct {
+	path      string  // local copy read by ffprobe and ffmpeg
+	mediaType string  // declared media type of the upload
+	fastStart bool    // already a faststart MP4, so the ffmpeg pass is skipped
+	storage   Storage // where the processed video and its files are stored
+	tenantID  string  // whose prefix the video's files are stored under
+	// storageClass applies to every object stored for the video, empty
+	// meaning defaultStorageClass
+	storageClass string
+	// watermarkPath, if set, is a PNG logo to burn into the video at
+	// watermarkPosition
+	watermarkPath     string
+	watermarkPosition string
+	// normalizeAudio brings the audio to cfg.loudnessTarget
+	normalizeAudio bool
+	// keepOriginal stores the upload itself next to the processed video,
+	// for the video to be reprocessed from later
+	keepOriginal bool
+	// rotate is how many degrees clockwise to turn the video, it's never
+	// set along with watermarkPath
+	rotate int
+	// fromPlayback means path is the video's own playback file. Its
+	// original, if kept, stays as it is, and so does whatever else describes
+	// the upload.
+	fromPlayback bool
+}
+
+// Stored objects of a processed video, under its key base
+const (
+	playbackVideoName = "playback.mp4"
+	originalVideoName = "original"
+)
+
+// originalVideoExts keep an original's container recognizable from its key
+var originalVideoExts = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+}
+
+func originalVideoKey(videoKeyBase, mediaType string) string {
+	ext, ok := originalVideoExts[mediaType]
+	if !ok {
+		ext = mediaTypeToExt(mediaType)
+	}
+	return videoKeyBase + "/" + originalVideoName + ext
+}
+
+// videoProcessingError carries the status and message a handler should
+// respond with when an ffmpeg step it ran fails
+type videoProcessingError struct {
+	status  int
+	code    string
+	message string
+	err     error
+}
+
+func (e *videoProcessingError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *videoProcessingError) Unwrap() error {
+	return e.err
+}
+
+// mediaProcessingError is the failure of an ffmpeg or ffprobe step. Files
+// that make them run past their timeout are most likely malformed, so
+// that's reported as the client's problem. The full stderr is logged at
+// debug level, clients only ever see message.
+func mediaProcessingError(videoID uuid.UUID, message string, err error) *videoProcessingError {
+	var cmdErr *mediaCommandError
+	if errors.As(err, &cmdErr) {
+		slog.Debug("media command failed", "video_id", videoID, "error", cmdErr.err, "stderr", cmdErr.stderr)
+	}
+	if errors.Is(err, errMediaTimeout) {
+		return &videoProcessingError{http.StatusUnprocessableEntity, errCodeProcessingTimeout, "Video took too long to process", err}
+	}
+	if errors.Is(err, errMediaBusy) {
+		return &videoProcessingError{http.StatusServiceUnavailable, errCodeMediaBusy, "Too many videos are being processed, try again later", err}
+	}
+	return &videoProcessingError{http.StatusInternalServerError, errCodeProcessingFailed, message, err}
+}
+
+// mediaStepError is mediaProcessingError for processVideo, which runs on a
+// worker with no response to write. Failures are only logged once the
+// video is marked as failed, so this just says which step it was.
+func mediaStepError(ctx context.Context, videoID uuid.UUID, step string, err error) error {
+	var cmdErr *mediaCommandError
+	if errors.As(err, &cmdErr) {
+		slog.DebugContext(ctx, "media command failed", "video_id", videoID, "error", cmdErr.err, "stderr", cmdErr.stderr)
+	}
+	return fmt.Errorf("%s: %w", step, err)
+}
+
+func respondWithProcessingError(w http.ResponseWriter, err error) {
+	setMediaBusyRetryAfter(w, err)
+	var procErr *videoProcessingError
+	if errors.As(err, &procErr) {
+		respondWithErrorCode(w, procErr.status, procErr.code, procErr.message, procErr.err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Failed to process video", err)
+}
+
+// localFileSize is the size of the file at path, 0 if it can't be read
+func localFileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// processVideo runs a staged upload through probing, faststart, thumbnail,
+// rendition and HLS generation, uploads everything to S3 and saves the
+// resulting URLs on the video row.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, src videoSource) (database.Video, error) {
+	// ---- Probe the upload, rejecting corrupt or empty videos ----
+	// Every later step works from this one probe
+	sourceMeta, err := cfg.validateVideoFile(src.path)
+	if err != nil {
+		return video, mediaStepError(ctx, video.ID, "couldn't read video metadata", err)
+	}
+
+	// ---- Confirm the contents match the declared type ----
+	if !videoFormatMatchesType(sourceMeta.FormatName, src.mediaType) {
+		return video, fmt.Errorf("file contents (%s) do not match declared type %s", sourceMeta.FormatName, src.mediaType)
+	}
+
+	// ---- Check there's audio to normalize ----
+	normalizeAudio := src.normalizeAudio && sourceMeta.HasAudio
+	if src.normalizeAudio && !sourceMeta.HasAudio {
+		slog.InfoContext(ctx, "video has no audio track, skipping loudness normalization", "video_id", video.ID)
+	}
+
+	// ---- Check browsers can play the video codec ----
+	transcode, err := cfg.codecNeedsTranscode(sourceMeta.VideoCodec)
+	if err != nil {
+		return video, fmt.Errorf("unsupported video codec %q: %w", sourceMeta.VideoCodec, err)
+	}
+
+	// ---- Check the bitrate is under the ceiling ----
+	// Re-encoding is slow, so videos within it keep their video stream as
+	// it is wherever the container and codec allow
+	if cfg.maxVideoBitrate > 0 {
+		if cfg.exceedsBitrateCeiling(sourceMeta) {
+			slog.InfoContext(ctx, "video is over the bitrate ceiling, re-encoding it", "video_id", video.ID, "bitrate_kbps", sourceMeta.Bitrate/1000, "ceiling_kbps", cfg.maxVideoBitrate/1000)
+			transcode = true
+		} else {
+			slog.InfoContext(ctx, "video is within the bitrate ceiling, not re-encoding it for bitrate", "video_id", video.ID, "bitrate_kbps", sourceMeta.Bitrate/1000, "ceiling_kbps", cfg.maxVideoBitrate/1000)
+		}
+	}
+
+	// ---- Process video to faststart MP4 (transcoding non-MP4 inputs) ----
+	// A watermark needs a re-encode anyway, which also takes care of this
+	processedPath := src.path
+	switch {
+	case src.watermarkPath != "":
+		processedPath, err = cfg.applyWatermark(src.path, src.watermarkPath, src.watermarkPosition, normalizeAudio)
+		if err != nil {
+			return video, mediaStepError(ctx, video.ID, "couldn't watermark video", err)
+		}
+		defer os.Remove(processedPath)
+	case !src.fastStart || normalizeAudio || transcode || src.rotate != 0:
+		processedPath, err = cfg.processVideoForFastStart(video.ID, src.path, src.mediaType, sourceMeta.Duration, normalizeAudio, transcode, src.rotate)
+		if err != nil {
+			return video, mediaStepError(ctx, video.ID, "couldn't process video", err)
+		}
+		defer os.Remove(processedPath)
+	}
+
+	// ---- Probe the file that will be stored ----
+	// Only if ffmpeg wrote a new one, whose size, codec and, once rotated,
+	// dimensions aren't the upload's
+	meta := sourceMeta
+	if processedPath != src.path {
+		meta, err = cfg.probeVideo(processedPath)
+		if err != nil {
+			return video, mediaStepError(ctx, video.ID, "couldn't read processed video metadata", err)
+		}
+	}
+	if meta.Duration == 0 {
+		// Some streams don't report a duration, which shouldn't fail the upload
+		slog.InfoContext(ctx, "couldn't determine duration of video, defaulting to 0", "video_id", video.ID)
+	}
+	video.Duration = meta.Duration
+	if meta.Size > 0 {
+		video.FileSize = meta.Size
+	}
+	video.FormatName = meta.FormatName
+	video.VideoCodec = meta.VideoCodec
+	video.Width = meta.Width
+	video.Height = meta.Height
+
+	// ---- Categorize Orientation ----
+	orientation := classifyOrientation(meta.Width, meta.Height)
+
+	// ---- Generate a thumbnail if the user never uploaded one ----
+	var generated database.Video
+	if video.ThumbnailURL == nil {
+		thumbnailPath, err := cfg.extractThumbnail(processedPath, meta.Duration, defaultThumbnailSeconds)
+		if err != nil {
+			slog.ErrorContext(ctx, "couldn't extract thumbnail", "video_id", video.ID, "error", err)
+		} else {
+			defer os.Remove(thumbnailPath)
+			thumbnails, err := cfg.saveThumbnailAsset(ctx, video.ID, thumbnailPath)
+			if err != nil {
+				slog.ErrorContext(ctx, "couldn't save thumbnail", "video_id", video.ID, "error", err)
+			} else {
+				thumbnailURL := thumbnails[len(thumbnails)-1].URL
+				video.ThumbnailURL = &thumbnailURL
+				video.Thumbnails = thumbnails
+				video.ThumbnailBytes = thumbnailSizesBytes(thumbnails)
+				generated = database.Video{ID: video.ID, ThumbnailURL: video.ThumbnailURL, Thumbnails: thumbnails}
+			}
+		}
+	}
+
+	// ---- Generate a sprite sheet for scrubbing previews ----
+	// Players work without one, so a failure here doesn't fail the upload
+	spritePath, spriteVTTPath, err := cfg.generateSpriteSheet(processedPath, meta, spriteIntervalSeconds)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't generate sprite sheet", "video_id", video.ID, "error", err)
+	} else {
+		defer os.Remove(spritePath)
+		defer os.Remove(spriteVTTPath)
+	}
+
+	// ---- Generate lower resolution renditions ----
+	renditions, err := cfg.processVideoRenditions(processedPath, meta)
+	if err != nil {
+		return video, mediaStepError(ctx, video.ID, "couldn't generate video renditions", err)
+	}
+	defer func() {
+		for _, rendition := range renditions {
+			os.Remove(rendition.Path)
+		}
+	}()
+	if len(renditions) == 0 {
+		slog.InfoContext(ctx, "video is smaller than the smallest rendition, keeping the original only", "video_id", video.ID, "min_rendition_height", renditionHeights[0])
+	}
+
+	// ---- Generate storage key ----
+	// Everything stored for the video goes under videoKeyBase. The playback
+	// file is always MP4, whatever the uploaded container was.
+	videoKeyBase := tenantKey(src.tenantID, userVideoKeyBase(video.UserID, orientation))
+	videoKey := videoKeyBase + "/" + playbackVideoName
+
+	// ---- Upload to storage ----
+	processedFile, err := os.Open(processedPath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't read processed video: %w", err)
+	}
+	defer processedFile.Close()
+
+	storageClass := src.storageClass
+	if storageClass == "" {
+		storageClass = defaultStorageClass
+	}
+	putOptions := func(contentType string) PutOptions {
+		return PutOptions{
+			ContentType:  contentType,
+			StorageClass: storageClass,
+			Tags:         cfg.videoObjectTags(video, storageClass, orientation, contentType),
+		}
+	}
+
+	err = src.storage.Put(ctx, videoKey, processedFile, putOptions("video/mp4"))
+	if err != nil {
+		return video, fmt.Errorf("failed to upload video to storage: %w", err)
+	}
+
+	// Everything stored besides the playback file counts against the
+	// owner's quota as well
+	var derivedBytes int64
+	if !src.fromPlayback {
+		video.OriginalURL = nil
+		video.OriginalMediaType = ""
+	} else if video.OriginalURL != nil {
+		// Kept as it was, so counted as it was stored
+		originalBytes, err := cfg.storedObjectSize(ctx, *video.OriginalURL)
+		if err != nil {
+			slog.ErrorContext(ctx, "couldn't get size of original of video, not counting it", "video_id", video.ID, "error", err)
+		}
+		derivedBytes += originalBytes
+	}
+	if src.keepOriginal && !src.fromPlayback {
+		originalKey := originalVideoKey(videoKeyBase, src.mediaType)
+		if err := uploadFile(ctx, src.storage, src.path, originalKey, putOptions(src.mediaType)); err != nil {
+			return video, fmt.Errorf("failed to upload original video to storage: %w", err)
+		}
+		storedOriginal := storedURL(src.storage, originalKey)
+		video.OriginalURL = &storedOriginal
+		video.OriginalMediaType = src.mediaType
+		derivedBytes += localFileSize(src.path)
+	}
+
+	video.Renditions = nil
+	for _, rendition := range renditions {
+		renditionKey := fmt.Sprintf("%s/%s.mp4", videoKeyBase, rendition.Name)
+		if err := uploadFile(ctx, src.storage, rendition.Path, renditionKey, putOptions("video/mp4")); err != nil {
+			return video, fmt.Errorf("failed to upload video rendition to storage: %w", err)
+		}
+		derivedBytes += localFileSize(rendition.Path)
+		video.Renditions = append(video.Renditions, database.VideoRendition{
+			Name: rendition.Name,
+			URL:  storedURL(src.storage, renditionKey),
+		})
+	}
+
+	// ---- Segment for HLS streaming ----
+	playlistPath, segmentPaths, err := cfg.processVideoForHLS(processedPath)
+	if err != nil {
+		return video, mediaStepError(ctx, video.ID, "couldn't generate HLS playlist", err)
+	}
+	defer os.RemoveAll(filepath.Dir(playlistPath))
+
+	hlsPrefix := videoKeyBase + "/hls/"
+	for _, segmentPath := range segmentPaths {
+		segmentKey := hlsPrefix + filepath.Base(segmentPath)
+		if err := uploadFile(ctx, src.storage, segmentPath, segmentKey, putOptions("video/mp2t")); err != nil {
+			return video, fmt.Errorf("failed to upload HLS segment to storage: %w", err)
+		}
+		derivedBytes += localFileSize(segmentPath)
+	}
+	playlistKey := hlsPrefix + hlsPlaylistName
+	if err := uploadFile(ctx, src.storage, playlistPath, playlistKey, putOptions("application/vnd.apple.mpegurl")); err != nil {
+		return video, fmt.Errorf("failed to upload HLS playlist to storage: %w", err)
+	}
+	derivedBytes += localFileSize(playlistPath)
+	storedPlaylist := storedURL(src.storage, playlistKey)
+	video.HLSPlaylistURL = &storedPlaylist
+
+	video.SpriteSheetURL = nil
+	video.SpriteVTTURL = nil
+	if spritePath != "" {
+		spriteKey := videoKeyBase + "/" + spriteSheetName
+		if err := uploadFile(ctx, src.storage, spritePath, spriteKey, putOptions("image/jpeg")); err != nil {
+			return video, fmt.Errorf("failed to upload sprite sheet to storage: %w", err)
+		}
+		spriteVTTKey := videoKeyBase + "/" + spriteVTTName
+		if err := uploadFile(ctx, src.storage, spriteVTTPath, spriteVTTKey, putOptions("text/vtt")); err != nil {
+			return video, fmt.Errorf("failed to upload sprite sheet cues to storage: %w", err)
+		}
+		derivedBytes += localFileSize(spritePath) + localFileSize(spriteVTTPath)
+		storedSprite := storedURL(src.storage, spriteKey)
+		storedSpriteVTT := storedURL(src.storage, spriteVTTKey)
+		video.SpriteSheetURL = &storedSprite
+		video.SpriteVTTURL = &storedSpriteVTT
+	}
+
+	// ---- Update DB with the stored URL ----
+	// videoURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, videoKey)
+	// video.VideoURL = &videoURL
+	// ---- presigneed url logic ----
+	bucketAndKey := storedURL(src.storage, videoKey)
+	video.VideoURL = &bucketAndKey
+	video.Status = database.VideoStatusReady
+	video.StorageClass = storageClass
+	video.DerivedBytes = derivedBytes
+	if src.fromPlayback {
+		video.Rotation = (video.Rotation + src.rotate) % 360
+		// The stored files no longer match what uploads of the same file
+		// would be processed into
+		if video.ContentHash != "" && src.rotate != 0 {
+			video.ContentHash = processedContentHash(video.ContentHash, fmt.Sprintf("rotate=%d", src.rotate))
+		}
+	} else {
+		video.NormalizeAudio = src.normalizeAudio
+		video.Rotation = src.rotate
+	}
+
+	// Only the fields processing produced are saved, edits made while it ran
+	// stay
+	saved, err := cfg.db.UpdateProcessedVideo(video)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video record: %w", err)
+	}
+	video = saved
+	if generated.ThumbnailURL != nil {
+		// A thumbnail uploaded in the meantime is kept over the generated one
+		cfg.deleteReplacedThumbnails(ctx, generated, video)
+	}
+	cfg.notifyVideoStatus(video, database.VideoStatusReady)
+
+	return video, nil
+}
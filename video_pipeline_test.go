@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// TestVideoJobCleanup fails processing at each ffmpeg and ffprobe run that
+// writes a file, after it has written part of it, and checks nothing is
+// left in the temp directory
+func TestVideoJobCleanup(t *testing.T) {
+	tests := []struct {
+		name   string
+		ffmpeg string // runs whose arguments contain it fail
+		probe  string // otherwise ffprobe runs on files ending in it fail
+	}{
+		{
+			name:   "faststart pass fails",
+			ffmpeg: "-progress pipe:1",
+		},
+		{
+			name:   "a rendition fails after others were written",
+			ffmpeg: "scale=-2:720",
+		},
+		{
+			name:   "HLS fails after writing segments",
+			ffmpeg: "-f hls",
+		},
+		{
+			name:  "probing the processed file fails",
+			probe: ".processing",
+		},
+		{
+			name:  "probing the upload fails",
+			probe: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+
+			if tc.ffmpeg != "" {
+				cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", testFFmpegScript+"\ncase \"$*\" in *'"+tc.ffmpeg+"'*) exit 1;; esac")
+			} else {
+				cfg.ffprobePath = writeFakeCommand(t, "ffprobe", "for a; do last=$a; done\ncase \"$last\" in *'"+tc.probe+"') exit 1;; esac\necho '"+testProbeOutput+"'")
+			}
+			runQueuedVideoJobs(t, cfg)
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Status != database.VideoStatusFailed {
+				t.Errorf("video status = %q, want %q", stored.Status, database.VideoStatusFailed)
+			}
+			left, err := os.ReadDir(cfg.tempDir)
+			if err != nil {
+				t.Fatalf("couldn't read temp dir: %v", err)
+			}
+			for _, entry := range left {
+				t.Errorf("%s was left in the temp dir", entry.Name())
+			}
+		})
+	}
+}
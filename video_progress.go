@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoProgress is how far along the faststart pass of each video being
+// processed is, as a percentage. It's only kept in memory: after a restart
+// videos in processing report 0 until they're picked up again.
+type videoProgress struct {
+	mu      sync.Mutex
+	percent map[uuid.UUID]float64
+}
+
+func newVideoProgress() *videoProgress {
+	return &videoProgress{percent: map[uuid.UUID]float64{}}
+}
+
+func (p *videoProgress) set(videoID uuid.UUID, percent float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.percent[videoID] = percent
+}
+
+func (p *videoProgress) get(videoID uuid.UUID) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.percent[videoID]
+}
+
+func (p *videoProgress) clear(videoID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.percent, videoID)
+}
+
+// ffmpegProgressWriter reads the key=value lines ffmpeg writes with
+// -progress and records how much of duration, in seconds, has been written
+// out. It does no more than parse each line as it arrives, so it never
+// holds ffmpeg up.
+type ffmpegProgressWriter struct {
+	progress *videoProgress
+	videoID  uuid.UUID
+	duration float64
+	// partial is a line that hasn't been terminated yet
+	partial []byte
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	data := append(w.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			break
+		}
+		w.parseLine(strings.TrimSpace(string(line)))
+		data = rest
+	}
+	w.partial = append(w.partial[:0], data...)
+	return len(p), nil
+}
+
+func (w *ffmpegProgressWriter) parseLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	if key == "progress" && value == "end" {
+		w.progress.set(w.videoID, 100)
+		return
+	}
+	if w.duration <= 0 {
+		return
+	}
+
+	var seconds float64
+	switch key {
+	// Both are in microseconds, out_time_ms is misnamed. Either reads N/A
+	// until the first frame is written.
+	case "out_time_us", "out_time_ms":
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return
+		}
+		seconds = float64(us) / 1e6
+	// Older builds only report this, as HH:MM:SS.micro, which can start
+	// out negative
+	case "out_time":
+		d, err := parseFFmpegTime(value)
+		if err != nil {
+			return
+		}
+		seconds = d.Seconds()
+	default:
+		return
+	}
+
+	// 100 is left for when ffmpeg says it's done, output can run a little
+	// past the probed duration
+	percent := math.Min(math.Max(seconds/w.duration*100, 0), 99.9)
+	w.progress.set(w.videoID, math.Round(percent*10)/10)
+}
+
+// parseFFmpegTime parses ffmpeg's HH:MM:SS.micro timestamps
+func parseFFmpegTime(s string) (time.Duration, error) {
+	negative := strings.HasPrefix(s, "-")
+	parts := strings.Split(strings.TrimPrefix(s, "-"), ":")
+	if len(parts) != 3 {
+		return 0, strconv.ErrSyntax
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// handlerVideoProgress reports how far processing of one of the caller's
+// videos has got. The percentage covers the faststart pass, the slow part
+// for videos that need transcoding. Videos that don't stay at 0 until
+// they're ready.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoID uuid.UUID `json:"video_id"`
+		Status  string    `json:"status"`
+		// Percent is null for videos that aren't processing or ready
+		Percent *float64 `json:"percent"`
+	}
+
+	video, _, err := cfg.authorizeVideoAccess(r, videoRoleViewer)
+	if err != nil {
+		respondWithAccessError(w, err)
+		return
+	}
+
+	resp := response{VideoID: video.ID, Status: video.Status}
+	switch video.Status {
+	case database.VideoStatusProcessing:
+		percent := cfg.videoProgress.get(video.ID)
+		resp.Percent = &percent
+	case database.VideoStatusReady:
+		percent := 100.0
+		resp.Percent = &percent
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoJob is a raw upload already sitting in storage, waiting to be run
+// through processVideo
+type videoJob struct {
+	videoID uuid.UUID
+	// storage holds the raw upload, and is where the processed video goes
+	storage      Storage
+	rawKey       string
+	tenantID     string // of the video's owner, whose prefix its files go under
+	requestID    string // of the upload, so the job's logs can be traced to it
+	mediaType    string
+	size         int64
+	storageClass string
+	contentHash  string // SHA-256 of the original upload, if known
+	// rawChecksum is the base64 SHA-256 of the raw upload, which storage
+	// checks the staged copy against
+	rawChecksum string
+	// watermark, if set, is burned into the video in place of the plain
+	// faststart pass
+	watermark *videoWatermark
+	// normalizeAudio runs the audio through loudnorm, if there is any
+	normalizeAudio bool
+	// reprocess marks a job rerunning a video's kept original, which is
+	// never discarded here. The files it replaces, the original included,
+	// stay until it succeeds.
+	reprocess bool
+	// fromPlayback marks a reprocess job rerunning the video's playback file
+	// instead, which leaves its original, if kept, as it is
+	fromPlayback bool
+	// rotate is how many degrees clockwise the video is turned, 0 for none
+	rotate int
+}
+
+var errVideoQueueFull = errors.New("video processing queue is full")
+
+// startVideoWorkers spins up the pool that drains cfg.videoJobs. Once ctx
+// is cancelled, jobs still running or queued fail fast and are marked as
+// failed rather than being dropped.
+func (cfg *apiConfig) startVideoWorkers(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range cfg.videoJobs {
+				cfg.runVideoJob(ctx, job)
+				cfg.pendingVideoJobs.Done()
+			}
+		}()
+	}
+}
+
+// enqueueVideoJob never blocks, a full queue is reported to the caller so
+// the client can retry later
+func (cfg *apiConfig) enqueueVideoJob(job videoJob) error {
+	cfg.pendingVideoJobs.Add(1)
+	select {
+	case cfg.videoJobs <- job:
+		return nil
+	default:
+		cfg.pendingVideoJobs.Done()
+		return errVideoQueueFull
+	}
+}
+
+// waitForVideoJobs reports whether every queued and running job finished
+// within timeout
+func (cfg *apiConfig) waitForVideoJobs(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		cfg.pendingVideoJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// queueVideoProcessing flips the video to processing and hands the job to
+// the workers. The upload counts towards the owner's quota straight away,
+// and the response can already show the storage class. If the job can't be
+// queued the raw upload is discarded and the video is left as it was.
+func (cfg *apiConfig) queueVideoProcessing(ctx context.Context, video *database.Video, job videoJob) error {
+	previous := *video
+	video.Status = database.VideoStatusProcessing
+	video.FileSize = job.size
+	if job.storageClass != "" {
+		video.StorageClass = job.storageClass
+	}
+	video.ContentHash = job.contentHash
+	job.tenantID = requestTenant(ctx)
+	if info := requestInfoFromContext(ctx); info != nil {
+		job.requestID = info.id
+	}
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		*video = previous
+		discardRawUpload(ctx, job)
+		return err
+	}
+
+	if err := cfg.enqueueVideoJob(job); err != nil {
+		*video = previous
+		if err := cfg.db.UpdateVideo(*video); err != nil {
+			slog.ErrorContext(ctx, "couldn't restore status of video", "video_id", video.ID, "error", err)
+		}
+		discardRawUpload(ctx, job)
+		return err
+	}
+	return nil
+}
+
+func discardRawUpload(ctx context.Context, job videoJob) {
+	if err := job.storage.Delete(ctx, job.rawKey); err != nil {
+		slog.ErrorContext(ctx, "couldn't delete raw upload", "video_id", job.videoID, "key", job.rawKey, "error", err)
+	}
+}
+
+func (cfg *apiConfig) runVideoJob(ctx context.Context, job videoJob) {
+	defer cfg.videoProgress.clear(job.videoID)
+	if job.requestID != "" {
+		ctx = context.WithValue(ctx, requestInfoKey{}, &requestInfo{id: job.requestID})
+	}
+
+	// Processing copies whatever it keeps, so the staged upload is cleaned
+	// up, even when processing was cancelled
+	if !job.reprocess {
+		defer discardRawUpload(context.WithoutCancel(ctx), job)
+	}
+
+	video, err := cfg.db.GetVideoIncludingDeleted(job.videoID)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load video for processing", "video_id", job.videoID, "error", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		slog.InfoContext(ctx, "video was purged before it could be processed", "video_id", job.videoID)
+		return
+	}
+	if video.DeletedAt != nil {
+		// It isn't processed, but it can't be left processing either, or it
+		// couldn't be uploaded or reprocessed again once restored. Videos
+		// being reprocessed still have what they were playing.
+		slog.InfoContext(ctx, "video was deleted before it could be processed", "video_id", job.videoID)
+		status := database.VideoStatusFailed
+		if job.reprocess {
+			status = database.VideoStatusReady
+		}
+		if err := cfg.db.SetVideoStatus(video.ID, status); err != nil {
+			slog.ErrorContext(ctx, "couldn't update status of deleted video", "video_id", video.ID, "error", err)
+		}
+		return
+	}
+
+	// Checked before the video stops pointing at its current files
+	shared, err := cfg.storedObjectsShared(video)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't check for shared files of video, keeping them", "video_id", video.ID, "error", err)
+		shared = true
+	}
+
+	processed, err := cfg.processRawUpload(ctx, video, job)
+	if err != nil {
+		slog.ErrorContext(ctx, "processing video failed", "video_id", video.ID, "error", err)
+		// Only the status is saved, so edits made while it was processed stay
+		if job.reprocess {
+			// Nothing was replaced, so it can go on playing what it had
+			if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusReady); err != nil {
+				slog.ErrorContext(ctx, "couldn't restore status of video", "video_id", video.ID, "error", err)
+			}
+			return
+		}
+		video.Status = database.VideoStatusFailed
+		if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusFailed); err != nil {
+			slog.ErrorContext(ctx, "couldn't mark video as failed", "video_id", video.ID, "error", err)
+		}
+		cfg.notifyVideoStatus(video, database.VideoStatusFailed)
+		return
+	}
+
+	cfg.deleteReplacedFiles(context.WithoutCancel(ctx), video, processed, shared)
+}
+
+// deleteReplacedFiles removes the stored files a processed video no longer
+// points at. Best effort: whatever can't be deleted is only logged.
+func (cfg *apiConfig) deleteReplacedFiles(ctx context.Context, previous, current database.Video, shared bool) {
+	if !shared && previous.VideoURL != nil && *previous.VideoURL != "" && (current.VideoURL == nil || *current.VideoURL != *previous.VideoURL) {
+		if err := cfg.deleteProcessedObjects(ctx, previous); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete replaced files of video", "video_id", previous.ID, "error", err)
+		}
+	}
+
+	if previous.OriginalURL == nil || (current.OriginalURL != nil && *current.OriginalURL == *previous.OriginalURL) {
+		return
+	}
+	n, err := cfg.db.CountVideosByOriginalURL(*previous.OriginalURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't check for shared originals of video, keeping it", "video_id", previous.ID, "error", err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	if err := cfg.deleteStoredObject(ctx, *previous.OriginalURL); err != nil {
+		slog.ErrorContext(ctx, "couldn't delete replaced original of video", "video_id", previous.ID, "error", err)
+	}
+}
+
+// processRawUpload fetches the job's upload to local disk and processes it
+func (cfg *apiConfig) processRawUpload(ctx context.Context, video database.Video, job videoJob) (database.Video, error) {
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-*.mp4")
+	if err != nil {
+		return video, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	raw, err := job.storage.Get(ctx, job.rawKey)
+	if err != nil {
+		return video, fmt.Errorf("couldn't fetch raw upload: %w", err)
+	}
+	defer raw.Close()
+
+	size, err := io.Copy(tempFile, raw)
+	if err != nil {
+		return video, fmt.Errorf("failed to write video to temporary file: %w", err)
+	}
+
+	// An MP4 whose index already sits at the front is browser-ready, so the
+	// ffmpeg faststart pass can be skipped
+	fastStart := false
+	if job.mediaType == "video/mp4" {
+		fastStart, err = isFastStartMP4(tempFile, size)
+		if err != nil {
+			slog.ErrorContext(ctx, "couldn't inspect MP4 boxes of video, will process it", "video_id", video.ID, "error", err)
+			fastStart = false
+		}
+	}
+
+	src := videoSource{
+		path:           tempFile.Name(),
+		mediaType:      job.mediaType,
+		fastStart:      fastStart,
+		storage:        job.storage,
+		tenantID:       job.tenantID,
+		storageClass:   job.storageClass,
+		normalizeAudio: job.normalizeAudio,
+		rotate:         job.rotate,
+		fromPlayback:   job.fromPlayback,
+	}
+	if job.watermark != nil {
+		src.watermarkPath, err = writeWatermarkFile(cfg.tempDir, job.watermark)
+		if err != nil {
+			return video, fmt.Errorf("failed to write watermark to temporary file: %w", err)
+		}
+		defer os.Remove(src.watermarkPath)
+		src.watermarkPosition = job.watermark.position
+	} else {
+		// The logo isn't kept, so a watermarked upload couldn't be
+		// reprocessed the same way and its original isn't worth keeping.
+		// Reprocessing keeps the original it started from either way.
+		src.keepOriginal = cfg.keepOriginals || job.reprocess
+	}
+
+	return cfg.processVideo(ctx, video, src)
+}
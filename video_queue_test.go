@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestVideoQueueStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		ffmpeg     string
+		wantStatus string
+	}{
+		{
+			name:       "processed video becomes ready",
+			ffmpeg:     testFFmpegScript,
+			wantStatus: database.VideoStatusReady,
+		},
+		{
+			name:       "video ffmpeg can't process becomes failed",
+			ffmpeg:     "exit 1",
+			wantStatus: database.VideoStatusFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", tc.ffmpeg)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			var resp database.Video
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if resp.Status != database.VideoStatusProcessing {
+				t.Fatalf("response status = %q, want %q", resp.Status, database.VideoStatusProcessing)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cfg.startVideoWorkers(ctx, cfg.videoWorkers)
+			if !cfg.waitForVideoJobs(10 * time.Second) {
+				t.Fatal("video job didn't finish")
+			}
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Status != tc.wantStatus {
+				t.Errorf("video status = %q, want %q", stored.Status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+// newCaptionUploadRequest is a multipart upload of a one cue WebVTT track
+// for language
+func newCaptionUploadRequest(t *testing.T, videoID uuid.UUID, language string) *http.Request {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("language", language)
+	part, err := writer.CreateFormFile("captions", "captions.vtt")
+	if err != nil {
+		t.Fatalf("couldn't create form part: %v", err)
+	}
+	part.Write([]byte("WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nHello\n"))
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+videoID.String()+"/captions", &form)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.SetPathValue("videoID", videoID.String())
+	// The tenant middleware isn't in front of handlers called directly
+	return r.WithContext(withRequestTenant(r.Context(), ""))
+}
+
+// pauseFFmpeg makes the first run of cfg's fake ffmpeg wait until release
+// is called. waitPaused returns once that run has started.
+func pauseFFmpeg(t *testing.T, cfg *apiConfig) (waitPaused, release func()) {
+	t.Helper()
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	released := filepath.Join(dir, "released")
+	cfg.ffmpegPath = writeFakeCommand(t, "ffmpeg", `if [ ! -e '`+started+`' ]; then
+	touch '`+started+`'
+	while [ ! -e '`+released+`' ]; do sleep 0.01; done
+fi
+`+testFFmpegScript)
+
+	waitPaused = func() {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(started); err == nil {
+				return
+			}
+		}
+		t.Fatal("ffmpeg never started")
+	}
+	release = func() {
+		if err := os.WriteFile(released, nil, 0o600); err != nil {
+			t.Errorf("couldn't release ffmpeg: %v", err)
+		}
+	}
+	return waitPaused, release
+}
+
+// TestRunVideoJobKeepsEdits checks processing and changes made to a video
+// while it's being processed don't undo each other
+func TestRunVideoJobKeepsEdits(t *testing.T) {
+	tests := []struct {
+		name string
+		// edit changes the video while it's being processed, or once it's
+		// processed from snapshot, the video as it was before
+		edit      func(t *testing.T, cfg *apiConfig, snapshot database.Video, owner uuid.UUID)
+		editAfter bool
+		check     func(t *testing.T, edited, stored database.Video)
+	}{
+		{
+			name: "title edited while processing",
+			edit: func(t *testing.T, cfg *apiConfig, snapshot database.Video, owner uuid.UUID) {
+				etag := getTestVideoETag(t, cfg, snapshot.ID, owner)
+				if w := updateTestVideo(t, cfg, snapshot.ID, owner, etag, "Edited title"); w.Code != http.StatusOK {
+					t.Fatalf("PUT status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+				}
+			},
+			check: func(t *testing.T, edited, stored database.Video) {
+				if stored.Title != "Edited title" {
+					t.Errorf("title = %q, want %q", stored.Title, "Edited title")
+				}
+			},
+		},
+		{
+			name: "thumbnail uploaded while processing",
+			edit: func(t *testing.T, cfg *apiConfig, snapshot database.Video, owner uuid.UUID) {
+				r := newThumbnailUploadRequest(t, snapshot.ID, "image/png", testPNG(t))
+				authorizeTestRequest(t, r, owner)
+				w := httptest.NewRecorder()
+				cfg.handlerUploadThumbnail(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("thumbnail status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+				}
+			},
+			check: func(t *testing.T, edited, stored database.Video) {
+				if edited.ThumbnailURL == nil {
+					t.Fatal("uploaded thumbnail wasn't saved")
+				}
+				if stored.ThumbnailURL == nil || *stored.ThumbnailURL != *edited.ThumbnailURL {
+					t.Errorf("thumbnail = %v, want the uploaded %q", stored.ThumbnailURL, *edited.ThumbnailURL)
+				}
+			},
+		},
+		{
+			name: "captions uploaded while processing",
+			edit: func(t *testing.T, cfg *apiConfig, snapshot database.Video, owner uuid.UUID) {
+				r := newCaptionUploadRequest(t, snapshot.ID, "en")
+				authorizeTestRequest(t, r, owner)
+				w := httptest.NewRecorder()
+				cfg.handlerUploadCaptions(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("captions status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+				}
+			},
+			check: func(t *testing.T, edited, stored database.Video) {
+				if len(stored.Captions) != 1 || stored.Captions[0].Language != "en" {
+					t.Errorf("captions = %v, want the uploaded en track", stored.Captions)
+				}
+			},
+		},
+		{
+			name:      "thumbnail saved from before processing",
+			editAfter: true,
+			edit: func(t *testing.T, cfg *apiConfig, snapshot database.Video, owner uuid.UUID) {
+				thumbnailURL := "http://localhost:8091/assets/stale.abc123.png"
+				snapshot.ThumbnailURL = &thumbnailURL
+				snapshot.Thumbnails = nil
+				if _, err := cfg.db.UpdateVideoThumbnail(snapshot); err != nil {
+					t.Fatalf("UpdateVideoThumbnail: %v", err)
+				}
+			},
+			check: func(t *testing.T, edited, stored database.Video) {
+				if stored.ThumbnailURL == nil || *stored.ThumbnailURL != "http://localhost:8091/assets/stale.abc123.png" {
+					t.Errorf("thumbnail = %v, want the one saved", stored.ThumbnailURL)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			snapshot, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+
+			waitPaused, release := pauseFFmpeg(t, cfg)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runQueuedVideoJobs(t, cfg)
+			}()
+			waitPaused()
+			if !tc.editAfter {
+				tc.edit(t, cfg, snapshot, owner)
+			}
+			edited, err := cfg.db.GetVideo(video.ID)
+			release()
+			<-done
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if tc.editAfter {
+				tc.edit(t, cfg, snapshot, owner)
+			}
+
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if stored.Status != database.VideoStatusReady || stored.VideoURL == nil {
+				t.Errorf("video status = %q with URL %v, want it ready", stored.Status, stored.VideoURL)
+			}
+			tc.check(t, edited, stored)
+		})
+	}
+}
+
+// TestRunVideoJobDeletedVideo checks a video deleted while its job was
+// queued isn't left processing, so it can be uploaded again once restored
+func TestRunVideoJobDeletedVideo(t *testing.T) {
+	tests := []struct {
+		name       string
+		reprocess  bool
+		wantStatus string
+	}{
+		{
+			name:       "new upload",
+			wantStatus: database.VideoStatusFailed,
+		},
+		{
+			name:       "reprocessing",
+			reprocess:  true,
+			wantStatus: database.VideoStatusReady,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			owner := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner)
+			storage, err := cfg.storageRegions.forRegion("")
+			if err != nil {
+				t.Fatalf("forRegion: %v", err)
+			}
+			if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusProcessing); err != nil {
+				t.Fatalf("SetVideoStatus: %v", err)
+			}
+			if err := cfg.db.SoftDeleteVideo(video.ID); err != nil {
+				t.Fatalf("SoftDeleteVideo: %v", err)
+			}
+
+			cfg.runVideoJob(context.Background(), videoJob{
+				videoID:   video.ID,
+				storage:   storage,
+				rawKey:    "uploads/" + video.ID.String(),
+				mediaType: "video/mp4",
+				reprocess: tc.reprocess,
+			})
+
+			stored, err := cfg.db.GetVideoIncludingDeleted(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideoIncludingDeleted: %v", err)
+			}
+			if stored.Status != tc.wantStatus {
+				t.Fatalf("status = %q, want %q", stored.Status, tc.wantStatus)
+			}
+
+			if err := cfg.db.RestoreVideo(video.ID); err != nil {
+				t.Fatalf("RestoreVideo: %v", err)
+			}
+			r := newVideoUploadRequest(t, video.ID, "video/mp4", []byte("an upload"))
+			authorizeTestRequest(t, r, owner)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Errorf("upload after restoring status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+		})
+	}
+}
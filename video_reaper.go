@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	videoReaperInterval = time.Hour
+	// Purged per pass, anything left over is picked up by the next one
+	videoReaperBatchSize = 100
+)
+
+// startVideoReaper permanently deletes videos that have been soft deleted
+// for longer than retention, along with expired idempotency keys, until
+// ctx is cancelled
+func (cfg *apiConfig) startVideoReaper(ctx context.Context, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(videoReaperInterval)
+		defer ticker.Stop()
+		for {
+			cfg.reapDeletedVideos(ctx, retention)
+			if err := cfg.db.DeleteIdempotencyKeysBefore(time.Now().Add(-cfg.idempotencyKeyTTL)); err != nil {
+				log.Printf("couldn't delete expired idempotency keys: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) reapDeletedVideos(ctx context.Context, retention time.Duration) {
+	videos, err := cfg.db.ListVideosDeletedBefore(time.Now().Add(-retention), videoReaperBatchSize)
+	if err != nil {
+		log.Printf("couldn't list deleted videos to purge: %v", err)
+		return
+	}
+	for _, video := range videos {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := cfg.purgeVideo(ctx, video); err != nil {
+			log.Printf("couldn't purge video %s: %v", video.ID, err)
+		}
+	}
+}
+
+// purgeVideo removes a video's row along with its stored files and
+// thumbnails. The row goes last, so a failed purge is retried next pass.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	// Identical uploads share stored objects. Purged side by side, each
+	// would see the other still using them and leave them behind.
+	if video.VideoURL != nil {
+		unlock := cfg.purgeLocks.lock(*video.VideoURL)
+		defer unlock()
+	}
+	// Identical uploads share stored objects, which stay until the last
+	// video using them is purged
+	shared, err := cfg.storedObjectsShared(video)
+	if err != nil {
+		return fmt.Errorf("couldn't check for shared video files: %w", err)
+	}
+	if !shared {
+		if err := cfg.deleteProcessedObjects(ctx, video); err != nil {
+			return err
+		}
+	}
+	// Reprocessing one of them gives it its own processed objects, but
+	// the original stays shared
+	if video.OriginalURL != nil {
+		n, err := cfg.db.CountVideosByOriginalURL(*video.OriginalURL)
+		if err != nil {
+			return fmt.Errorf("couldn't check for shared originals: %w", err)
+		}
+		if n <= 1 {
+			if err := cfg.deleteStoredObject(ctx, *video.OriginalURL); err != nil {
+				return fmt.Errorf("couldn't delete original upload from storage: %w", err)
+			}
+		}
+	}
+
+	// Captions belong to this video alone, even when its files are shared
+	for _, caption := range video.Captions {
+		if err := cfg.deleteStoredObject(ctx, caption.URL); err != nil {
+			return fmt.Errorf("couldn't delete captions from storage: %w", err)
+		}
+	}
+
+	if err := cfg.deleteThumbnailAssets(ctx, video); err != nil {
+		return fmt.Errorf("couldn't delete thumbnail: %w", err)
+	}
+
+	if err := cfg.db.DeleteShareLinksForVideo(video.ID); err != nil {
+		return fmt.Errorf("couldn't delete share links: %w", err)
+	}
+	if err := cfg.db.DeleteVideoPermissions(video.ID); err != nil {
+		return fmt.Errorf("couldn't delete video permissions: %w", err)
+	}
+	if err := cfg.db.DeleteIdempotencyKeysForVideo(video.ID); err != nil {
+		return fmt.Errorf("couldn't delete idempotency keys: %w", err)
+	}
+	return cfg.db.DeleteVideo(video.ID)
+}
+
+// deleteProcessedObjects removes everything processing stored for a
+// video: the playback file, its renditions, sprite sheet and HLS files
+func (cfg *apiConfig) deleteProcessedObjects(ctx context.Context, video database.Video) error {
+	if video.VideoURL != nil && *video.VideoURL != "" {
+		if err := cfg.deleteStoredObject(ctx, *video.VideoURL); err != nil {
+			return fmt.Errorf("couldn't delete video from storage: %w", err)
+		}
+	}
+	for _, rendition := range video.Renditions {
+		if err := cfg.deleteStoredObject(ctx, rendition.URL); err != nil {
+			return fmt.Errorf("couldn't delete video rendition from storage: %w", err)
+		}
+	}
+	for _, stored := range []*string{video.SpriteSheetURL, video.SpriteVTTURL} {
+		if stored != nil && *stored != "" {
+			if err := cfg.deleteStoredObject(ctx, *stored); err != nil {
+				return fmt.Errorf("couldn't delete sprite sheet from storage: %w", err)
+			}
+		}
+	}
+	if video.HLSPlaylistURL != nil && *video.HLSPlaylistURL != "" {
+		if err := cfg.deleteStoredPrefix(ctx, *video.HLSPlaylistURL); err != nil {
+			return fmt.Errorf("couldn't delete HLS files from storage: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Logos are composited at their own size, so anything bigger would
+	// cover most of a small video
+	maxWatermarkDimension = 512
+	maxWatermarkBytes     = 1 << 20 // 1 MB
+	// watermarkMargin is the gap in pixels between the logo and the edges
+	watermarkMargin = 16
+
+	defaultWatermarkPosition = "bottom-right"
+)
+
+// watermarkOverlays are the ffmpeg overlay coordinates for each corner. W
+// and H are the video's size, w and h the logo's.
+var watermarkOverlays = map[string]string{
+	"top-left":     fmt.Sprintf("%d:%d", watermarkMargin, watermarkMargin),
+	"top-right":    fmt.Sprintf("W-w-%d:%d", watermarkMargin, watermarkMargin),
+	"bottom-left":  fmt.Sprintf("%d:H-h-%d", watermarkMargin, watermarkMargin),
+	"bottom-right": fmt.Sprintf("W-w-%d:H-h-%d", watermarkMargin, watermarkMargin),
+}
+
+// videoWatermark is a logo to burn into a video. It's small enough to ride
+// along with the queued job rather than being staged in storage.
+type videoWatermark struct {
+	png      []byte
+	position string
+}
+
+// readWatermark validates the optional "watermark" form field, returning
+// nil if there isn't one. Failures are a *videoUploadError.
+func readWatermark(r *http.Request) (*videoWatermark, error) {
+	file, header, err := r.FormFile("watermark")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidForm, "Couldn't read watermark", err}
+	}
+	defer file.Close()
+
+	position := r.FormValue("watermark_position")
+	if position == "" {
+		position = defaultWatermarkPosition
+	}
+	if _, ok := watermarkOverlays[position]; !ok {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidForm, "Invalid watermark_position: must be one of top-left, top-right, bottom-left or bottom-right", nil}
+	}
+
+	if header.Size > maxWatermarkBytes {
+		return nil, &videoUploadError{http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Watermark exceeds the maximum size of %d bytes", maxWatermarkBytes), nil}
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxWatermarkBytes+1))
+	if err != nil {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't read watermark", err}
+	}
+	if len(data) > maxWatermarkBytes {
+		return nil, &videoUploadError{http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Watermark exceeds the maximum size of %d bytes", maxWatermarkBytes), nil}
+	}
+
+	// Only the bytes count, whatever Content-Type the part declared
+	if http.DetectContentType(data) != "image/png" {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidMediaType, "Invalid watermark: must be a PNG", nil}
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't decode watermark", err}
+	}
+	if config.Width > maxWatermarkDimension || config.Height > maxWatermarkDimension {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeImageTooLarge, fmt.Sprintf("Watermark must be at most %dx%d pixels", maxWatermarkDimension, maxWatermarkDimension), nil}
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidImage, "Watermark has no pixels", nil}
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		return nil, &videoUploadError{http.StatusBadRequest, errCodeInvalidImage, "Couldn't decode watermark", err}
+	}
+
+	return &videoWatermark{png: data, position: position}, nil
+}
+
+// contentHash folds the watermark into an upload's content hash, so a
+// watermarked video is only ever reused for the same video, logo and
+// position, and never for a plain upload of the same file
+func (wm *videoWatermark) contentHash(videoHash string) string {
+	logoHash := sha256.Sum256(wm.png)
+	return processedContentHash(videoHash, "watermark="+hex.EncodeToString(logoHash[:]), wm.position)
+}
+
+// applyWatermark writes a copy of the video with the logo composited in
+// the given corner. Unlike the faststart pass the video has to be
+// re-encoded, and the copy is a faststart MP4 so it replaces that pass,
+// normalizing the audio the same way if asked to. Nothing is left on disk
+// if ffmpeg fails.
+func (cfg *apiConfig) applyWatermark(videoPath, logoPath, position string, normalizeAudio bool) (_ string, err error) {
+	overlay, ok := watermarkOverlays[position]
+	if !ok {
+		return "", fmt.Errorf("unknown watermark position %q", position)
+	}
+
+	absPath, err := filepath.Abs(videoPath)
+	if err != nil {
+		return "", err
+	}
+
+	processedPath := absPath + ".watermarked"
+	defer func() {
+		if err != nil {
+			os.Remove(processedPath)
+		}
+	}()
+
+	args := []string{
+		"-i", absPath,
+		"-i", logoPath,
+		"-filter_complex", "[0:v][1:v]overlay=" + overlay + "[v]",
+		"-map", "[v]",
+		"-map", "0:a?",
+	}
+	args = append(args, cfg.videoEncodeArgs()...)
+	args = append(args, cfg.audioCodecArgs(normalizeAudio)...)
+	args = append(args,
+		"-movflags", "faststart",
+		"-f", "mp4",
+		processedPath,
+	)
+	cmd := cfg.transcodeCommand(cfg.ffmpegPath, args...)
+
+	start := time.Now()
+	err = cmd.Run()
+	ffmpegDuration.WithLabelValues("watermark", metricResult(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", fmt.Errorf("failed to execute ffmpeg: %w", err)
+	}
+	return processedPath, nil
+}
+
+// writeWatermarkFile puts the logo on disk for ffmpeg to read
+func writeWatermarkFile(dir string, wm *videoWatermark) (string, error) {
+	file, err := os.CreateTemp(dir, "tubely-watermark-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(wm.png); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	webhookMaxRetries     = 3
+	webhookInitialBackoff = time.Second
+	webhookTimeout        = 10 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type webhookPayload struct {
+	VideoID  string `json:"videoID"`
+	Status   string `json:"status"`
+	VideoURL string `json:"videoURL"`
+}
+
+// notifyVideoStatus tells the configured webhook about a video in the
+// background. Delivery failures are only logged, they never affect the
+// request that triggered them.
+func (cfg *apiConfig) notifyVideoStatus(video database.Video, status string) {
+	if cfg.webhookURL == "" {
+		return
+	}
+
+	payload := webhookPayload{
+		VideoID: video.ID.String(),
+		Status:  status,
+	}
+	if video.VideoURL != nil && *video.VideoURL != "" {
+		// The notification outlives whatever triggered it
+		ctx, err := cfg.withOwnerTenant(context.Background(), video.UserID)
+		var signedURL string
+		if err == nil {
+			signedURL, err = cfg.signStoredURL(ctx, *video.VideoURL, cfg.presignExpiry, SignOptions{})
+		}
+		if err != nil {
+			log.Printf("couldn't sign video URL for webhook on video %s: %v", video.ID, err)
+		} else {
+			payload.VideoURL = signedURL
+		}
+	}
+
+	go func() {
+		if err := cfg.sendWebhook(payload); err != nil {
+			log.Printf("webhook delivery for video %s failed: %v", video.ID, err)
+		}
+	}()
+}
+
+func (cfg *apiConfig) sendWebhook(payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.webhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := webhookInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(cfg.webhookURL, body, signature)
+		if err == nil {
+			return nil
+		}
+		if attempt == webhookMaxRetries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tubely-Signature", signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}